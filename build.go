@@ -247,7 +247,7 @@ func assets() {
 }
 
 func xdr() {
-	for _, f := range []string{"internal/discover/packets", "internal/files/leveldb", "internal/protocol/message"} {
+	for _, f := range []string{"internal/discover/cache", "internal/discover/packets", "internal/model/pendingrecord", "internal/relay/packets", "internal/files/leveldb", "internal/protocol/message"} {
 		runPipe(f+"_xdr.go", "go", "run", "./Godeps/_workspace/src/github.com/calmh/xdr/cmd/genxdr/main.go", "--", f+".go")
 	}
 }
@@ -0,0 +1,62 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/juju/ratelimit"
+)
+
+// A limiter keeps a token bucket per source address. The number of tracked
+// addresses is bounded; when the limit is reached all buckets are forgotten
+// and start over full.
+type limiter struct {
+	avg     float64
+	burst   int64
+	size    int
+	mut     sync.Mutex
+	buckets map[string]*ratelimit.Bucket
+}
+
+func newLimiter(avg float64, burst, size int) *limiter {
+	return &limiter{
+		avg:     avg,
+		burst:   int64(burst),
+		size:    size,
+		buckets: make(map[string]*ratelimit.Bucket),
+	}
+}
+
+// allow returns true if a packet from the given address should be processed.
+func (l *limiter) allow(ip net.IP) bool {
+	key := string(ip.To16())
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.size {
+			l.buckets = make(map[string]*ratelimit.Bucket)
+		}
+		bucket = ratelimit.NewBucketWithRate(l.avg, l.burst)
+		l.buckets[key] = bucket
+	}
+
+	return bucket.TakeAvailable(1) == 1
+}
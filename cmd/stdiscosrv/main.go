@@ -0,0 +1,84 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Command stdiscosrv is a global discovery server for syncthing. It accepts
+// device announcements, remembers them for a while and answers queries for
+// them.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var debug bool
+
+func main() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags)
+
+	var listen, dbDir, statsListen string
+	var expiry, statsIntv time.Duration
+	var limitAvg float64
+	var limitBurst, limitCache int
+
+	flag.StringVar(&listen, "listen", ":22026", "Listen address")
+	flag.StringVar(&dbDir, "db", "discosrv.db", "Database directory")
+	flag.DurationVar(&expiry, "expiry", time.Hour, "Time after which an announcement is forgotten")
+	flag.Float64Var(&limitAvg, "limit-avg", 1, "Allowed average packets per second, per source address")
+	flag.IntVar(&limitBurst, "limit-burst", 10, "Allowed burst size, packets, per source address")
+	flag.IntVar(&limitCache, "limit-cache", 10240, "Number of source addresses to track rate limits for")
+	flag.DurationVar(&statsIntv, "stats-intv", 5*time.Minute, "Statistics log interval (0 to disable)")
+	flag.StringVar(&statsListen, "stats-listen", "", "Address to serve statistics on over HTTP (empty to disable)")
+	flag.BoolVar(&debug, "debug", false, "Enable debug output")
+	flag.Parse()
+
+	db, err := leveldb.OpenFile(dbDir, &opt.Options{CachedOpenFiles: 32})
+	if err != nil {
+		log.Fatalln("Cannot open database:", err)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		log.Fatalln("listen:", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalln("listen:", err)
+	}
+	log.Println("Listening on", conn.LocalAddr())
+
+	srv := newServer(db, expiry, newLimiter(limitAvg, limitBurst, limitCache))
+
+	go srv.cleanLoop()
+
+	if statsIntv > 0 {
+		go srv.stats.logLoop(statsIntv, log.Printf)
+	}
+
+	if statsListen != "" {
+		http.Handle("/stats", srv.stats)
+		go func() {
+			log.Fatalln("stats:", http.ListenAndServe(statsListen, nil))
+		}()
+	}
+
+	srv.serve(conn)
+}
@@ -0,0 +1,286 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/discover"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Announced addresses and relays are each stored under their own key, with
+// the time they were last announced as the value:
+//
+//	keyTypeAddress, device ID (32 bytes), IP (4 or 16 bytes), port (2 bytes)
+//	keyTypeRelay, device ID (32 bytes), relay URI
+const (
+	keyTypeAddress = iota
+	keyTypeRelay
+)
+
+var errInvalidDeviceID = errors.New("invalid device ID")
+
+// Announcements carry at most 16 addresses and 16 relays, so this is what we
+// answer with at most.
+const maxEntries = 16
+
+type server struct {
+	db      *leveldb.DB
+	expiry  time.Duration
+	limiter *limiter
+	stats   *stats
+}
+
+func newServer(db *leveldb.DB, expiry time.Duration, limiter *limiter) *server {
+	return &server{
+		db:      db,
+		expiry:  expiry,
+		limiter: limiter,
+		stats:   newStats(),
+	}
+}
+
+func (s *server) serve(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("read:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		reply := s.handle(buf[:n], addr)
+		if reply == nil {
+			continue
+		}
+		if _, err := conn.WriteToUDP(reply, addr); err != nil {
+			if debug {
+				log.Println("write:", addr, err)
+			}
+			s.stats.error()
+		}
+	}
+}
+
+// handle processes a single packet from the given address and returns the
+// reply to send, if any.
+func (s *server) handle(buf []byte, addr *net.UDPAddr) []byte {
+	if !s.limiter.allow(addr.IP) {
+		s.stats.dropped()
+		return nil
+	}
+
+	if len(buf) < 4 {
+		s.stats.error()
+		return nil
+	}
+
+	switch magic := binary.BigEndian.Uint32(buf); magic {
+	case discover.AnnouncementMagic:
+		pkt, err := discover.UnmarshalAnnouncement(buf)
+		if err != nil {
+			if debug {
+				log.Println("announce:", addr, err)
+			}
+			s.stats.error()
+			return nil
+		}
+		if err := s.handleAnnounce(pkt, addr); err != nil {
+			if debug {
+				log.Println("announce:", addr, err)
+			}
+			s.stats.error()
+			return nil
+		}
+		s.stats.announce()
+		return nil
+
+	case discover.QueryMagic:
+		var pkt discover.Query
+		if err := pkt.UnmarshalXDR(buf); err != nil || len(pkt.DeviceID) != 32 {
+			if debug {
+				log.Println("query:", addr, err)
+			}
+			s.stats.error()
+			return nil
+		}
+		reply, err := s.handleQuery(pkt)
+		if err != nil {
+			log.Println("query:", err)
+			s.stats.error()
+			return nil
+		}
+		s.stats.query(reply != nil)
+		return reply
+
+	default:
+		if debug {
+			log.Printf("unknown magic %08x from %v", magic, addr)
+		}
+		s.stats.error()
+		return nil
+	}
+}
+
+func (s *server) handleAnnounce(pkt discover.Announce, addr *net.UDPAddr) error {
+	if len(pkt.This.ID) != 32 {
+		return errInvalidDeviceID
+	}
+	if debug {
+		log.Printf("announce from %v for %v: %v, %v", addr, protocol.DeviceIDFromBytes(pkt.This.ID), pkt.This.Addresses, pkt.Relays)
+	}
+
+	var now [8]byte
+	binary.BigEndian.PutUint64(now[:], uint64(time.Now().Unix()))
+
+	batch := new(leveldb.Batch)
+	for _, a := range pkt.This.Addresses {
+		ip := net.IP(a.IP)
+		if len(ip) == 0 || ip.IsUnspecified() {
+			// The device announces the port only and relies on us to
+			// see its address.
+			ip = addr.IP
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		batch.Put(addressKey(pkt.This.ID, ip, a.Port), now[:])
+	}
+	for _, r := range pkt.Relays {
+		batch.Put(relayKey(pkt.This.ID, r.Address), now[:])
+	}
+	return s.db.Write(batch, nil)
+}
+
+// handleQuery returns the reply to a query, or nil if we know nothing about
+// the device.
+func (s *server) handleQuery(pkt discover.Query) ([]byte, error) {
+	var addrs []discover.Address
+	var relays []discover.Relay
+
+	batch := new(leveldb.Batch)
+	s.iterate(keyTypeAddress, pkt.DeviceID, batch, func(rest []byte) {
+		if len(addrs) < maxEntries && (len(rest) == 6 || len(rest) == 18) {
+			addrs = append(addrs, discover.Address{
+				IP:   append([]byte(nil), rest[:len(rest)-2]...),
+				Port: binary.BigEndian.Uint16(rest[len(rest)-2:]),
+			})
+		}
+	})
+	s.iterate(keyTypeRelay, pkt.DeviceID, batch, func(rest []byte) {
+		if len(relays) < maxEntries {
+			relays = append(relays, discover.Relay{Address: string(rest)})
+		}
+	})
+	if err := s.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+
+	if debug {
+		log.Printf("query for %v: %v, %v", protocol.DeviceIDFromBytes(pkt.DeviceID), addrs, relays)
+	}
+
+	if len(addrs) == 0 && len(relays) == 0 {
+		return nil, nil
+	}
+
+	reply := discover.Announce{
+		Magic:  discover.AnnouncementMagic,
+		This:   discover.Device{ID: pkt.DeviceID, Addresses: addrs},
+		Relays: relays,
+	}
+	return reply.MarshalXDR()
+}
+
+// iterate calls fn with the remainder of the key, after the device ID, for
+// each unexpired entry of the given type for the device. Expired entries are
+// added to the batch for deletion.
+func (s *server) iterate(keyType byte, device []byte, batch *leveldb.Batch, fn func(rest []byte)) {
+	prefix := append([]byte{keyType}, device...)
+	it := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		if s.expired(it.Value()) {
+			batch.Delete(append([]byte(nil), it.Key()...))
+			continue
+		}
+		fn(it.Key()[len(prefix):])
+	}
+}
+
+// clean removes all expired entries from the database.
+func (s *server) clean() (int, error) {
+	batch := new(leveldb.Batch)
+	n := 0
+	it := s.db.NewIterator(nil, nil)
+	for it.Next() {
+		if s.expired(it.Value()) {
+			batch.Delete(append([]byte(nil), it.Key()...))
+			n++
+		}
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return 0, err
+	}
+	return n, s.db.Write(batch, nil)
+}
+
+func (s *server) cleanLoop() {
+	for range time.Tick(s.expiry / 4) {
+		n, err := s.clean()
+		if err != nil {
+			log.Println("clean:", err)
+		} else if debug {
+			log.Println("cleaned", n, "expired entries")
+		}
+	}
+}
+
+func (s *server) expired(val []byte) bool {
+	if len(val) != 8 {
+		return true
+	}
+	seen := time.Unix(int64(binary.BigEndian.Uint64(val)), 0)
+	return time.Since(seen) > s.expiry
+}
+
+func addressKey(device []byte, ip net.IP, port uint16) []byte {
+	var key bytes.Buffer
+	key.WriteByte(keyTypeAddress)
+	key.Write(device)
+	key.Write(ip)
+	binary.Write(&key, binary.BigEndian, port)
+	return key.Bytes()
+}
+
+func relayKey(device []byte, uri string) []byte {
+	var key bytes.Buffer
+	key.WriteByte(keyTypeRelay)
+	key.Write(device)
+	key.WriteString(uri)
+	return key.Bytes()
+}
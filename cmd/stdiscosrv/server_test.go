@@ -0,0 +1,164 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/discover"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+var (
+	device1 = make([]byte, 32)
+	device2 = make([]byte, 32)
+	source  = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 42), Port: 21025}
+)
+
+func init() {
+	device1[0] = 1
+	device2[0] = 2
+}
+
+func newTestServer(t *testing.T) *server {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newServer(db, time.Hour, newLimiter(100, 100, 10))
+}
+
+func query(t *testing.T, s *server, device []byte) *discover.Announce {
+	reply := s.handle(discover.Query{Magic: discover.QueryMagic, DeviceID: device}.MustMarshalXDR(), source)
+	if reply == nil {
+		return nil
+	}
+	pkt, err := discover.UnmarshalAnnouncement(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pkt
+}
+
+func TestAnnounceQuery(t *testing.T) {
+	s := newTestServer(t)
+
+	ann := discover.Announce{
+		Magic: discover.AnnouncementMagic,
+		This: discover.Device{
+			ID: device1,
+			Addresses: []discover.Address{
+				{Port: 22000},
+				{IP: net.IPv4(198, 51, 100, 1).To4(), Port: 22001},
+			},
+		},
+		Relays: []discover.Relay{{Address: "relay://198.51.100.2:22067"}},
+	}
+	if reply := s.handle(ann.MustMarshalXDR(), source); reply != nil {
+		t.Error("unexpected reply to announcement")
+	}
+
+	pkt := query(t, s, device1)
+	if pkt == nil {
+		t.Fatal("no reply to query for announced device")
+	}
+
+	expected := map[string]bool{
+		"192.0.2.42:22000":   true,
+		"198.51.100.1:22001": true,
+	}
+	if len(pkt.This.Addresses) != len(expected) {
+		t.Errorf("incorrect number of addresses %v", pkt.This.Addresses)
+	}
+	for _, a := range pkt.This.Addresses {
+		addr := (&net.TCPAddr{IP: a.IP, Port: int(a.Port)}).String()
+		if !expected[addr] {
+			t.Errorf("unexpected address %s", addr)
+		}
+	}
+	if len(pkt.Relays) != 1 || pkt.Relays[0].Address != ann.Relays[0].Address {
+		t.Errorf("incorrect relays %v", pkt.Relays)
+	}
+
+	if pkt := query(t, s, device2); pkt != nil {
+		t.Errorf("unexpected reply for unknown device: %v", pkt)
+	}
+
+	stats := s.stats.snapshot()
+	if stats.Announces != 1 || stats.Queries != 2 || stats.Answered != 1 {
+		t.Errorf("incorrect stats %+v", stats)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := newTestServer(t)
+
+	var old [8]byte
+	binary.BigEndian.PutUint64(old[:], uint64(time.Now().Add(-2*time.Hour).Unix()))
+	key := addressKey(device1, net.IPv4(192, 0, 2, 1).To4(), 22000)
+	if err := s.db.Put(key, old[:], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if pkt := query(t, s, device1); pkt != nil {
+		t.Errorf("unexpected reply with expired address: %v", pkt)
+	}
+	if _, err := s.db.Get(key, nil); err != leveldb.ErrNotFound {
+		t.Errorf("expired address should have been removed, got %v", err)
+	}
+}
+
+func TestClean(t *testing.T) {
+	s := newTestServer(t)
+
+	var old [8]byte
+	binary.BigEndian.PutUint64(old[:], uint64(time.Now().Add(-2*time.Hour).Unix()))
+	s.db.Put(relayKey(device1, "relay://192.0.2.1:22067"), old[:], nil)
+
+	ann := discover.Announce{
+		Magic: discover.AnnouncementMagic,
+		This:  discover.Device{ID: device2, Addresses: []discover.Address{{Port: 22000}}},
+	}
+	s.handle(ann.MustMarshalXDR(), source)
+
+	if n, err := s.clean(); err != nil || n != 1 {
+		t.Errorf("clean removed %d entries (%v), expected 1", n, err)
+	}
+	if pkt := query(t, s, device2); pkt == nil {
+		t.Error("unexpired device should remain")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	s.limiter = newLimiter(0.001, 2, 10)
+
+	q := discover.Query{Magic: discover.QueryMagic, DeviceID: device1}.MustMarshalXDR()
+	for i := 0; i < 3; i++ {
+		s.handle(q, source)
+	}
+	// Another source has its own bucket
+	s.handle(q, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 43), Port: 21025})
+
+	stats := s.stats.snapshot()
+	if stats.Queries != 3 || stats.Dropped != 1 {
+		t.Errorf("incorrect stats %+v", stats)
+	}
+}
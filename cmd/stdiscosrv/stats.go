@@ -0,0 +1,111 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type stats struct {
+	mut    sync.Mutex
+	start  time.Time
+	counts statCounts
+}
+
+type statCounts struct {
+	Announces int64 `json:"announces"`
+	Queries   int64 `json:"queries"`
+	Answered  int64 `json:"answered"`
+	Dropped   int64 `json:"dropped"`
+	Errors    int64 `json:"errors"`
+}
+
+func newStats() *stats {
+	return &stats{start: time.Now()}
+}
+
+func (s *stats) announce() {
+	s.mut.Lock()
+	s.counts.Announces++
+	s.mut.Unlock()
+}
+
+func (s *stats) query(answered bool) {
+	s.mut.Lock()
+	s.counts.Queries++
+	if answered {
+		s.counts.Answered++
+	}
+	s.mut.Unlock()
+}
+
+func (s *stats) dropped() {
+	s.mut.Lock()
+	s.counts.Dropped++
+	s.mut.Unlock()
+}
+
+func (s *stats) error() {
+	s.mut.Lock()
+	s.counts.Errors++
+	s.mut.Unlock()
+}
+
+func (s *stats) snapshot() statCounts {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.counts
+}
+
+func (s *stats) logLoop(intv time.Duration, logf func(format string, v ...interface{})) {
+	prev := s.snapshot()
+	for range time.Tick(intv) {
+		cur := s.snapshot()
+		logf("Last %v: %v", intv, cur.sub(prev))
+		prev = cur
+	}
+}
+
+// ServeHTTP returns the counters since startup as JSON.
+func (s *stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := struct {
+		statCounts
+		Uptime int64 `json:"uptimeS"`
+	}{
+		statCounts: s.snapshot(),
+		Uptime:     int64(time.Since(s.start).Seconds()),
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (c statCounts) sub(o statCounts) statCounts {
+	return statCounts{
+		Announces: c.Announces - o.Announces,
+		Queries:   c.Queries - o.Queries,
+		Answered:  c.Answered - o.Answered,
+		Dropped:   c.Dropped - o.Dropped,
+		Errors:    c.Errors - o.Errors,
+	}
+}
+
+func (c statCounts) String() string {
+	return fmt.Sprintf("%d announces, %d queries (%d answered), %d dropped, %d errors", c.Announces, c.Queries, c.Answered, c.Dropped, c.Errors)
+}
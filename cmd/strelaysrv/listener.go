@@ -0,0 +1,237 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/relay"
+)
+
+var (
+	outboxesMut sync.RWMutex
+	outboxes    = make(map[protocol.DeviceID]chan interface{})
+)
+
+func protocolListen(listener net.Listener, tlsCfg *tls.Config) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if debug {
+				log.Println(err)
+			}
+			continue
+		}
+
+		setTCPOptions(conn)
+
+		if debug {
+			log.Println("Protocol listener accepted connection from", conn.RemoteAddr())
+		}
+
+		go protocolConnectionHandler(conn, tlsCfg)
+	}
+}
+
+func protocolConnectionHandler(tcpConn net.Conn, tlsCfg *tls.Config) {
+	conn := tls.Server(tcpConn, tlsCfg)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(messageTimeout))
+	if err := conn.Handshake(); err != nil {
+		if debug {
+			log.Println("Protocol connection TLS handshake:", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) != 1 {
+		if debug {
+			log.Println("Certificate list error from", conn.RemoteAddr())
+		}
+		return
+	}
+	id := protocol.NewDeviceID(certs[0].Raw)
+
+	messages := make(chan interface{})
+	errors := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go messageReader(conn, messages, errors, done)
+
+	outbox := make(chan interface{})
+	joined := false
+	defer func() {
+		if joined {
+			outboxesMut.Lock()
+			delete(outboxes, id)
+			outboxesMut.Unlock()
+			if debug {
+				log.Println(id, "left the relay")
+			}
+		}
+	}()
+
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+	timeoutTimer := time.NewTimer(networkTimeout)
+	defer timeoutTimer.Stop()
+
+	for {
+		select {
+		case msg := <-messages:
+			timeoutTimer.Reset(networkTimeout)
+			if debug {
+				log.Printf("Message %T from %s", msg, id)
+			}
+
+			switch msg := msg.(type) {
+			case relay.JoinRelayRequest:
+				outboxesMut.Lock()
+				_, ok := outboxes[id]
+				if !ok {
+					outboxes[id] = outbox
+					joined = true
+				}
+				outboxesMut.Unlock()
+
+				if ok {
+					writeMessage(conn, relay.ResponseAlreadyJoined)
+					return
+				}
+				if !writeMessage(conn, relay.ResponseSuccess) {
+					return
+				}
+				if debug {
+					log.Println(id, "joined the relay")
+				}
+
+			case relay.ConnectRequest:
+				if len(msg.ID) != len(protocol.DeviceID{}) {
+					writeMessage(conn, relay.ResponseUnexpected)
+					return
+				}
+				requestedPeer := protocol.DeviceIDFromBytes(msg.ID)
+
+				outboxesMut.RLock()
+				peerOutbox, ok := outboxes[requestedPeer]
+				outboxesMut.RUnlock()
+				if !ok {
+					if debug {
+						log.Println(id, "is looking for", requestedPeer, "which is not joined")
+					}
+					writeMessage(conn, relay.ResponseNotFound)
+					return
+				}
+
+				// The session is served once the peer has its invitation.
+				// If it can't be invited, the session is dropped before
+				// anyone knows its keys.
+				ses := newSession()
+				select {
+				case peerOutbox <- ses.invitation(id, true):
+				case <-time.After(messageTimeout):
+					ses.forget()
+					writeMessage(conn, relay.ResponseNotFound)
+					return
+				}
+				go ses.Serve()
+
+				if debug {
+					log.Println("Created session between", id, "and", requestedPeer)
+				}
+
+				// The requesting side is done with the protocol connection
+				// once it has its invitation.
+				writeMessage(conn, ses.invitation(requestedPeer, false))
+				return
+
+			case relay.Pong:
+				// Nothing to do; the timeout has already been reset.
+
+			default:
+				writeMessage(conn, relay.ResponseUnexpected)
+				return
+			}
+
+		case msg := <-outbox:
+			if !writeMessage(conn, msg) {
+				return
+			}
+
+		case err := <-errors:
+			if debug {
+				log.Println("Protocol connection from", id, err)
+			}
+			return
+
+		case <-pingTicker.C:
+			if joined && !writeMessage(conn, relay.Ping{}) {
+				return
+			}
+
+		case <-timeoutTimer.C:
+			if debug {
+				log.Println("Protocol connection from", id, "timed out")
+			}
+			return
+		}
+	}
+}
+
+func messageReader(conn net.Conn, messages chan<- interface{}, errors chan<- error, done <-chan struct{}) {
+	for {
+		msg, err := relay.ReadMessage(conn)
+		if err != nil {
+			errors <- err
+			return
+		}
+		select {
+		case messages <- msg:
+		case <-done:
+			return
+		}
+	}
+}
+
+func writeMessage(conn net.Conn, msg interface{}) bool {
+	conn.SetWriteDeadline(time.Now().Add(messageTimeout))
+	if err := relay.WriteMessage(conn, msg); err != nil {
+		if debug {
+			log.Println("Writing message to", conn.RemoteAddr(), err)
+		}
+		return false
+	}
+	return true
+}
+
+func setTCPOptions(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tcpConn.SetLinger(0)
+	tcpConn.SetNoDelay(true)
+	tcpConn.SetKeepAlivePeriod(networkTimeout)
+	tcpConn.SetKeepAlive(true)
+}
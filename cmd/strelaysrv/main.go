@@ -0,0 +1,98 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Command strelaysrv is a relay server for syncthing. Devices that cannot
+// reach each other directly join the relay, and the relay connects them by
+// forwarding the bytes of a session between them. The session is end-to-end
+// encrypted by the devices; the relay only sees TLS traffic.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+var (
+	debug          bool
+	sessionAddress []byte
+	sessionPort    uint16
+	networkTimeout time.Duration
+	pingInterval   time.Duration
+	messageTimeout time.Duration
+)
+
+func main() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags)
+
+	var listenProtocol, listenSession, keyDir string
+
+	flag.StringVar(&listenProtocol, "listen-protocol", ":22067", "Protocol listen address")
+	flag.StringVar(&listenSession, "listen-session", ":22068", "Session listen address")
+	flag.StringVar(&keyDir, "keys", ".", "Directory where cert.pem and key.pem is stored")
+	flag.DurationVar(&networkTimeout, "network-timeout", 2*time.Minute, "Timeout for network operations")
+	flag.DurationVar(&pingInterval, "ping-interval", time.Minute, "How often pings are sent")
+	flag.DurationVar(&messageTimeout, "message-timeout", time.Minute, "Maximum amount of time we wait for relevant messages to arrive")
+	flag.BoolVar(&debug, "debug", false, "Enable debug output")
+	flag.Parse()
+
+	certFile, keyFile := filepath.Join(keyDir, "cert.pem"), filepath.Join(keyDir, "key.pem")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if os.IsNotExist(err) {
+		log.Println("Failed to load keypair. Generating one, this might take a while...")
+		cert, err = generateCertificate(certFile, keyFile)
+	}
+	if err != nil {
+		log.Fatalln("Failed to load keypair:", err)
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		ClientAuth:             tls.RequestClientCert,
+		SessionTicketsDisabled: true,
+		InsecureSkipVerify:     true,
+		MinVersion:             tls.VersionTLS12,
+	}
+
+	id := protocol.NewDeviceID(cert.Certificate[0])
+	log.Println("ID:", id)
+
+	sessionListener, err := net.Listen("tcp", listenSession)
+	if err != nil {
+		log.Fatalln("listen (session):", err)
+	}
+	addr := sessionListener.Addr().(*net.TCPAddr)
+	if !addr.IP.IsUnspecified() {
+		sessionAddress = addr.IP
+	}
+	sessionPort = uint16(addr.Port)
+
+	protocolListener, err := net.Listen("tcp", listenProtocol)
+	if err != nil {
+		log.Fatalln("listen (protocol):", err)
+	}
+
+	log.Println("Listening for protocol connections on", protocolListener.Addr())
+	log.Println("Listening for session connections on", sessionListener.Addr())
+
+	go sessionListen(sessionListener)
+	protocolListen(protocolListener, tlsCfg)
+}
@@ -0,0 +1,228 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/relay"
+)
+
+var (
+	sessionMut sync.Mutex
+	sessions   = make(map[string]*session)
+)
+
+// A session connects two devices. Each of them is given its own key, which
+// can be used once to join the session.
+type session struct {
+	serverKey []byte
+	clientKey []byte
+	conns     chan net.Conn
+}
+
+func newSession() *session {
+	serverKey := make([]byte, 32)
+	if _, err := rand.Read(serverKey); err != nil {
+		panic(err)
+	}
+	clientKey := make([]byte, 32)
+	if _, err := rand.Read(clientKey); err != nil {
+		panic(err)
+	}
+
+	ses := &session{
+		serverKey: serverKey,
+		clientKey: clientKey,
+		conns:     make(chan net.Conn, 2),
+	}
+
+	sessionMut.Lock()
+	sessions[string(serverKey)] = ses
+	sessions[string(clientKey)] = ses
+	sessionMut.Unlock()
+
+	return ses
+}
+
+// takeSession returns the session with the given key and forgets the key,
+// or nil if there is no such session.
+func takeSession(key []byte) *session {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+
+	ses, ok := sessions[string(key)]
+	if !ok {
+		return nil
+	}
+	delete(sessions, string(key))
+	return ses
+}
+
+// forget removes the keys of the session, so that it can no longer be
+// joined.
+func (s *session) forget() {
+	sessionMut.Lock()
+	delete(sessions, string(s.serverKey))
+	delete(sessions, string(s.clientKey))
+	sessionMut.Unlock()
+}
+
+// invitation returns the invitation for one of the sides of the session.
+// The address is left empty; the device uses the address of the relay.
+func (s *session) invitation(from protocol.DeviceID, server bool) relay.SessionInvitation {
+	key := s.clientKey
+	if server {
+		key = s.serverKey
+	}
+	return relay.SessionInvitation{
+		From:         from[:],
+		Key:          key,
+		Address:      sessionAddress,
+		Port:         sessionPort,
+		ServerSocket: server,
+	}
+}
+
+// Serve waits for both sides to join and then forwards data between them
+// until either side disconnects.
+func (s *session) Serve() {
+	defer s.forget()
+
+	timer := time.NewTimer(messageTimeout)
+	defer timer.Stop()
+
+	var conns []net.Conn
+	for len(conns) < 2 {
+		select {
+		case conn := <-s.conns:
+			conns = append(conns, conn)
+		case <-timer.C:
+			if debug {
+				log.Println("Session timed out waiting for both sides to join")
+			}
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return
+		}
+	}
+
+	for _, conn := range conns {
+		if !writeMessage(conn, relay.ResponseSuccess) {
+			conns[0].Close()
+			conns[1].Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	if debug {
+		log.Println("Session between", conns[0].RemoteAddr(), "and", conns[1].RemoteAddr(), "started")
+	}
+
+	errors := make(chan error, 2)
+	go proxy(conns[0], conns[1], errors)
+	go proxy(conns[1], conns[0], errors)
+
+	err := <-errors
+	conns[0].Close()
+	conns[1].Close()
+	<-errors
+
+	if debug {
+		log.Println("Session between", conns[0].RemoteAddr(), "and", conns[1].RemoteAddr(), "ended:", err)
+	}
+}
+
+// proxy copies data from one side of the session to the other. Sessions that
+// see no traffic for the network timeout are considered dead.
+func proxy(from, to net.Conn, errors chan<- error) {
+	buf := make([]byte, 65536)
+	for {
+		from.SetReadDeadline(time.Now().Add(networkTimeout))
+		n, err := from.Read(buf)
+		if n > 0 {
+			to.SetWriteDeadline(time.Now().Add(networkTimeout))
+			if _, werr := to.Write(buf[:n]); werr != nil {
+				errors <- werr
+				return
+			}
+		}
+		if err != nil {
+			errors <- err
+			return
+		}
+	}
+}
+
+func sessionListen(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if debug {
+				log.Println(err)
+			}
+			continue
+		}
+
+		setTCPOptions(conn)
+
+		if debug {
+			log.Println("Session listener accepted connection from", conn.RemoteAddr())
+		}
+
+		go sessionConnectionHandler(conn)
+	}
+}
+
+func sessionConnectionHandler(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(messageTimeout))
+	msg, err := relay.ReadMessage(conn)
+	if err != nil {
+		if debug {
+			log.Println("Reading join request from", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+
+	req, ok := msg.(relay.JoinSessionRequest)
+	if !ok {
+		writeMessage(conn, relay.ResponseUnexpected)
+		conn.Close()
+		return
+	}
+
+	ses := takeSession(req.Key)
+	if ses == nil {
+		writeMessage(conn, relay.ResponseNotFound)
+		conn.Close()
+		return
+	}
+
+	select {
+	case ses.conns <- conn:
+	default:
+		writeMessage(conn, relay.ResponseAlreadyJoined)
+		conn.Close()
+	}
+}
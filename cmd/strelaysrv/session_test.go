@@ -0,0 +1,153 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/relay"
+)
+
+func init() {
+	networkTimeout = 10 * time.Second
+	pingInterval = time.Second
+	messageTimeout = 5 * time.Second
+}
+
+func TestRelaySession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "strelaysrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var certs []tls.Certificate
+	for _, name := range []string{"relay", "a", "b"} {
+		cert, err := generateCertificate(filepath.Join(dir, name+"-cert.pem"), filepath.Join(dir, name+"-key.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	relayID := protocol.NewDeviceID(certs[0].Certificate[0])
+	idA := protocol.NewDeviceID(certs[1].Certificate[0])
+	idB := protocol.NewDeviceID(certs[2].Certificate[0])
+
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionPort = uint16(sl.Addr().(*net.TCPAddr).Port)
+	go sessionListen(sl)
+
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go protocolListen(pl, &tls.Config{
+		Certificates:       certs[:1],
+		ClientAuth:         tls.RequestClientCert,
+		InsecureSkipVerify: true,
+	})
+
+	uri, err := url.Parse("relay://" + pl.Addr().String() + "/?id=" + relayID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Device A joins the relay and waits for invitations
+	invitations := make(chan relay.SessionInvitation, 1)
+	client := relay.NewClient(uri, certs[1:2], invitations, 10*time.Second)
+	go client.Serve()
+	defer client.Stop()
+
+	for t0 := time.Now(); !client.Connected(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatal("client did not join the relay")
+		}
+	}
+
+	// A device that isn't joined can't be reached
+	if _, err := relay.GetInvitationFromRelay(uri, idB, certs[2:]); err == nil {
+		t.Error("unexpected invitation to a device that isn't joined")
+	}
+
+	// Device B connects to device A through the relay
+	invB, err := relay.GetInvitationFromRelay(uri, idA, certs[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invB.ServerSocket || protocol.DeviceIDFromBytes(invB.From) != idA {
+		t.Errorf("incorrect invitation for the connecting side: %+v", invB)
+	}
+
+	var invA relay.SessionInvitation
+	select {
+	case invA = <-invitations:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no invitation for the joined side")
+	}
+	if !invA.ServerSocket || protocol.DeviceIDFromBytes(invA.From) != idB {
+		t.Errorf("incorrect invitation for the joined side: %+v", invA)
+	}
+
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := relay.JoinSession(invA)
+		if err != nil {
+			t.Error(err)
+		}
+		conns <- conn
+	}()
+	connB, err := relay.JoinSession(invB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connB.Close()
+	connA := <-conns
+	if connA == nil {
+		t.FailNow()
+	}
+	defer connA.Close()
+
+	// A key can only be used once
+	if _, err := relay.JoinSession(invB); err == nil {
+		t.Error("unexpected success joining a session twice")
+	}
+
+	data := []byte("hello through the relay")
+	if _, err := connB.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	connA.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(connA, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("incorrect data %q != %q", buf, data)
+	}
+}
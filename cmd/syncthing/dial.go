@@ -0,0 +1,295 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/dialer"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// dialStagger is how long we give a dial attempt before starting the next
+// one in parallel with it.
+const dialStagger = 250 * time.Millisecond
+
+// ranker remembers how dial attempts to each address went, across all
+// devices and reconnection rounds.
+var ranker = newAddrRanker()
+
+// A dialTarget is a direct address of a device.
+type dialTarget struct {
+	disc string // the address as configured or discovered
+	addr string // the address to dial
+}
+
+// newDialTarget fills in the default port of the address, if missing, and
+// checks it against the allowed networks of the device.
+func newDialTarget(deviceCfg config.DeviceConfiguration, addr string) (dialTarget, bool) {
+	discAddr := addr
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil && strings.HasPrefix(err.Error(), "missing port") {
+		// addr is on the form "1.2.3.4"
+		addr = net.JoinHostPort(addr, "22000")
+	} else if err == nil && port == "" {
+		// addr is on the form "1.2.3.4:"
+		addr = net.JoinHostPort(host, "22000")
+	}
+	allowedAddr, ok := dialAddrAllowed(deviceCfg, addr)
+	if !ok {
+		if debugNet {
+			l.Debugln("not dialing", deviceCfg.DeviceID, addr, "outside the allowed networks")
+		}
+		return dialTarget{}, false
+	}
+	return dialTarget{disc: discAddr, addr: allowedAddr}, true
+}
+
+// resolveDialTargets returns the direct addresses to dial for the device,
+// with dynamic addresses looked up through discovery, and the relay
+// addresses it can be reached through.
+func resolveDialTargets(deviceID protocol.DeviceID, deviceCfg config.DeviceConfiguration) (targets []dialTarget, relayAddrs []string) {
+	add := func(addr string) {
+		if isRelayAddr(addr) {
+			relayAddrs = append(relayAddrs, addr)
+		} else if target, ok := newDialTarget(deviceCfg, addr); ok {
+			targets = append(targets, target)
+		}
+	}
+
+	for _, addr := range deviceCfg.Addresses {
+		if addr != "dynamic" {
+			add(addr)
+		} else if discoverer != nil {
+			for _, addr := range discoverer.Lookup(deviceID) {
+				add(addr)
+			}
+		}
+	}
+	return targets, relayAddrs
+}
+
+// dialDirect dials the targets in order of rank, starting another attempt
+// whenever one fails or has been outstanding for dialStagger. The first
+// connection to complete the TLS handshake is returned; connections that
+// complete later are closed. Returns nil if all attempts fail.
+func dialDirect(deviceID protocol.DeviceID, targets []dialTarget, tlsCfg *tls.Config, dialTimeout, handshakeTimeout time.Duration) *tls.Conn {
+	if len(targets) == 0 {
+		return nil
+	}
+	targets = ranker.rank(targets)
+
+	results := make(chan *tls.Conn, len(targets))
+	started, finished := 0, 0
+	start := func() {
+		go func(target dialTarget) {
+			results <- dialOne(deviceID, target, tlsCfg, dialTimeout, handshakeTimeout)
+		}(targets[started])
+		started++
+	}
+
+	start()
+	for finished < len(targets) {
+		var stagger <-chan time.Time
+		if started < len(targets) {
+			stagger = time.After(dialStagger)
+		}
+
+		select {
+		case tc := <-results:
+			finished++
+			if tc != nil {
+				go closeConns(results, started-finished)
+				return tc
+			}
+			if started < len(targets) {
+				start()
+			}
+
+		case <-stagger:
+			start()
+		}
+	}
+
+	return nil
+}
+
+// closeConns waits for n more dial results and closes the successful ones.
+func closeConns(results <-chan *tls.Conn, n int) {
+	for i := 0; i < n; i++ {
+		if tc := <-results; tc != nil {
+			tc.Close()
+		}
+	}
+}
+
+// dialOne connects to the target and performs the TLS handshake, recording
+// the outcome for later ranking.
+func dialOne(deviceID protocol.DeviceID, target dialTarget, tlsCfg *tls.Config, dialTimeout, handshakeTimeout time.Duration) *tls.Conn {
+	if debugNet {
+		l.Debugln("dial", deviceID, target.addr)
+	}
+
+	t0 := time.Now()
+	conn, err := dialer.DialTimeout("tcp", target.addr, dialTimeout)
+	if err != nil {
+		if debugNet {
+			l.Debugln(err)
+		}
+		ranker.failed(target.addr)
+		connectionFailed(deviceID, target.disc)
+		return nil
+	}
+	latency := time.Since(t0)
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		setTCPOptions(tcpConn)
+	}
+
+	tc := tls.Client(conn, tlsCfg)
+	if handshakeTimeout > 0 {
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+	err = tc.Handshake()
+	if err != nil {
+		l.Infoln("TLS handshake:", err)
+		tc.Close()
+		ranker.failed(target.addr)
+		connectionFailed(deviceID, target.disc)
+		return nil
+	}
+	tc.SetDeadline(time.Time{})
+
+	if debugNet {
+		l.Debugf("dial %s %s: connected in %v", deviceID, target.addr, latency)
+	}
+	ranker.succeeded(target.addr, latency)
+	connectionSucceeded(deviceID, target.disc)
+	return tc
+}
+
+type addrStats struct {
+	latency     time.Duration
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+type addrRanker struct {
+	stats map[string]addrStats
+	mut   sync.Mutex
+}
+
+func newAddrRanker() *addrRanker {
+	return &addrRanker{
+		stats: make(map[string]addrStats),
+	}
+}
+
+func (r *addrRanker) succeeded(addr string, latency time.Duration) {
+	r.mut.Lock()
+	s := r.stats[addr]
+	s.latency = latency
+	s.lastSuccess = time.Now()
+	r.stats[addr] = s
+	r.mut.Unlock()
+}
+
+func (r *addrRanker) failed(addr string) {
+	r.mut.Lock()
+	s := r.stats[addr]
+	s.lastFailure = time.Now()
+	r.stats[addr] = s
+	r.mut.Unlock()
+}
+
+// rank returns the targets in the order they should be dialed: addresses
+// that failed on the last attempt go last, LAN addresses go first and the
+// remaining ones are ordered by latency, with untried addresses after those
+// that have succeeded before. Otherwise the original order is kept.
+func (r *addrRanker) rank(targets []dialTarget) []dialTarget {
+	r.mut.Lock()
+	ranked := make(rankedTargets, len(targets))
+	for i, target := range targets {
+		ranked[i] = rankedTarget{
+			dialTarget: target,
+			addrStats:  r.stats[target.addr],
+			lan:        isLANHost(target.addr),
+		}
+	}
+	r.mut.Unlock()
+
+	sort.Stable(ranked)
+
+	res := make([]dialTarget, len(ranked))
+	for i := range ranked {
+		res[i] = ranked[i].dialTarget
+	}
+	return res
+}
+
+// isLANHost returns true if the host part of the address is an IP in a LAN
+// range. Host names are not resolved.
+func isLANHost(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return isLANIP(net.ParseIP(host))
+}
+
+type rankedTarget struct {
+	dialTarget
+	addrStats
+	lan bool
+}
+
+func (t rankedTarget) failed() bool {
+	return t.lastFailure.After(t.lastSuccess)
+}
+
+func (t rankedTarget) succeeded() bool {
+	return t.lastSuccess.After(t.lastFailure)
+}
+
+type rankedTargets []rankedTarget
+
+func (l rankedTargets) Len() int {
+	return len(l)
+}
+
+func (l rankedTargets) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l rankedTargets) Less(a, b int) bool {
+	ta, tb := l[a], l[b]
+	if ta.failed() != tb.failed() {
+		return tb.failed()
+	}
+	if ta.lan != tb.lan {
+		return ta.lan
+	}
+	if ta.succeeded() != tb.succeeded() {
+		return ta.succeeded()
+	}
+	return ta.succeeded() && ta.latency < tb.latency
+}
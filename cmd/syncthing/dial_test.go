@@ -0,0 +1,94 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+func TestRankAddresses(t *testing.T) {
+	r := newAddrRanker()
+	r.succeeded("198.51.100.1:22000", 100*time.Millisecond)
+	r.succeeded("198.51.100.2:22000", 20*time.Millisecond)
+	r.failed("192.168.1.1:22000")
+	r.succeeded("198.51.100.3:22000", time.Millisecond)
+	r.failed("198.51.100.3:22000")
+
+	addrs := []string{
+		"198.51.100.3:22000", // failed on the last attempt
+		"192.168.1.1:22000",  // LAN, but failed
+		"example.com:22000",  // untried
+		"198.51.100.1:22000", // slow
+		"10.0.0.1:22000",     // LAN
+		"198.51.100.2:22000", // fast
+		"198.51.100.4:22000", // untried
+	}
+	expected := []string{
+		"10.0.0.1:22000",
+		"198.51.100.2:22000",
+		"198.51.100.1:22000",
+		"example.com:22000",
+		"198.51.100.4:22000",
+		"192.168.1.1:22000",
+		"198.51.100.3:22000",
+	}
+
+	var targets []dialTarget
+	for _, addr := range addrs {
+		targets = append(targets, dialTarget{disc: addr, addr: addr})
+	}
+
+	var ranked []string
+	for _, target := range r.rank(targets) {
+		ranked = append(ranked, target.addr)
+	}
+
+	if !reflect.DeepEqual(ranked, expected) {
+		t.Errorf("incorrect ranking\n  got: %v\n  expected: %v", ranked, expected)
+	}
+}
+
+func TestDialDirectAllFail(t *testing.T) {
+	// Grab two free ports and close them again, so that dialing fails.
+	var targets []dialTarget
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		targets = append(targets, dialTarget{disc: addr, addr: addr})
+	}
+
+	tc := dialDirect(protocol.LocalDeviceID, targets, &tls.Config{}, time.Second, time.Second)
+	if tc != nil {
+		tc.Close()
+		t.Fatal("unexpected connection")
+	}
+
+	for _, target := range targets {
+		if s := ranker.stats[target.addr]; s.lastFailure.IsZero() {
+			t.Errorf("failure to dial %s not recorded", target.addr)
+		}
+	}
+}
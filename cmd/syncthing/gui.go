@@ -95,12 +95,18 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	getRestMux.HandleFunc("/rest/config/sync", restGetConfigInSync)
 	getRestMux.HandleFunc("/rest/connections", withModel(m, restGetConnections))
 	getRestMux.HandleFunc("/rest/discovery", restGetDiscovery)
+	getRestMux.HandleFunc("/rest/discovery/servers", restGetDiscoveryServers)
 	getRestMux.HandleFunc("/rest/errors", restGetErrors)
 	getRestMux.HandleFunc("/rest/events", restGetEvents)
+	getRestMux.HandleFunc("/rest/folder/deletions", withModel(m, restGetFolderDeletions))
+	getRestMux.HandleFunc("/rest/folder/errors", withModel(m, restGetFolderErrors))
+	getRestMux.HandleFunc("/rest/folder/progress", withModel(m, restGetFolderProgress))
 	getRestMux.HandleFunc("/rest/ignores", withModel(m, restGetIgnores))
 	getRestMux.HandleFunc("/rest/lang", restGetLang)
 	getRestMux.HandleFunc("/rest/model", withModel(m, restGetModel))
 	getRestMux.HandleFunc("/rest/need", withModel(m, restGetNeed))
+	getRestMux.HandleFunc("/rest/pending/devices", withModel(m, restGetPendingDevices))
+	getRestMux.HandleFunc("/rest/pending/folders", withModel(m, restGetPendingFolders))
 	getRestMux.HandleFunc("/rest/deviceid", restGetDeviceID)
 	getRestMux.HandleFunc("/rest/report", withModel(m, restGetReport))
 	getRestMux.HandleFunc("/rest/system", restGetSystem)
@@ -118,8 +124,15 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	postRestMux.HandleFunc("/rest/discovery/hint", restPostDiscoveryHint)
 	postRestMux.HandleFunc("/rest/error", restPostError)
 	postRestMux.HandleFunc("/rest/error/clear", restClearErrors)
+	postRestMux.HandleFunc("/rest/folder/deletions/abort", withModel(m, restPostAbortDeletions))
+	postRestMux.HandleFunc("/rest/folder/deletions/confirm", withModel(m, restPostConfirmDeletions))
 	postRestMux.HandleFunc("/rest/ignores", withModel(m, restPostIgnores))
 	postRestMux.HandleFunc("/rest/model/override", withModel(m, restPostOverride))
+	postRestMux.HandleFunc("/rest/model/revert", withModel(m, restPostRevert))
+	postRestMux.HandleFunc("/rest/pending/device/accept", withModel(m, restPostAcceptPendingDevice))
+	postRestMux.HandleFunc("/rest/pending/device/ignore", withModel(m, restPostIgnorePendingDevice))
+	postRestMux.HandleFunc("/rest/pending/folder/accept", withModel(m, restPostAcceptPendingFolder))
+	postRestMux.HandleFunc("/rest/pending/folder/ignore", withModel(m, restPostIgnorePendingFolder))
 	postRestMux.HandleFunc("/rest/reset", restPostReset)
 	postRestMux.HandleFunc("/rest/restart", restPostRestart)
 	postRestMux.HandleFunc("/rest/shutdown", restPostShutdown)
@@ -273,7 +286,13 @@ func restGetModel(m *model.Model, w http.ResponseWriter, r *http.Request) {
 
 	res["inSyncFiles"], res["inSyncBytes"] = globalFiles-needFiles, globalBytes-needBytes
 
-	res["state"], res["stateChanged"] = m.State(folder)
+	res["localChangedFiles"], res["localChangedBytes"] = m.LocalChangedSize(folder)
+
+	state, changed, err := m.State(folder)
+	res["state"], res["stateChanged"] = state, changed
+	if err != nil {
+		res["error"] = err.Error()
+	}
 	res["version"] = m.CurrentLocalVersion(folder) + m.RemoteLocalVersion(folder)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -286,6 +305,14 @@ func restPostOverride(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	go m.Override(folder)
 }
 
+func restPostRevert(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	if err := m.Revert(folder); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
 func restGetNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var folder = qs.Get("folder")
@@ -296,6 +323,127 @@ func restGetNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(files)
 }
 
+func restGetFolderErrors(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	errs, err := m.FolderErrors(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(errs)
+}
+
+func restGetFolderProgress(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	prog, err := m.FolderProgress(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(prog)
+}
+
+func restGetFolderDeletions(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	names, err := m.PendingDeletions(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(names)
+}
+
+func restPostConfirmDeletions(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	if err := m.ConfirmDeletions(folder); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostAbortDeletions(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	if err := m.AbortDeletions(folder); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restGetPendingDevices(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var res = m.PendingDevices()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func restGetPendingFolders(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var res = m.PendingFolders()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func restPostAcceptPendingDevice(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := m.AcceptPendingDevice(device, qs.Get("name")); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostIgnorePendingDevice(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := m.IgnorePendingDevice(device); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostAcceptPendingFolder(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := m.AcceptPendingFolder(qs.Get("folder"), device, qs.Get("path")); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// New folders are started on restart
+	configInSync = false
+}
+
+func restPostIgnorePendingFolder(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := m.IgnorePendingFolder(qs.Get("folder"), device); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
 func restGetConnections(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var res = m.ConnectionStats()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -334,6 +482,14 @@ func restPostConfig(m *model.Model, w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		for _, rule := range newCfg.Options.BandwidthSchedule {
+			if err := rule.Validate(); err != nil {
+				l.Warnf("Posted bandwidth rule %q: %v", rule, err)
+				http.Error(w, fmt.Sprintf("bandwidth rule %q: %v", rule, err), 500)
+				return
+			}
+		}
+
 		// Start or stop usage reporting as appropriate
 
 		if curAcc := cfg.Options().URAccepted; newCfg.Options.URAccepted > curAcc {
@@ -409,6 +565,9 @@ func restGetSystem(w http.ResponseWriter, r *http.Request) {
 	}
 	cpuUsageLock.RUnlock()
 	res["cpuPercent"] = cpusum / 10
+	if rateLimiter != nil {
+		res["bandwidthRule"] = rateLimiter.activeRule()
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(res)
@@ -465,6 +624,11 @@ func restGetDiscovery(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(devices)
 }
 
+func restGetDiscoveryServers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(discoverer.ExtServerStatus())
+}
+
 func restGetReport(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(reportData(m))
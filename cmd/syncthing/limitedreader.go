@@ -18,18 +18,20 @@ package main
 import (
 	"io"
 
-	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/internal/protocol"
 )
 
 type limitedReader struct {
-	r      io.Reader
-	bucket *ratelimit.Bucket
+	r       io.Reader
+	limiter *limiter
+	device  protocol.DeviceID
+	lan     bool
 }
 
 func (r *limitedReader) Read(buf []byte) (int, error) {
 	n, err := r.r.Read(buf)
-	if r.bucket != nil {
-		r.bucket.Wait(int64(n))
+	if r.limiter != nil {
+		r.limiter.waitRead(r.device, r.lan, n)
 	}
 	return n, err
 }
@@ -18,17 +18,19 @@ package main
 import (
 	"io"
 
-	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/internal/protocol"
 )
 
 type limitedWriter struct {
-	w      io.Writer
-	bucket *ratelimit.Bucket
+	w       io.Writer
+	limiter *limiter
+	device  protocol.DeviceID
+	lan     bool
 }
 
 func (w *limitedWriter) Write(buf []byte) (int, error) {
-	if w.bucket != nil {
-		w.bucket.Wait(int64(len(buf)))
+	if w.limiter != nil {
+		w.limiter.waitWrite(w.device, w.lan, len(buf))
 	}
 	return w.w.Write(buf)
 }
@@ -0,0 +1,209 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// A limiter holds the global and per device rate limits for sending and
+// receiving, and keeps them in sync with the configuration so that changed
+// limits apply to existing connections. The global limits follow the
+// bandwidth schedule.
+type limiter struct {
+	write       rateLimit
+	read        rateLimit
+	deviceWrite map[protocol.DeviceID]rateLimit
+	deviceRead  map[protocol.DeviceID]rateLimit
+	limitLAN    bool
+	opts        config.OptionsConfiguration
+	rule        *config.BandwidthRule // the active scheduled rule, if any
+	mut         sync.RWMutex
+}
+
+// A rateLimit is a token bucket for the given rate, or nil when unlimited.
+type rateLimit struct {
+	kbps   int
+	bucket *ratelimit.Bucket
+}
+
+func newLimiter(cfg *config.ConfigWrapper) *limiter {
+	lim := &limiter{
+		deviceWrite: make(map[protocol.DeviceID]rateLimit),
+		deviceRead:  make(map[protocol.DeviceID]rateLimit),
+	}
+	lim.Changed(cfg.Raw())
+	cfg.Subscribe(lim)
+	go lim.serve()
+	return lim
+}
+
+// serve keeps the global limits in line with the bandwidth schedule.
+func (lim *limiter) serve() {
+	for now := range time.Tick(time.Minute) {
+		lim.mut.Lock()
+		lim.applySchedule(now)
+		lim.mut.Unlock()
+	}
+}
+
+// Implements config.Handler interface
+func (lim *limiter) Changed(cfg config.Configuration) error {
+	lim.mut.Lock()
+	defer lim.mut.Unlock()
+
+	lim.opts = cfg.Options
+	lim.limitLAN = cfg.Options.LimitBandwidthInLan
+	lim.applySchedule(time.Now())
+
+	deviceWrite := make(map[protocol.DeviceID]rateLimit, len(cfg.Devices))
+	deviceRead := make(map[protocol.DeviceID]rateLimit, len(cfg.Devices))
+	for _, dev := range cfg.Devices {
+		deviceWrite[dev.DeviceID] = lim.deviceWrite[dev.DeviceID].update(dev.MaxSendKbps)
+		deviceRead[dev.DeviceID] = lim.deviceRead[dev.DeviceID].update(dev.MaxRecvKbps)
+	}
+	lim.deviceWrite = deviceWrite
+	lim.deviceRead = deviceRead
+
+	if debugNet {
+		l.Debugf("rate limits: send %d KiB/s, recv %d KiB/s, LAN limited: %v", lim.write.kbps, lim.read.kbps, lim.limitLAN)
+	}
+	return nil
+}
+
+// applySchedule sets the global limits from the bandwidth rule active at the
+// given time, or from the options when there is none. It must be called with
+// the lock held.
+func (lim *limiter) applySchedule(now time.Time) {
+	sendKbps, recvKbps := lim.opts.MaxSendKbps, lim.opts.MaxRecvKbps
+	rule, ok := lim.opts.ActiveBandwidthRule(now)
+	if ok {
+		sendKbps, recvKbps = rule.MaxSendKbps, rule.MaxRecvKbps
+	}
+
+	switch {
+	case ok && (lim.rule == nil || *lim.rule != rule):
+		l.Infof("Bandwidth rule %q active: send %d KiB/s, receive %d KiB/s", rule, sendKbps, recvKbps)
+		lim.rule = &rule
+	case !ok && lim.rule != nil:
+		l.Infof("Bandwidth rule %q no longer active", *lim.rule)
+		lim.rule = nil
+	}
+
+	lim.write = lim.write.update(sendKbps)
+	lim.read = lim.read.update(recvKbps)
+}
+
+// activeRule returns the currently active bandwidth rule, or nil.
+func (lim *limiter) activeRule() *config.BandwidthRule {
+	lim.mut.RLock()
+	defer lim.mut.RUnlock()
+	return lim.rule
+}
+
+// update returns the rate limit for the given rate, keeping the current
+// bucket if the rate is unchanged.
+func (r rateLimit) update(kbps int) rateLimit {
+	if kbps <= 0 {
+		return rateLimit{}
+	}
+	if kbps == r.kbps {
+		return r
+	}
+	return rateLimit{
+		kbps:   kbps,
+		bucket: ratelimit.NewBucketWithRate(float64(1000*kbps), int64(5*1000*kbps)),
+	}
+}
+
+func (lim *limiter) waitWrite(device protocol.DeviceID, lan bool, n int) {
+	lim.mut.RLock()
+	global, dev := lim.write.bucket, lim.deviceWrite[device].bucket
+	exempt := lan && !lim.limitLAN
+	lim.mut.RUnlock()
+	wait(global, dev, exempt, n)
+}
+
+func (lim *limiter) waitRead(device protocol.DeviceID, lan bool, n int) {
+	lim.mut.RLock()
+	global, dev := lim.read.bucket, lim.deviceRead[device].bucket
+	exempt := lan && !lim.limitLAN
+	lim.mut.RUnlock()
+	wait(global, dev, exempt, n)
+}
+
+// wait blocks until n bytes may pass both the device and the global limit.
+// LAN connections may be exempt from the global limit, but not from the
+// device limit.
+func wait(global, dev *ratelimit.Bucket, exempt bool, n int) {
+	if dev != nil {
+		dev.Wait(int64(n))
+	}
+	if global != nil && !exempt {
+		global.Wait(int64(n))
+	}
+}
+
+var lanNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"169.254.0.0/16",
+		"127.0.0.0/8",
+		"fc00::/7",
+		"fe80::/10",
+		"::1/128",
+	} {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		lanNetworks = append(lanNetworks, ipnet)
+	}
+}
+
+// isLANAddr returns true if the address is in a private, link local or
+// loopback range.
+func isLANAddr(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	return isLANIP(net.ParseIP(host))
+}
+
+// isLANIP returns true if the IP is in a private, link local or loopback
+// range.
+func isLANIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range lanNetworks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
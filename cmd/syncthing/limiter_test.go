@@ -0,0 +1,113 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+func TestLimiterChanged(t *testing.T) {
+	dev := protocol.LocalDeviceID
+	cfg := config.New(dev)
+	cfg.Options.MaxSendKbps = 100
+	cfg.Devices = []config.DeviceConfiguration{{DeviceID: dev, MaxRecvKbps: 50}}
+
+	lim := &limiter{}
+	lim.Changed(cfg)
+	if lim.write.bucket == nil || lim.read.bucket != nil {
+		t.Fatal("incorrect global limits")
+	}
+	if lim.deviceRead[dev].bucket == nil || lim.deviceWrite[dev].bucket != nil {
+		t.Fatal("incorrect device limits")
+	}
+	write, read := lim.write.bucket, lim.deviceRead[dev].bucket
+
+	// Unchanged rates keep their buckets
+	cfg.Options.MaxRecvKbps = 0
+	lim.Changed(cfg)
+	if lim.write.bucket != write || lim.deviceRead[dev].bucket != read {
+		t.Error("unchanged limits got new buckets")
+	}
+
+	cfg.Options.MaxSendKbps = 200
+	cfg.Devices[0].MaxRecvKbps = 0
+	lim.Changed(cfg)
+	if lim.write.bucket == write || lim.write.kbps != 200 {
+		t.Error("changed limit kept the old bucket")
+	}
+	if lim.deviceRead[dev].bucket != nil {
+		t.Error("removed limit still has a bucket")
+	}
+}
+
+func TestIsLANAddr(t *testing.T) {
+	cases := []struct {
+		addr string
+		lan  bool
+	}{
+		{"192.168.1.10:22000", true},
+		{"10.1.2.3:22000", true},
+		{"172.20.0.1:22000", true},
+		{"127.0.0.1:22000", true},
+		{"[fe80::1]:22000", true},
+		{"[fd00::1]:22000", true},
+		{"172.32.0.1:22000", false},
+		{"192.0.2.1:22000", false},
+		{"[2001:db8::1]:22000", false},
+	}
+
+	for _, tc := range cases {
+		addr, err := net.ResolveTCPAddr("tcp", tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lan := isLANAddr(addr); lan != tc.lan {
+			t.Errorf("isLANAddr(%s) = %v, expected %v", tc.addr, lan, tc.lan)
+		}
+	}
+}
+
+func TestLimiterSchedule(t *testing.T) {
+	cfg := config.New(protocol.LocalDeviceID)
+	cfg.Options.MaxSendKbps = 100
+	cfg.Options.BandwidthSchedule = []config.BandwidthRule{
+		{Start: "08:00", End: "18:00", MaxSendKbps: 10, MaxRecvKbps: 20},
+	}
+
+	lim := &limiter{}
+	lim.Changed(cfg)
+
+	lim.applySchedule(time.Date(2015, 1, 5, 12, 0, 0, 0, time.Local))
+	if rule := lim.activeRule(); rule == nil || rule.MaxSendKbps != 10 {
+		t.Fatalf("incorrect active rule %v", rule)
+	}
+	if lim.write.kbps != 10 || lim.read.kbps != 20 {
+		t.Errorf("scheduled limits not applied: %d, %d", lim.write.kbps, lim.read.kbps)
+	}
+
+	lim.applySchedule(time.Date(2015, 1, 5, 20, 0, 0, 0, time.Local))
+	if rule := lim.activeRule(); rule != nil {
+		t.Errorf("unexpected active rule %v", rule)
+	}
+	if lim.write.kbps != 100 || lim.read.bucket != nil {
+		t.Errorf("configured limits not restored: %d, %d", lim.write.kbps, lim.read.kbps)
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -34,11 +33,12 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.crypto/bcrypt"
-	"github.com/juju/ratelimit"
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/dialer"
 	"github.com/syncthing/syncthing/internal/discover"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/files"
@@ -71,6 +71,15 @@ const (
 	exitUpgrading          = 4
 )
 
+const (
+	// The name of the index database directory within the config
+	// directory. This changes when the database format changes in an
+	// incompatible way, so that the old database is not misinterpreted.
+	dbName = "index-v2"
+	// The previous database name, removed on startup.
+	oldDBName = "index"
+)
+
 var l = logger.DefaultLogger
 
 func init() {
@@ -94,17 +103,16 @@ func init() {
 }
 
 var (
-	cfg            *config.ConfigWrapper
-	myID           protocol.DeviceID
-	confDir        string
-	logFlags       int = log.Ltime
-	writeRateLimit *ratelimit.Bucket
-	readRateLimit  *ratelimit.Bucket
-	stop           = make(chan int)
-	discoverer     *discover.Discoverer
-	externalPort   int
-	igd            *upnp.IGD
-	cert           tls.Certificate
+	cfg          *config.ConfigWrapper
+	myID         protocol.DeviceID
+	confDir      string
+	logFlags     int = log.Ltime
+	rateLimiter  *limiter
+	stop         = make(chan int)
+	discoverer   *discover.Discoverer
+	externalPort int
+	igd          *upnp.IGD
+	cert         tls.Certificate
 )
 
 const (
@@ -140,14 +148,17 @@ are mostly useful for developers. Use with care.
                facility strings are:
 
                - "beacon"   (the beacon package)
+               - "dialer"   (the dialer package)
                - "discover" (the discover package)
                - "events"   (the events package)
                - "files"    (the files package)
                - "net"      (the main package; connections & network messages)
                - "model"    (the model package)
+               - "relay"    (the relay package)
                - "scanner"  (the scanner package)
                - "stats"    (the stats package)
                - "upnp"     (the upnp package)
+               - "watcher"  (the watcher package)
                - "xdr"      (the xdr package)
                - "all"      (all of the above)
 
@@ -305,7 +316,7 @@ func main() {
 
 		if doUpgrade {
 			// Use leveldb database locks to protect against concurrent upgrades
-			_, err = leveldb.OpenFile(filepath.Join(confDir, "index"), &opt.Options{CachedOpenFiles: 100})
+			_, err = leveldb.OpenFile(filepath.Join(confDir, dbName), &opt.Options{CachedOpenFiles: 100})
 			if err != nil {
 				l.Fatalln("Cannot upgrade, database seems to be locked. Is another copy of Syncthing already running?")
 			}
@@ -427,19 +438,31 @@ func syncthingMain() {
 		MinVersion:             tls.VersionTLS12,
 	}
 
-	// If the read or write rate should be limited, set up a rate limiter for it.
-	// This will be used on connections created in the connect and listen routines.
+	// Set up the rate limiter for the read and write rates. This will be used
+	// on connections created in the connect and listen routines, and follows
+	// changes to the configuration.
 
 	opts := cfg.Options()
+	rateLimiter = newLimiter(cfg)
 
-	if opts.MaxSendKbps > 0 {
-		writeRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxSendKbps), int64(5*1000*opts.MaxSendKbps))
+	// Outgoing connections go through the proxy, if one is configured or
+	// given in the environment.
+	if err := dialer.SetProxy(opts.Proxy); err != nil {
+		l.Fatalln("Proxy:", err)
 	}
-	if opts.MaxRecvKbps > 0 {
-		readRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxRecvKbps), int64(5*1000*opts.MaxRecvKbps))
+	if dialer.Proxy() != nil && (opts.GlobalAnnEnabled || opts.LocalAnnEnabled) {
+		l.Infoln("Discovery uses UDP and is not sent through the proxy")
 	}
 
-	db, err := leveldb.OpenFile(filepath.Join(confDir, "index"), &opt.Options{CachedOpenFiles: 100})
+	// The old database format stored scalar file versions, which are not
+	// compatible with the current version vectors. The index will be rebuilt
+	// from a rescan and the index exchange with other devices.
+	if oldDB := filepath.Join(confDir, oldDBName); dirExists(oldDB) {
+		l.Infoln("Removing index database in old format; it will be rebuilt")
+		os.RemoveAll(oldDB)
+	}
+
+	db, err := leveldb.OpenFile(filepath.Join(confDir, dbName), &opt.Options{CachedOpenFiles: 100})
 	if err != nil {
 		l.Fatalln("Cannot open database:", err, "- Is another copy of Syncthing already running?")
 	}
@@ -453,7 +476,7 @@ func syncthingMain() {
 		}
 	}
 
-	m := model.NewModel(cfg, myName, "syncthing", Version, db)
+	m := model.NewModel(cfg, myID, myName, "syncthing", Version, db)
 
 	sanityCheckFolders(cfg, m)
 
@@ -461,21 +484,6 @@ func syncthingMain() {
 
 	setupGUI(cfg, m)
 
-	// Clear out old indexes for other devices. Otherwise we'll start up and
-	// start needing a bunch of files which are nowhere to be found. This
-	// needs to be changed when we correctly do persistent indexes.
-	for _, folderCfg := range cfg.Folders() {
-		if folderCfg.Invalid != "" {
-			continue
-		}
-		for _, device := range folderCfg.DeviceIDs() {
-			if device == myID {
-				continue
-			}
-			m.Index(device, folderCfg.ID, nil)
-		}
-	}
-
 	// The default port we announce, possibly modified by setupUPnP next.
 
 	addr, err := net.ResolveTCPAddr("tcp", opts.ListenAddress[0])
@@ -492,7 +500,7 @@ func syncthingMain() {
 	}
 
 	// Routine to connect out to configured devices
-	discoverer = discovery(externalPort)
+	discoverer = discovery(externalPort, db)
 	go listenConnect(myID, m, tlsCfg)
 
 	for _, folder := range cfg.Folders() {
@@ -788,7 +796,7 @@ func renewUPnP(port int) {
 		if forwardedPort != 0 {
 			externalPort = forwardedPort
 			discoverer.StopGlobal()
-			discoverer.StartGlobal(opts.GlobalAnnServer, uint16(forwardedPort))
+			discoverer.StartGlobal(opts.GlobalAnnServers, uint16(forwardedPort))
 			if debugNet {
 				l.Debugf("Updated UPnP port mapping for external port %d on device %s.", forwardedPort, igd.FriendlyIdentifier())
 			}
@@ -807,7 +815,7 @@ func resetFolders() {
 		}
 	}
 
-	idx := filepath.Join(confDir, "index")
+	idx := filepath.Join(confDir, dbName)
 	os.RemoveAll(idx)
 }
 
@@ -829,6 +837,11 @@ func listenConnect(myID protocol.DeviceID, m *model.Model, tlsCfg *tls.Config) {
 		go listenTLS(conns, addr, tlsCfg)
 	}
 
+	// Relays
+	if relays := cfg.Options().RelayServers; len(relays) > 0 {
+		go listenRelays(relays, conns, tlsCfg)
+	}
+
 	// Connect
 	go dialTLS(m, conns, tlsCfg)
 
@@ -870,21 +883,31 @@ next:
 					// likely wants to know about, since it's an advanced
 					// config. Warn instead of Info.
 					l.Warnf("Bad certificate from %s (%v): %v", remoteID, conn.RemoteAddr(), err)
+					events.Default.Log(events.DeviceRejected, map[string]string{
+						"device":  remoteID.String(),
+						"address": conn.RemoteAddr().String(),
+						"reason":  "bad certificate name",
+					})
 					conn.Close()
 					continue next
 				}
 
-				// If rate limiting is set, we wrap the connection in a
-				// limiter.
-				var wr io.Writer = conn
-				if writeRateLimit != nil {
-					wr = &limitedWriter{conn, writeRateLimit}
+				if !remoteAddrAllowed(deviceCfg, conn.RemoteAddr()) {
+					l.Infof("Connection from %s at %s is outside the allowed networks; rejecting", remoteID, conn.RemoteAddr())
+					events.Default.Log(events.DeviceRejected, map[string]string{
+						"device":  remoteID.String(),
+						"address": conn.RemoteAddr().String(),
+						"reason":  "address not in allowed networks",
+					})
+					conn.Close()
+					continue next
 				}
 
-				var rd io.Reader = conn
-				if readRateLimit != nil {
-					rd = &limitedReader{conn, readRateLimit}
-				}
+				// The connection is wrapped in the rate limiter. Connections
+				// on the LAN may be exempt from the global limit.
+				lan := isLANAddr(conn.RemoteAddr())
+				wr := &limitedWriter{conn, rateLimiter, remoteID, lan}
+				rd := &limitedReader{conn, rateLimiter, remoteID, lan}
 
 				name := fmt.Sprintf("%s-%s", conn.LocalAddr(), conn.RemoteAddr())
 				protoConn := protocol.NewConnection(remoteID, rd, wr, m, name, deviceCfg.Compression)
@@ -906,9 +929,10 @@ next:
 		events.Default.Log(events.DeviceRejected, map[string]string{
 			"device":  remoteID.String(),
 			"address": conn.RemoteAddr().String(),
+			"reason":  "unknown device",
 		})
-		l.Infof("Connection from %s with unknown device ID %s; ignoring", conn.RemoteAddr(), remoteID)
-		conn.Close()
+		l.Infof("Connection from %s with unknown device ID %s; recording as pending device", conn.RemoteAddr(), remoteID)
+		startRecordPendingDevice(m, conn, remoteID)
 	}
 }
 
@@ -956,7 +980,13 @@ func listenTLS(conns chan *tls.Conn, addr string, tlsCfg *tls.Config) {
 func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 	var delay time.Duration = 1 * time.Second
 	for {
-	nextDevice:
+		opts := cfg.Options()
+		dialTimeout := time.Duration(opts.DialTimeoutS) * time.Second
+		handshakeTimeout := time.Duration(opts.HandshakeTimeoutS) * time.Second
+
+		// All devices are dialed concurrently, so that unreachable addresses
+		// of one device don't hold up the others.
+		var wg sync.WaitGroup
 		for deviceID, deviceCfg := range cfg.Devices() {
 			if deviceID == myID {
 				continue
@@ -966,73 +996,69 @@ func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 				continue
 			}
 
-			var addrs []string
-			for _, addr := range deviceCfg.Addresses {
-				if addr == "dynamic" {
-					if discoverer != nil {
-						t := discoverer.Lookup(deviceID)
-						if len(t) == 0 {
-							continue
-						}
-						addrs = append(addrs, t...)
-					}
-				} else {
-					addrs = append(addrs, addr)
-				}
-			}
+			wg.Add(1)
+			go func(deviceID protocol.DeviceID, deviceCfg config.DeviceConfiguration) {
+				defer wg.Done()
 
-			for _, addr := range addrs {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil && strings.HasPrefix(err.Error(), "missing port") {
-					// addr is on the form "1.2.3.4"
-					addr = net.JoinHostPort(addr, "22000")
-				} else if err == nil && port == "" {
-					// addr is on the form "1.2.3.4:"
-					addr = net.JoinHostPort(host, "22000")
-				}
-				if debugNet {
-					l.Debugln("dial", deviceCfg.DeviceID, addr)
+				// Resolving the addresses may take a while, as it involves
+				// discovery lookups and DNS.
+				targets, relayAddrs := resolveDialTargets(deviceID, deviceCfg)
+				if tc := dialDirect(deviceID, targets, tlsCfg, dialTimeout, handshakeTimeout); tc != nil {
+					conns <- tc
+					return
 				}
 
-				raddr, err := net.ResolveTCPAddr("tcp", addr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
+				// Relays are only used when the device can't be reached directly.
+				for _, addr := range relayAddrs {
+					if _, ok := dialAddrAllowed(deviceCfg, addr); !ok {
+						if debugNet {
+							l.Debugln("not dialing", deviceCfg.DeviceID, addr, "outside the allowed networks")
+						}
+						continue
 					}
-					continue
-				}
-
-				conn, err := net.DialTCP("tcp", nil, raddr)
-				if err != nil {
 					if debugNet {
-						l.Debugln(err)
+						l.Debugln("dial", deviceCfg.DeviceID, addr)
 					}
-					continue
-				}
 
-				setTCPOptions(conn)
+					tc, err := dialRelay(addr, deviceID, tlsCfg)
+					if err != nil {
+						if debugNet {
+							l.Debugln(err)
+						}
+						connectionFailed(deviceID, addr)
+						continue
+					}
 
-				tc := tls.Client(conn, tlsCfg)
-				err = tc.Handshake()
-				if err != nil {
-					l.Infoln("TLS handshake:", err)
-					tc.Close()
-					continue
+					connectionSucceeded(deviceID, addr)
+					conns <- tc
+					return
 				}
-
-				conns <- tc
-				continue nextDevice
-			}
+			}(deviceID, deviceCfg)
 		}
+		wg.Wait()
 
 		time.Sleep(delay)
 		delay *= 2
-		if maxD := time.Duration(cfg.Options().ReconnectIntervalS) * time.Second; delay > maxD {
+		if maxD := time.Duration(opts.ReconnectIntervalS) * time.Second; delay > maxD {
 			delay = maxD
 		}
 	}
 }
 
+// connectionSucceeded and connectionFailed let the discoverer rank the
+// addresses of a device by how well they have worked for us.
+func connectionSucceeded(deviceID protocol.DeviceID, addr string) {
+	if discoverer != nil {
+		discoverer.ConnectionSucceeded(deviceID, addr)
+	}
+}
+
+func connectionFailed(deviceID protocol.DeviceID, addr string) {
+	if discoverer != nil {
+		discoverer.ConnectionFailed(deviceID, addr)
+	}
+}
+
 func setTCPOptions(conn *net.TCPConn) {
 	var err error
 	if err = conn.SetLinger(0); err != nil {
@@ -1049,9 +1075,9 @@ func setTCPOptions(conn *net.TCPConn) {
 	}
 }
 
-func discovery(extPort int) *discover.Discoverer {
+func discovery(extPort int, db *leveldb.DB) *discover.Discoverer {
 	opts := cfg.Options()
-	disc := discover.NewDiscoverer(myID, opts.ListenAddress)
+	disc := discover.NewDiscoverer(myID, opts.ListenAddress, opts.RelayServers, db)
 
 	if opts.LocalAnnEnabled {
 		l.Infoln("Starting local discovery announcements")
@@ -1060,7 +1086,7 @@ func discovery(extPort int) *discover.Discoverer {
 
 	if opts.GlobalAnnEnabled {
 		l.Infoln("Starting global discovery announcements")
-		disc.StartGlobal(opts.GlobalAnnServer, uint16(extPort))
+		disc.StartGlobal(opts.GlobalAnnServers, uint16(extPort))
 	}
 
 	return disc
@@ -1082,6 +1108,11 @@ func ensureDir(dir string, mode int) {
 	}
 }
 
+func dirExists(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
 func getDefaultConfDir() (string, error) {
 	switch runtime.GOOS {
 	case "windows":
@@ -0,0 +1,78 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"net/url"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// dialAddrAllowed checks a direct or relay address of the device against the
+// device's allowed networks. Direct addresses with a host name are resolved
+// and returned with an allowed IP address in place of the name, so that the
+// connection can't end up elsewhere.
+func dialAddrAllowed(deviceCfg config.DeviceConfiguration, addr string) (string, bool) {
+	if len(deviceCfg.AllowedNetworks) == 0 {
+		return addr, true
+	}
+
+	hostport := addr
+	if isRelayAddr(addr) {
+		uri, err := url.Parse(addr)
+		if err != nil {
+			return addr, false
+		}
+		hostport = uri.Host
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return addr, false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return addr, deviceCfg.AllowsIP(ip)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return addr, false
+	}
+	for _, ip := range ips {
+		if deviceCfg.AllowsIP(ip) {
+			if isRelayAddr(addr) {
+				return addr, true
+			}
+			return net.JoinHostPort(ip.String(), port), true
+		}
+	}
+	return addr, false
+}
+
+// remoteAddrAllowed checks the remote address of a connection against the
+// device's allowed networks.
+func remoteAddrAllowed(deviceCfg config.DeviceConfiguration, addr net.Addr) bool {
+	if len(deviceCfg.AllowedNetworks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && deviceCfg.AllowsIP(ip)
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestDialAddrAllowed(t *testing.T) {
+	dev := config.DeviceConfiguration{
+		AllowedNetworks: []string{"127.0.0.0/8", "192.0.2.0/24"},
+	}
+
+	cases := []struct {
+		addr     string
+		expected string
+		allowed  bool
+	}{
+		{"192.0.2.10:22000", "192.0.2.10:22000", true},
+		{"198.51.100.1:22000", "198.51.100.1:22000", false},
+		{"localhost:22000", "127.0.0.1:22000", true},
+		{"relay://192.0.2.1:22067/?id=foo", "relay://192.0.2.1:22067/?id=foo", true},
+		{"relay://198.51.100.1:22067/?id=foo", "relay://198.51.100.1:22067/?id=foo", false},
+	}
+
+	for _, tc := range cases {
+		addr, allowed := dialAddrAllowed(dev, tc.addr)
+		if allowed != tc.allowed || addr != tc.expected {
+			t.Errorf("%s: got %s, %v; expected %s, %v", tc.addr, addr, allowed, tc.expected, tc.allowed)
+		}
+	}
+
+	if addr, ok := dialAddrAllowed(config.DeviceConfiguration{}, "example.com:22000"); !ok || addr != "example.com:22000" {
+		t.Errorf("unrestricted device address changed to %s, %v", addr, ok)
+	}
+}
+
+func TestRemoteAddrAllowed(t *testing.T) {
+	dev := config.DeviceConfiguration{
+		AllowedNetworks: []string{"192.0.2.0/24"},
+	}
+
+	if !remoteAddrAllowed(dev, &net.TCPAddr{IP: net.ParseIP("192.0.2.5"), Port: 22000}) {
+		t.Error("address in allowed network rejected")
+	}
+	if remoteAddrAllowed(dev, &net.TCPAddr{IP: net.ParseIP("198.51.100.5"), Port: 22000}) {
+		t.Error("address outside allowed network accepted")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// How long to wait for the cluster config of an unknown device.
+const pendingClusterConfigTimeout = 10 * time.Second
+
+// Connections from unknown devices being read at the same time. Anyone can
+// connect with a new certificate, so further ones are closed right away.
+const maxPendingHandshakes = 4
+
+var pendingHandshakes = make(chan struct{}, maxPendingHandshakes)
+
+// startRecordPendingDevice records the device in the background, unless
+// too many unknown devices are already being handled. The connection is
+// closed in either case.
+func startRecordPendingDevice(m *model.Model, conn *tls.Conn, remoteID protocol.DeviceID) {
+	select {
+	case pendingHandshakes <- struct{}{}:
+		go func() {
+			recordPendingDevice(m, conn, remoteID)
+			<-pendingHandshakes
+		}()
+	default:
+		if debugNet {
+			l.Debugln("too many pending handshakes; closing connection from", remoteID)
+		}
+		conn.Close()
+	}
+}
+
+// recordPendingDevice reads the cluster config that an unknown device sends
+// after connecting, and records the device as a pending offer with the name
+// and folders from it. The connection is closed afterwards.
+func recordPendingDevice(m *model.Model, conn *tls.Conn, remoteID protocol.DeviceID) {
+	defer conn.Close()
+
+	recv := &clusterConfigReceiver{
+		configs: make(chan protocol.ClusterConfigMessage, 1),
+	}
+	protoConn := protocol.NewConnection(remoteID, conn, conn, recv, conn.RemoteAddr().String(), true)
+	protoConn.Start()
+
+	var name string
+	var folders []string
+	select {
+	case cm := <-recv.configs:
+		name = cm.GetOption("name")
+		for _, folder := range cm.Folders {
+			folders = append(folders, folder.ID)
+		}
+	case <-time.After(pendingClusterConfigTimeout):
+		if debugNet {
+			l.Debugln("no cluster config from pending device", remoteID)
+		}
+	}
+
+	m.RecordPendingDevice(remoteID, name, conn.RemoteAddr().String(), folders)
+}
+
+// A clusterConfigReceiver is a protocol.Model that only cares about the
+// cluster config message.
+type clusterConfigReceiver struct {
+	configs chan protocol.ClusterConfigMessage
+}
+
+func (r *clusterConfigReceiver) Index(protocol.DeviceID, string, []protocol.FileInfo) {}
+
+func (r *clusterConfigReceiver) IndexUpdate(protocol.DeviceID, string, []protocol.FileInfo) {}
+
+func (r *clusterConfigReceiver) Request(protocol.DeviceID, string, string, int64, int) ([]byte, error) {
+	return nil, model.ErrNoSuchFile
+}
+
+func (r *clusterConfigReceiver) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
+	select {
+	case r.configs <- cm:
+	default:
+	}
+}
+
+func (r *clusterConfigReceiver) DownloadProgress(protocol.DeviceID, string, []protocol.FileDownloadProgressUpdate) {}
+
+func (r *clusterConfigReceiver) Close(protocol.DeviceID, error) {}
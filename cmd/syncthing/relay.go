@@ -0,0 +1,118 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/relay"
+)
+
+// The relay pings joined devices once a minute; we consider the relay
+// connection dead if we haven't heard from it in this long.
+const relayTimeout = 3 * time.Minute
+
+func isRelayAddr(addr string) bool {
+	return strings.HasPrefix(addr, "relay://")
+}
+
+// listenRelays joins the given relays and accepts the connections from
+// other devices that arrive through them.
+func listenRelays(relays []string, conns chan *tls.Conn, tlsCfg *tls.Config) {
+	invitations := make(chan relay.SessionInvitation)
+
+	for _, addr := range relays {
+		uri, err := url.Parse(addr)
+		if err != nil {
+			l.Infof("Bad relay address %q: %v", addr, err)
+			continue
+		}
+
+		if debugNet {
+			l.Debugln("joining relay", uri)
+		}
+
+		client := relay.NewClient(uri, tlsCfg.Certificates, invitations, relayTimeout)
+		go client.Serve()
+	}
+
+	for inv := range invitations {
+		go func(inv relay.SessionInvitation) {
+			tc, err := joinRelaySession(inv, tlsCfg)
+			if err != nil {
+				l.Infoln("Relay session:", err)
+				return
+			}
+			conns <- tc
+		}(inv)
+	}
+}
+
+// dialRelay connects to the given device through the relay at addr.
+func dialRelay(addr string, deviceID protocol.DeviceID, tlsCfg *tls.Config) (*tls.Conn, error) {
+	uri, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err := relay.GetInvitationFromRelay(uri, deviceID, tlsCfg.Certificates)
+	if err != nil {
+		return nil, err
+	}
+
+	return joinRelaySession(inv, tlsCfg)
+}
+
+// joinRelaySession joins the session given by the invitation and performs the
+// TLS handshake with the device on the other side. The session is end-to-end
+// encrypted; the relay only forwards the TLS stream.
+func joinRelaySession(inv relay.SessionInvitation, tlsCfg *tls.Config) (*tls.Conn, error) {
+	conn, err := relay.JoinSession(inv)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		setTCPOptions(tcpConn)
+	}
+
+	var tc *tls.Conn
+	if inv.ServerSocket {
+		tc = tls.Server(conn, tlsCfg)
+	} else {
+		tc = tls.Client(conn, tlsCfg)
+	}
+	tc.SetDeadline(time.Now().Add(relayTimeout))
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return nil, fmt.Errorf("TLS handshake: %v", err)
+	}
+	tc.SetDeadline(time.Time{})
+
+	// The device on the other side must be the one the relay said it was.
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) != 1 || protocol.NewDeviceID(certs[0].Raw) != protocol.DeviceIDFromBytes(inv.From) {
+		tc.Close()
+		return nil, fmt.Errorf("relayed connection is not from the expected device %s", protocol.DeviceIDFromBytes(inv.From))
+	}
+
+	return tc, nil
+}
@@ -290,6 +290,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
 
         $scope.config = config;
         $scope.config.Options.ListenStr = $scope.config.Options.ListenAddress.join(', ');
+        $scope.config.Options.GlobalAnnServersStr = $scope.config.Options.GlobalAnnServers.join(', ');
 
         $scope.devices = $scope.config.Devices;
         $scope.devices.forEach(function (deviceCfg) {
@@ -463,6 +464,9 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
         if (state == 'scanning') {
             return 'primary';
         }
+        if (state == 'outOfSpace') {
+            return 'danger';
+        }
         return 'info';
     };
 
@@ -604,6 +608,9 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
             $scope.config.Options.ListenAddress = $scope.config.Options.ListenStr.split(',').map(function (x) {
                 return x.trim();
             });
+            $scope.config.Options.GlobalAnnServers = $scope.config.Options.GlobalAnnServersStr.split(',').map(function (x) {
+                return x.trim();
+            });
 
             $scope.saveConfig();
         }
@@ -657,6 +664,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
         $scope.editingExisting = true;
         $scope.editingSelf = (deviceCfg.DeviceID == $scope.myID);
         $scope.currentDevice.AddressesStr = deviceCfg.Addresses.join(', ');
+        $scope.currentDevice.AllowedNetworksStr = (deviceCfg.AllowedNetworks || []).join(', ');
         $scope.deviceEditor.$setPristine();
         $('#editDevice').modal();
     };
@@ -673,8 +681,11 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
 		.then(function () {
 			$scope.currentDevice = {
 			    AddressesStr: 'dynamic',
+			    AllowedNetworksStr: '',
 			    Compression: true,
-			    Introducer: false
+			    Introducer: false,
+			    MaxSendKbps: 0,
+			    MaxRecvKbps: 0
 			};
 			$scope.editingExisting = false;
 			$scope.editingSelf = false;
@@ -711,6 +722,11 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
         deviceCfg.Addresses = deviceCfg.AddressesStr.split(',').map(function (x) {
             return x.trim();
         });
+        deviceCfg.AllowedNetworks = deviceCfg.AllowedNetworksStr.split(',').map(function (x) {
+            return x.trim();
+        }).filter(function (x) {
+            return x !== '';
+        });
 
         done = false;
         for (i = 0; i < $scope.devices.length; i++) {
@@ -796,6 +812,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
         } else {
             $scope.currentFolder.FileVersioningSelector = "none";
         }
+        $scope.currentFolder.Order = $scope.currentFolder.Order || "alphabetic";
         $scope.currentFolder.simpleKeep = $scope.currentFolder.simpleKeep || 5;
         $scope.currentFolder.staggeredCleanInterval = $scope.currentFolder.staggeredCleanInterval || 3600;
         $scope.currentFolder.staggeredVersionsPath = $scope.currentFolder.staggeredVersionsPath || "";
@@ -817,6 +834,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
             selectedDevices: {}
         };
         $scope.currentFolder.RescanIntervalS = 60;
+        $scope.currentFolder.Order = "alphabetic";
         $scope.currentFolder.FileVersioningSelector = "none";
         $scope.currentFolder.simpleKeep = 5;
         $scope.currentFolder.staggeredMaxAge = 365;
@@ -20,11 +20,14 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"code.google.com/p/go.crypto/bcrypt"
 	"github.com/syncthing/syncthing/internal/logger"
@@ -54,10 +57,18 @@ type FolderConfiguration struct {
 	Path            string                      `xml:"path,attr"`
 	Devices         []FolderDeviceConfiguration `xml:"device"`
 	ReadOnly        bool                        `xml:"ro,attr"`
+	ReceiveOnly     bool                        `xml:"receiveOnly,attr"`
 	RescanIntervalS int                         `xml:"rescanIntervalS,attr" default:"60"`
 	IgnorePerms     bool                        `xml:"ignorePerms,attr"`
 	Versioning      VersioningConfiguration     `xml:"versioning"`
 	LenientMtimes   bool                        `xml:"lenientMtimes"`
+	IgnoreSymlinks  bool                        `xml:"ignoreSymlinks"`
+	WatchFS         bool                        `xml:"watchFS"`
+	WatchDelayS     int                         `xml:"watchDelayS"`
+	MaxDeletes      int                         `xml:"maxDeletes"`    // 0 for no limit
+	MaxDeletesPct   int                         `xml:"maxDeletesPct"` // 0 for no limit
+	Order           PullOrder                   `xml:"order"`         // empty for alphabetic
+	MinDiskFree     string                      `xml:"minDiskFree"`   // e.g. "1%" or "10 GB"; empty for 1%, 0 for no minimum
 
 	Invalid string `xml:"-"` // Set at runtime when there is an error, not saved
 
@@ -98,6 +109,120 @@ func (r *FolderConfiguration) DeviceIDs() []protocol.DeviceID {
 	return r.deviceIDs
 }
 
+// PullOrder is the order in which a folder pulls the files it needs.
+type PullOrder string
+
+const (
+	OrderAlphabetic    PullOrder = "alphabetic"
+	OrderRandom        PullOrder = "random"
+	OrderSmallestFirst PullOrder = "smallestFirst"
+	OrderLargestFirst  PullOrder = "largestFirst"
+	OrderOldestFirst   PullOrder = "oldestFirst"
+	OrderNewestFirst   PullOrder = "newestFirst"
+)
+
+func (o PullOrder) valid() bool {
+	switch o {
+	case "", OrderAlphabetic, OrderRandom, OrderSmallestFirst, OrderLargestFirst, OrderOldestFirst, OrderNewestFirst:
+		return true
+	default:
+		return false
+	}
+}
+
+// DefaultMinDiskFree is the free space kept on the disk of a folder unless
+// configured otherwise.
+const DefaultMinDiskFree = "1%"
+
+// MinDiskFreeSize returns the free space that must be left on the disk
+// holding the folder for it to be pulled.
+func (f FolderConfiguration) MinDiskFreeSize() Size {
+	if f.MinDiskFree == "" {
+		size, _ := ParseSize(DefaultMinDiskFree)
+		return size
+	}
+	size, _ := ParseSize(f.MinDiskFree)
+	return size
+}
+
+// A Size is an amount of disk space, either in bytes or as a percentage of
+// the total size of the disk.
+type Size struct {
+	Value   float64
+	Percent bool
+}
+
+var sizeUnits = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"m":  1e6,
+	"g":  1e9,
+	"t":  1e12,
+	"ki": 1 << 10,
+	"mi": 1 << 20,
+	"gi": 1 << 30,
+	"ti": 1 << 40,
+}
+
+// ParseSize parses sizes such as "1%", "500000", "100 MB" or "2 GiB". The
+// units are case insensitive; k, M, G and T are powers of 1000, while Ki, Mi,
+// Gi and Ti are powers of 1024. An empty string is a zero size.
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Size{}, nil
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	val, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return Size{}, fmt.Errorf("invalid size %q", s)
+	}
+
+	unit := strings.ToLower(strings.TrimSpace(s[i:]))
+	if unit == "%" {
+		if val > 100 {
+			return Size{}, fmt.Errorf("percentage in size %q is above 100", s)
+		}
+		return Size{Value: val, Percent: true}, nil
+	}
+	mult, ok := sizeUnits[strings.TrimSuffix(unit, "b")]
+	if !ok {
+		return Size{}, fmt.Errorf("invalid unit in size %q", s)
+	}
+	return Size{Value: val * mult}, nil
+}
+
+// Satisfied returns true if the given free space, on a disk of the given
+// total size, is at least the size.
+func (s Size) Satisfied(free, total int64) bool {
+	if s.Percent {
+		return float64(free)*100 >= s.Value*float64(total)
+	}
+	return float64(free) >= s.Value
+}
+
+func (s Size) String() string {
+	if s.Percent {
+		return strconv.FormatFloat(s.Value, 'f', -1, 64) + "%"
+	}
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	val, i := s.Value, 0
+	for val >= 1000 && i < len(units)-1 {
+		val /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f B", val)
+	}
+	return fmt.Sprintf("%.1f %s", val, units[i])
+}
+
 type VersioningConfiguration struct {
 	Type   string `xml:"type,attr"`
 	Params map[string]string
@@ -140,12 +265,40 @@ func (c *VersioningConfiguration) UnmarshalXML(d *xml.Decoder, start xml.StartEl
 }
 
 type DeviceConfiguration struct {
-	DeviceID    protocol.DeviceID `xml:"id,attr"`
-	Name        string            `xml:"name,attr,omitempty"`
-	Addresses   []string          `xml:"address,omitempty"`
-	Compression bool              `xml:"compression,attr"`
-	CertName    string            `xml:"certName,attr,omitempty"`
-	Introducer  bool              `xml:"introducer,attr"`
+	DeviceID        protocol.DeviceID `xml:"id,attr"`
+	Name            string            `xml:"name,attr,omitempty"`
+	Addresses       []string          `xml:"address,omitempty"`
+	Compression     bool              `xml:"compression,attr"`
+	CertName        string            `xml:"certName,attr,omitempty"`
+	Introducer      bool              `xml:"introducer,attr"`
+	MaxSendKbps     int               `xml:"maxSendKbps,attr,omitempty"` // 0 for no limit
+	MaxRecvKbps     int               `xml:"maxRecvKbps,attr,omitempty"` // 0 for no limit
+	AllowedNetworks []string          `xml:"allowedNetwork,omitempty"`   // CIDR networks or IP addresses; empty to allow any address
+}
+
+// AllowsIP returns true if the device may connect from, or be connected to
+// at, the given IP address.
+func (d DeviceConfiguration) AllowsIP(ip net.IP) bool {
+	if len(d.AllowedNetworks) == 0 {
+		return true
+	}
+	for _, network := range d.AllowedNetworks {
+		if allowed := net.ParseIP(network); allowed != nil {
+			if allowed.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			// Warned about when loading the config
+			continue
+		}
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 type FolderDeviceConfiguration struct {
@@ -156,24 +309,32 @@ type FolderDeviceConfiguration struct {
 }
 
 type OptionsConfiguration struct {
-	ListenAddress        []string `xml:"listenAddress" default:"0.0.0.0:22000"`
-	GlobalAnnServer      string   `xml:"globalAnnounceServer" default:"announce.syncthing.net:22026"`
-	GlobalAnnEnabled     bool     `xml:"globalAnnounceEnabled" default:"true"`
-	LocalAnnEnabled      bool     `xml:"localAnnounceEnabled" default:"true"`
-	LocalAnnPort         int      `xml:"localAnnouncePort" default:"21025"`
-	LocalAnnMCAddr       string   `xml:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
-	MaxSendKbps          int      `xml:"maxSendKbps"`
-	MaxRecvKbps          int      `xml:"maxRecvKbps"`
-	ReconnectIntervalS   int      `xml:"reconnectionIntervalS" default:"60"`
-	StartBrowser         bool     `xml:"startBrowser" default:"true"`
-	UPnPEnabled          bool     `xml:"upnpEnabled" default:"true"`
-	UPnPLease            int      `xml:"upnpLeaseMinutes" default:"0"`
-	UPnPRenewal          int      `xml:"upnpRenewalMinutes" default:"30"`
-	URAccepted           int      `xml:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
-	RestartOnWakeup      bool     `xml:"restartOnWakeup" default:"true"`
-	AutoUpgradeIntervalH int      `xml:"autoUpgradeIntervalH" default:"12"` // 0 for off
-	KeepTemporariesH     int      `xml:"keepTemporariesH" default:"24"`     // 0 for off
-	CacheIgnoredFiles    bool     `xml:"cacheIgnoredFiles" default:"true"`
+	ListenAddress        []string        `xml:"listenAddress" default:"0.0.0.0:22000"`
+	GlobalAnnServers     []string        `xml:"globalAnnounceServer" default:"announce.syncthing.net:22026"`
+	GlobalAnnEnabled     bool            `xml:"globalAnnounceEnabled" default:"true"`
+	LocalAnnEnabled      bool            `xml:"localAnnounceEnabled" default:"true"`
+	LocalAnnPort         int             `xml:"localAnnouncePort" default:"21025"`
+	LocalAnnMCAddr       string          `xml:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
+	MaxSendKbps          int             `xml:"maxSendKbps"`
+	MaxRecvKbps          int             `xml:"maxRecvKbps"`
+	LimitBandwidthInLan  bool            `xml:"limitBandwidthInLan" default:"true"` // false to exempt LAN connections from the limits above
+	ReconnectIntervalS   int             `xml:"reconnectionIntervalS" default:"60"`
+	DialTimeoutS         int             `xml:"dialTimeoutS" default:"10"`
+	HandshakeTimeoutS    int             `xml:"handshakeTimeoutS" default:"10"`
+	StartBrowser         bool            `xml:"startBrowser" default:"true"`
+	UPnPEnabled          bool            `xml:"upnpEnabled" default:"true"`
+	UPnPLease            int             `xml:"upnpLeaseMinutes" default:"0"`
+	UPnPRenewal          int             `xml:"upnpRenewalMinutes" default:"30"`
+	URAccepted           int             `xml:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
+	RestartOnWakeup      bool            `xml:"restartOnWakeup" default:"true"`
+	AutoUpgradeIntervalH int             `xml:"autoUpgradeIntervalH" default:"12"` // 0 for off
+	KeepTemporariesH     int             `xml:"keepTemporariesH" default:"24"`     // 0 for off
+	CacheIgnoredFiles    bool            `xml:"cacheIgnoredFiles" default:"true"`
+	RelayServers         []string        `xml:"relayServer"`                   // relay://host:port/?id=... URIs of relays to join
+	BandwidthSchedule    []BandwidthRule `xml:"bandwidthRule"`                 // overrides MaxSendKbps and MaxRecvKbps while a rule is active
+	ProgressIntervalS    int             `xml:"progressIntervalS" default:"5"` // 0 to not report or advertise download progress
+	Proxy                string          `xml:"proxy"`                         // socks5:// or http:// URL for outgoing connections; empty to use all_proxy or https_proxy from the environment
+	MinHomeDiskFree      string          `xml:"minHomeDiskFree" default:"1%"`  // Free space to keep on the disk holding the database; 0 for no minimum
 
 	Deprecated_RescanIntervalS int    `xml:"rescanIntervalS,omitempty" json:"-"`
 	Deprecated_UREnabled       bool   `xml:"urEnabled,omitempty" json:"-"`
@@ -183,6 +344,127 @@ type OptionsConfiguration struct {
 	Deprecated_GUIAddress      string `xml:"guiAddress,omitempty" json:"-"`
 }
 
+// ActiveBandwidthRule returns the first rule of the bandwidth schedule that
+// is active at the given time, if any.
+func (o OptionsConfiguration) ActiveBandwidthRule(t time.Time) (BandwidthRule, bool) {
+	for _, rule := range o.BandwidthSchedule {
+		if rule.Active(t) {
+			return rule, true
+		}
+	}
+	return BandwidthRule{}, false
+}
+
+// MinHomeDiskFreeSize returns the free space that must be left on the disk
+// holding the database for folders to be pulled.
+func (o OptionsConfiguration) MinHomeDiskFreeSize() Size {
+	size, _ := ParseSize(o.MinHomeDiskFree)
+	return size
+}
+
+// A BandwidthRule sets the rate limits for a time of day on some days of the
+// week. Days is a comma separated list of weekdays ("Mon,Tue") or empty for
+// every day. Start and End are given as "15:04"; a rule that ends before it
+// starts continues past midnight, and one that ends when it starts lasts
+// the whole day.
+type BandwidthRule struct {
+	Days        string `xml:"days,attr,omitempty"`
+	Start       string `xml:"start,attr"`
+	End         string `xml:"end,attr"`
+	MaxSendKbps int    `xml:"maxSendKbps,attr"` // 0 for no limit
+	MaxRecvKbps int    `xml:"maxRecvKbps,attr"` // 0 for no limit
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (r BandwidthRule) String() string {
+	days := r.Days
+	if days == "" {
+		days = "every day"
+	}
+	return fmt.Sprintf("%s %s-%s", days, r.Start, r.End)
+}
+
+// Validate returns an error if the days or times of the rule are malformed.
+func (r BandwidthRule) Validate() error {
+	_, _, _, err := r.parse()
+	return err
+}
+
+// Active returns true if the rule applies at the given time. Malformed rules
+// are never active.
+func (r BandwidthRule) Active(t time.Time) bool {
+	days, start, end, err := r.parse()
+	if err != nil {
+		return false
+	}
+
+	wd := t.Weekday()
+	now := t.Hour()*60 + t.Minute()
+	switch {
+	case start == end:
+		return days[wd]
+	case start < end:
+		return days[wd] && now >= start && now < end
+	case now >= start:
+		return days[wd]
+	case now < end:
+		// Continued from the day before
+		return days[(wd+6)%7]
+	default:
+		return false
+	}
+}
+
+// parse returns the days the rule applies to, and the start and end times
+// in minutes after midnight.
+func (r BandwidthRule) parse() (days [7]bool, start, end int, err error) {
+	if strings.TrimSpace(r.Days) == "" {
+		for i := range days {
+			days[i] = true
+		}
+	} else {
+		for _, day := range strings.Split(r.Days, ",") {
+			day = strings.ToLower(strings.TrimSpace(day))
+			wd, ok := time.Weekday(0), false
+			if len(day) >= 3 {
+				wd, ok = weekdays[day[:3]]
+			}
+			if !ok || !strings.HasPrefix(strings.ToLower(wd.String()), day) {
+				return days, 0, 0, fmt.Errorf("unknown weekday %q", day)
+			}
+			days[wd] = true
+		}
+	}
+
+	if start, err = parseTimeOfDay(r.Start); err != nil {
+		return days, 0, 0, err
+	}
+	if end, err = parseTimeOfDay(r.End); err != nil {
+		return days, 0, 0, err
+	}
+	return days, start, end, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
 type GUIConfiguration struct {
 	Enabled  bool   `xml:"enabled,attr" default:"true"`
 	Address  string `xml:"address" default:"127.0.0.1:8080"`
@@ -256,6 +538,20 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 			folder.ID = "default"
 		}
 
+		if folder.ReadOnly && folder.ReceiveOnly {
+			folder.Invalid = "folder cannot be both read only and receive only"
+		}
+
+		if !folder.Order.valid() {
+			l.Warnf("Folder %q: unknown pull order %q; using alphabetic", folder.ID, folder.Order)
+			folder.Order = OrderAlphabetic
+		}
+
+		if _, err := ParseSize(folder.MinDiskFree); err != nil {
+			l.Warnf("Folder %q: %v; using %s", folder.ID, err, DefaultMinDiskFree)
+			folder.MinDiskFree = ""
+		}
+
 		if seen, ok := seenFolders[folder.ID]; ok {
 			l.Warnf("Multiple folders with ID %q; disabling", folder.ID)
 
@@ -272,6 +568,32 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		}
 	}
 
+	for _, device := range cfg.Devices {
+		for _, network := range device.AllowedNetworks {
+			if net.ParseIP(network) != nil {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(network); err != nil {
+				l.Warnf("Allowed network %q for device %v: %v; ignoring", network, device.DeviceID, err)
+			}
+		}
+	}
+
+	var schedule []BandwidthRule
+	for _, rule := range cfg.Options.BandwidthSchedule {
+		if err := rule.Validate(); err != nil {
+			l.Warnf("Bandwidth rule %q: %v; removing", rule, err)
+			continue
+		}
+		schedule = append(schedule, rule)
+	}
+	cfg.Options.BandwidthSchedule = schedule
+
+	if _, err := ParseSize(cfg.Options.MinHomeDiskFree); err != nil {
+		l.Warnf("Minimum free space for the database: %v; using %s", err, DefaultMinDiskFree)
+		cfg.Options.MinHomeDiskFree = DefaultMinDiskFree
+	}
+
 	if cfg.Options.Deprecated_URDeclined {
 		cfg.Options.URAccepted = -1
 	}
@@ -367,8 +689,14 @@ func ChangeRequiresRestart(from, to Configuration) bool {
 		}
 	}
 
-	// All of the generic options require restart
-	if !reflect.DeepEqual(from.Options, to.Options) || !reflect.DeepEqual(from.GUI, to.GUI) {
+	// All of the generic options require restart, except for the rate limits
+	// which are applied to the running connections.
+	fromOpts, toOpts := from.Options, to.Options
+	fromOpts.MaxSendKbps, toOpts.MaxSendKbps = 0, 0
+	fromOpts.MaxRecvKbps, toOpts.MaxRecvKbps = 0, 0
+	fromOpts.LimitBandwidthInLan, toOpts.LimitBandwidthInLan = false, false
+	fromOpts.BandwidthSchedule, toOpts.BandwidthSchedule = nil, nil
+	if !reflect.DeepEqual(fromOpts, toOpts) || !reflect.DeepEqual(from.GUI, to.GUI) {
 		return true
 	}
 
@@ -449,8 +777,10 @@ func convertV2V3(cfg *Configuration) {
 
 	// The global discovery format and port number changed in v0.9. Having the
 	// default announce server but old port number is guaranteed to be legacy.
-	if cfg.Options.GlobalAnnServer == "announce.syncthing.net:22025" {
-		cfg.Options.GlobalAnnServer = "announce.syncthing.net:22026"
+	for i, srv := range cfg.Options.GlobalAnnServers {
+		if srv == "announce.syncthing.net:22025" {
+			cfg.Options.GlobalAnnServers[i] = "announce.syncthing.net:22026"
+		}
 	}
 
 	cfg.Version = 3
@@ -17,9 +17,11 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/syncthing/syncthing/internal/protocol"
 )
@@ -36,14 +38,17 @@ func init() {
 func TestDefaultValues(t *testing.T) {
 	expected := OptionsConfiguration{
 		ListenAddress:        []string{"0.0.0.0:22000"},
-		GlobalAnnServer:      "announce.syncthing.net:22026",
+		GlobalAnnServers:     []string{"announce.syncthing.net:22026"},
 		GlobalAnnEnabled:     true,
 		LocalAnnEnabled:      true,
 		LocalAnnPort:         21025,
 		LocalAnnMCAddr:       "[ff32::5222]:21026",
 		MaxSendKbps:          0,
 		MaxRecvKbps:          0,
+		LimitBandwidthInLan:  true,
 		ReconnectIntervalS:   60,
+		DialTimeoutS:         10,
+		HandshakeTimeoutS:    10,
 		StartBrowser:         true,
 		UPnPEnabled:          true,
 		UPnPLease:            0,
@@ -52,6 +57,8 @@ func TestDefaultValues(t *testing.T) {
 		AutoUpgradeIntervalH: 12,
 		KeepTemporariesH:     24,
 		CacheIgnoredFiles:    true,
+		ProgressIntervalS:    5,
+		MinHomeDiskFree:      "1%",
 	}
 
 	cfg := New(device1)
@@ -134,14 +141,17 @@ func TestNoListenAddress(t *testing.T) {
 func TestOverriddenValues(t *testing.T) {
 	expected := OptionsConfiguration{
 		ListenAddress:        []string{":23000"},
-		GlobalAnnServer:      "syncthing.nym.se:22026",
+		GlobalAnnServers:     []string{"syncthing.nym.se:22026"},
 		GlobalAnnEnabled:     false,
 		LocalAnnEnabled:      false,
 		LocalAnnPort:         42123,
 		LocalAnnMCAddr:       "quux:3232",
 		MaxSendKbps:          1234,
 		MaxRecvKbps:          2341,
+		LimitBandwidthInLan:  false,
 		ReconnectIntervalS:   6000,
+		DialTimeoutS:         5,
+		HandshakeTimeoutS:    15,
 		StartBrowser:         false,
 		UPnPEnabled:          false,
 		UPnPLease:            60,
@@ -150,6 +160,11 @@ func TestOverriddenValues(t *testing.T) {
 		AutoUpgradeIntervalH: 24,
 		KeepTemporariesH:     48,
 		CacheIgnoredFiles:    false,
+		ProgressIntervalS:    2,
+		MinHomeDiskFree:      "5 GB",
+		BandwidthSchedule: []BandwidthRule{
+			{Days: "Mon,Tue,Wed,Thu,Fri", Start: "08:00", End: "18:00", MaxSendKbps: 100, MaxRecvKbps: 200},
+		},
 	}
 
 	cfg, err := Load("testdata/overridenvalues.xml", device1)
@@ -162,6 +177,128 @@ func TestOverriddenValues(t *testing.T) {
 	}
 }
 
+func TestDeviceAllowsIP(t *testing.T) {
+	dev := DeviceConfiguration{
+		AllowedNetworks: []string{"192.168.0.0/16", "2001:db8::/32", "198.51.100.7", "bogus"},
+	}
+
+	cases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.168.1.10", true},
+		{"2001:db8::1", true},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"10.0.0.1", false},
+		{"2001:db9::1", false},
+	}
+
+	for _, tc := range cases {
+		if allowed := dev.AllowsIP(net.ParseIP(tc.ip)); allowed != tc.allowed {
+			t.Errorf("%s: allowed %v, expected %v", tc.ip, allowed, tc.allowed)
+		}
+	}
+
+	if !(DeviceConfiguration{}).AllowsIP(net.ParseIP("192.0.2.1")) {
+		t.Error("a device without allowed networks should allow any address")
+	}
+}
+
+func TestBandwidthRuleActive(t *testing.T) {
+	// 2015-01-05 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2015, 1, 5+day, hour, min, 0, 0, time.Local)
+	}
+
+	cases := []struct {
+		rule   BandwidthRule
+		t      time.Time
+		active bool
+	}{
+		{BandwidthRule{Days: "Mon,Tue", Start: "08:00", End: "18:00"}, at(0, 8, 0), true},
+		{BandwidthRule{Days: "Mon,Tue", Start: "08:00", End: "18:00"}, at(1, 17, 59), true},
+		{BandwidthRule{Days: "Mon,Tue", Start: "08:00", End: "18:00"}, at(1, 18, 0), false},
+		{BandwidthRule{Days: "Mon,Tue", Start: "08:00", End: "18:00"}, at(0, 7, 59), false},
+		{BandwidthRule{Days: "Mon,Tue", Start: "08:00", End: "18:00"}, at(2, 12, 0), false},
+		{BandwidthRule{Days: "monday, Friday", Start: "08:00", End: "18:00"}, at(4, 12, 0), true},
+		{BandwidthRule{Start: "08:00", End: "18:00"}, at(6, 12, 0), true},
+		{BandwidthRule{Days: "Sat,Sun"}, at(5, 0, 0), true},
+		{BandwidthRule{Days: "Sat,Sun"}, at(0, 12, 0), false},
+
+		// Past midnight; the night to Tuesday belongs to Monday
+		{BandwidthRule{Days: "Mon", Start: "22:00", End: "06:00"}, at(0, 23, 0), true},
+		{BandwidthRule{Days: "Mon", Start: "22:00", End: "06:00"}, at(1, 5, 0), true},
+		{BandwidthRule{Days: "Mon", Start: "22:00", End: "06:00"}, at(0, 5, 0), false},
+		{BandwidthRule{Days: "Mon", Start: "22:00", End: "06:00"}, at(1, 12, 0), false},
+
+		// Malformed rules are never active
+		{BandwidthRule{Days: "Mon", Start: "8am", End: "18:00"}, at(0, 12, 0), false},
+		{BandwidthRule{Days: "Someday"}, at(0, 12, 0), false},
+	}
+
+	for i, tc := range cases {
+		if active := tc.rule.Active(tc.t); active != tc.active {
+			t.Errorf("%d: %v at %v: active %v, expected %v", i, tc.rule, tc.t, active, tc.active)
+		}
+	}
+
+	opts := OptionsConfiguration{
+		BandwidthSchedule: []BandwidthRule{
+			{Days: "Sat,Sun", MaxSendKbps: 1},
+			{Start: "08:00", End: "18:00", MaxSendKbps: 2},
+		},
+	}
+	if rule, ok := opts.ActiveBandwidthRule(at(5, 12, 0)); !ok || rule.MaxSendKbps != 1 {
+		t.Errorf("incorrect rule %v for Saturday", rule)
+	}
+	if rule, ok := opts.ActiveBandwidthRule(at(0, 12, 0)); !ok || rule.MaxSendKbps != 2 {
+		t.Errorf("incorrect rule %v for Monday", rule)
+	}
+	if rule, ok := opts.ActiveBandwidthRule(at(0, 20, 0)); ok {
+		t.Errorf("unexpected rule %v for Monday evening", rule)
+	}
+}
+
+func TestBandwidthRuleValidate(t *testing.T) {
+	cases := []struct {
+		rule  BandwidthRule
+		valid bool
+	}{
+		{BandwidthRule{}, true},
+		{BandwidthRule{Days: "Mon, tuesday,WED", Start: "08:00", End: "18:30"}, true},
+		{BandwidthRule{Days: "Someday"}, false},
+		{BandwidthRule{Days: "Monkey"}, false},
+		{BandwidthRule{Days: "Mo"}, false},
+		{BandwidthRule{Days: "Mon,"}, false},
+		{BandwidthRule{Start: "8am"}, false},
+		{BandwidthRule{End: "24:00"}, false},
+	}
+
+	for i, tc := range cases {
+		if err := tc.rule.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%d: %v: error %v, expected valid %v", i, tc.rule, err, tc.valid)
+		}
+	}
+
+	cfg := Configuration{
+		Options: OptionsConfiguration{
+			BandwidthSchedule: []BandwidthRule{
+				{Days: "Sat", MaxSendKbps: 1},
+				{Days: "Someday", MaxSendKbps: 2},
+				{Start: "08:00", End: "6pm", MaxSendKbps: 3},
+				{Start: "22:00", End: "06:00", MaxSendKbps: 4},
+			},
+		},
+	}
+	cfg.prepare(device1)
+
+	schedule := cfg.Options.BandwidthSchedule
+	if len(schedule) != 2 || schedule[0].MaxSendKbps != 1 || schedule[1].MaxSendKbps != 4 {
+		t.Errorf("malformed rules not removed: %v", schedule)
+	}
+}
+
 func TestDeviceAddressesDynamic(t *testing.T) {
 	name, _ := os.Hostname()
 	expected := map[protocol.DeviceID]DeviceConfiguration{
@@ -307,6 +444,99 @@ func TestPrepare(t *testing.T) {
 	}
 }
 
+func TestPullOrder(t *testing.T) {
+	cfg := Configuration{
+		Folders: []FolderConfiguration{
+			{ID: "a", Path: "a", Order: OrderNewestFirst},
+			{ID: "b", Path: "b", Order: "bogus"},
+			{ID: "c", Path: "c"},
+		},
+	}
+
+	cfg.prepare(device1)
+
+	expected := []PullOrder{OrderNewestFirst, OrderAlphabetic, ""}
+	for i, folder := range cfg.Folders {
+		if folder.Order != expected[i] {
+			t.Errorf("folder %q: order %q != %q", folder.ID, folder.Order, expected[i])
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		in   string
+		size Size
+		ok   bool
+	}{
+		{"", Size{}, true},
+		{"0", Size{}, true},
+		{"1%", Size{1, true}, true},
+		{" 2.5 % ", Size{2.5, true}, true},
+		{"500000", Size{500000, false}, true},
+		{"100 MB", Size{100e6, false}, true},
+		{"2GiB", Size{2 << 30, false}, true},
+		{"3 k", Size{3000, false}, true},
+		{"101%", Size{}, false},
+		{"10 parsecs", Size{}, false},
+		{"GB", Size{}, false},
+	}
+
+	for _, tc := range cases {
+		size, err := ParseSize(tc.in)
+		if tc.ok && err != nil {
+			t.Errorf("%q: unexpected error %v", tc.in, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%q: expected an error", tc.in)
+		} else if size != tc.size {
+			t.Errorf("%q: size %v != %v", tc.in, size, tc.size)
+		}
+	}
+
+	if !(Size{1, true}).Satisfied(10, 1000) || (Size{1, true}).Satisfied(9, 1000) {
+		t.Error("incorrect percentage check")
+	}
+	if !(Size{100, false}).Satisfied(100, 1000) || (Size{100, false}).Satisfied(99, 1000) {
+		t.Error("incorrect absolute check")
+	}
+
+	for _, tc := range []struct {
+		size Size
+		str  string
+	}{
+		{Size{1.5, true}, "1.5%"},
+		{Size{500, false}, "500 B"},
+		{Size{2.5e9, false}, "2.5 GB"},
+	} {
+		if str := tc.size.String(); str != tc.str {
+			t.Errorf("%v: %q != %q", tc.size.Value, str, tc.str)
+		}
+	}
+}
+
+func TestMinDiskFree(t *testing.T) {
+	cfg := Configuration{
+		Folders: []FolderConfiguration{
+			{ID: "a", Path: "a", MinDiskFree: "10 GB"},
+			{ID: "b", Path: "b", MinDiskFree: "bogus"},
+			{ID: "c", Path: "c"},
+		},
+		Options: OptionsConfiguration{MinHomeDiskFree: "200%"},
+	}
+
+	cfg.prepare(device1)
+
+	expected := []Size{{10e9, false}, {1, true}, {1, true}}
+	for i, folder := range cfg.Folders {
+		if size := folder.MinDiskFreeSize(); size != expected[i] {
+			t.Errorf("folder %q: size %v != %v", folder.ID, size, expected[i])
+		}
+	}
+	if size := cfg.Options.MinHomeDiskFreeSize(); size != (Size{1, true}) {
+		t.Errorf("incorrect database size %v", size)
+	}
+}
+
 func TestRequiresRestart(t *testing.T) {
 	wr, err := Load("testdata/v6.xml", device1)
 	if err != nil {
@@ -377,6 +607,13 @@ func TestRequiresRestart(t *testing.T) {
 		t.Error("Changing general options requires restart")
 	}
 
+	newCfg = cfg
+	newCfg.Options.MaxSendKbps = cfg.Options.MaxSendKbps + 100
+	newCfg.Options.LimitBandwidthInLan = !cfg.Options.LimitBandwidthInLan
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing rate limits does not require restart")
+	}
+
 	newCfg = cfg
 	newCfg.GUI.UseTLS = !cfg.GUI.UseTLS
 	if !ChangeRequiresRestart(cfg, newCfg) {
@@ -109,6 +109,11 @@ func (w *ConfigWrapper) Subscribe(h Handler) {
 	w.sMut.Unlock()
 }
 
+// ConfigPath returns the path of the configuration file.
+func (w *ConfigWrapper) ConfigPath() string {
+	return w.path
+}
+
 // Raw returns the currently wrapped Configuration object.
 func (w *ConfigWrapper) Raw() Configuration {
 	return w.cfg
@@ -0,0 +1,189 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package dialer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+const (
+	socks5Version          = 5
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+	socks5CmdConnect       = 1
+	socks5AddrIPv4         = 1
+	socks5AddrDomain       = 3
+	socks5AddrIPv6         = 4
+)
+
+var socks5Errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// connectSOCKS5 performs the SOCKS5 (RFC 1928) handshake on the connection
+// to the proxy, asking it to connect to the address. Host names are resolved
+// by the proxy.
+func connectSOCKS5(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		conn.Close()
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	if err := socks5Authenticate(conn, proxy.User); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			conn.Close()
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The reply is the version, the status, a reserved byte and the address
+	// the proxy bound to, which we don't need.
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp[0] != socks5Version {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected SOCKS version %d", resp[0])
+	}
+	if resp[1] != 0 {
+		conn.Close()
+		msg, ok := socks5Errors[resp[1]]
+		if !ok {
+			msg = fmt.Sprintf("unknown error %d", resp[1])
+		}
+		return nil, targetError{fmt.Sprintf("connect to %s: %s", addr, msg)}
+	}
+
+	var skip int
+	switch resp[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len + 2
+	case socks5AddrIPv6:
+		skip = net.IPv6len + 2
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		skip = int(n[0]) + 2
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected SOCKS address type %d", resp[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// socks5Authenticate negotiates the authentication method, using a username
+// and password (RFC 1929) if the proxy URL has one.
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	methods := []byte{socks5AuthNone}
+	if user != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case socks5AuthNone:
+		return nil
+
+	case socks5AuthPassword:
+		if user == nil {
+			return errors.New("proxy requires authentication")
+		}
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{1, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errors.New("authentication failed")
+		}
+		return nil
+
+	case socks5AuthNoAcceptable:
+		return errors.New("no acceptable authentication method")
+
+	default:
+		return fmt.Errorf("unexpected authentication method %d", resp[1])
+	}
+}
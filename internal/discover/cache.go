@@ -0,0 +1,219 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"sort"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Same key space as files/leveldb.go keyType* constants
+const (
+	keyTypeCacheEntry = iota + 40
+)
+
+// Sources of cache entries
+const (
+	SourceLocal  = "local"
+	SourceGlobal = "global"
+	SourceHint   = "hint"
+)
+
+// cacheRecord is the database representation of a CacheEntry. Times are
+// stored as Unix nanoseconds, zero meaning never.
+type cacheRecord struct {
+	Seen          int64
+	Source        string // max:16
+	LastConnected int64
+	LastFailed    int64
+}
+
+// cacheKey returns a byte slice encoding the following information:
+//
+//	keyTypeCacheEntry (1 byte)
+//	device (32 bytes)
+//	address (variable size)
+func cacheKey(device protocol.DeviceID, address string) []byte {
+	k := make([]byte, 1+32+len(address))
+	k[0] = keyTypeCacheEntry
+	copy(k[1:], device[:])
+	copy(k[1+32:], address)
+	return k
+}
+
+func toRecord(e CacheEntry) cacheRecord {
+	return cacheRecord{
+		Seen:          unixNano(e.Seen),
+		Source:        e.Source,
+		LastConnected: unixNano(e.LastConnected),
+		LastFailed:    unixNano(e.LastFailed),
+	}
+}
+
+func fromRecord(address string, r cacheRecord) CacheEntry {
+	return CacheEntry{
+		Address:       address,
+		Seen:          fromUnixNano(r.Seen),
+		Source:        r.Source,
+		LastConnected: fromUnixNano(r.LastConnected),
+		LastFailed:    fromUnixNano(r.LastFailed),
+	}
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// loadCache reads the cache entries from the database into the registry,
+// skipping and removing the ones that have expired.
+func (d *Discoverer) loadCache() {
+	if d.db == nil {
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	it := d.db.NewIterator(util.BytesPrefix([]byte{keyTypeCacheEntry}), nil)
+	for it.Next() {
+		key := it.Key()
+		if len(key) < 1+32 {
+			batch.Delete(append([]byte(nil), key...))
+			continue
+		}
+
+		var rec cacheRecord
+		if err := rec.UnmarshalXDR(it.Value()); err != nil {
+			batch.Delete(append([]byte(nil), key...))
+			continue
+		}
+
+		var id protocol.DeviceID
+		copy(id[:], key[1:])
+		entry := fromRecord(string(key[1+32:]), rec)
+		if d.expired(entry) {
+			batch.Delete(append([]byte(nil), key...))
+			continue
+		}
+
+		d.registry[id] = append(d.registry[id], entry)
+	}
+	it.Release()
+
+	if err := d.db.Write(batch, nil); err != nil {
+		l.Warnln("Discovery cache:", err)
+	}
+
+	if debug {
+		l.Debugf("discover: loaded cache for %d devices", len(d.registry))
+	}
+}
+
+// saveCache replaces the stored cache entries for the device with the given
+// ones.
+func (d *Discoverer) saveCache(id protocol.DeviceID, entries []CacheEntry) {
+	if d.db == nil {
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	it := d.db.NewIterator(util.BytesPrefix(cacheKey(id, "")), nil)
+	for it.Next() {
+		batch.Delete(append([]byte(nil), it.Key()...))
+	}
+	it.Release()
+
+	for _, e := range entries {
+		bs, err := toRecord(e).MarshalXDR()
+		if err != nil {
+			l.Warnln("Discovery cache:", err)
+			continue
+		}
+		batch.Put(cacheKey(id, e.Address), bs)
+	}
+
+	if err := d.db.Write(batch, nil); err != nil {
+		l.Warnln("Discovery cache:", err)
+	}
+}
+
+// expired returns true if the entry should be removed from the cache. An
+// entry is kept while it has recently been seen in an announcement, or while
+// the last connection attempt to it succeeded within the persist lifetime.
+func (d *Discoverer) expired(e CacheEntry) bool {
+	if time.Since(e.Seen) <= d.cacheLifetime {
+		return false
+	}
+	if e.connectedOK() && time.Since(e.LastConnected) <= d.persistLifetime {
+		return false
+	}
+	return true
+}
+
+func (e CacheEntry) connectedOK() bool {
+	return !e.LastConnected.IsZero() && e.LastConnected.After(e.LastFailed)
+}
+
+// rankedEntries sorts entries with the address we last connected to
+// successfully first, then addresses we haven't tried, then the ones that
+// failed.
+type rankedEntries []CacheEntry
+
+func (r rankedEntries) Len() int {
+	return len(r)
+}
+
+func (r rankedEntries) Swap(a, b int) {
+	r[a], r[b] = r[b], r[a]
+}
+
+func (r rankedEntries) Less(a, b int) bool {
+	ra, rb := r[a].rank(), r[b].rank()
+	if ra != rb {
+		return ra < rb
+	}
+	if ra == 0 {
+		return r[a].LastConnected.After(r[b].LastConnected)
+	}
+	return false
+}
+
+func (e CacheEntry) rank() int {
+	switch {
+	case e.connectedOK():
+		return 0
+	case e.LastFailed.IsZero():
+		return 1
+	default:
+		return 2
+	}
+}
+
+func rankEntries(entries []CacheEntry) {
+	sort.Stable(rankedEntries(entries))
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestCachePersistence(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	id := protocol.LocalDeviceID
+
+	d := NewDiscoverer(protocol.LocalDeviceID, nil, nil, db)
+	d.registerDevice(nil, Device{
+		ID: id[:],
+		Addresses: []Address{
+			{IP: []byte{192, 0, 2, 1}, Port: 22000},
+			{IP: []byte{192, 0, 2, 2}, Port: 22000},
+			{IP: []byte{192, 0, 2, 3}, Port: 22000},
+		},
+	}, nil, SourceLocal)
+	d.ConnectionFailed(id, "192.0.2.1:22000")
+	d.ConnectionSucceeded(id, "192.0.2.2:22000")
+
+	// A new discoverer on the same database starts out with the cache, ranked
+	// by connection history.
+	d = NewDiscoverer(protocol.LocalDeviceID, nil, nil, db)
+	addrs := d.Lookup(id)
+	expected := []string{"192.0.2.2:22000", "192.0.2.3:22000", "192.0.2.1:22000"}
+	if len(addrs) != len(expected) {
+		t.Fatalf("incorrect addresses %v", addrs)
+	}
+	for i := range expected {
+		if addrs[i] != expected[i] {
+			t.Errorf("incorrect address %d: %s != %s", i, addrs[i], expected[i])
+		}
+	}
+	if src := d.registry[id][0].Source; src != SourceLocal {
+		t.Errorf("incorrect source %q", src)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	id := protocol.LocalDeviceID
+	old := time.Now().Add(-time.Hour)
+
+	d := NewDiscoverer(protocol.LocalDeviceID, nil, nil, db)
+	d.saveCache(id, []CacheEntry{
+		{Address: "192.0.2.1:22000", Seen: old, Source: SourceGlobal},
+		{Address: "192.0.2.2:22000", Seen: old, Source: SourceGlobal, LastConnected: old},
+		{Address: "192.0.2.3:22000", Seen: old, Source: SourceGlobal, LastConnected: old.Add(-time.Minute), LastFailed: old},
+	})
+
+	// Only the address we have connected to is kept past the cache lifetime.
+	d = NewDiscoverer(protocol.LocalDeviceID, nil, nil, db)
+	addrs := d.Lookup(id)
+	if len(addrs) != 1 || addrs[0] != "192.0.2.2:22000" {
+		t.Errorf("incorrect addresses %v", addrs)
+	}
+
+	// ... until the persist lifetime runs out as well.
+	d.persistLifetime = time.Minute
+	if addrs := d.Lookup(id); len(addrs) != 0 {
+		t.Errorf("incorrect addresses %v", addrs)
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
-	"io"
 	"net"
 	"strconv"
 	"sync"
@@ -28,48 +27,74 @@ import (
 	"github.com/syncthing/syncthing/internal/beacon"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type Discoverer struct {
-	myID             protocol.DeviceID
-	listenAddrs      []string
-	localBcastIntv   time.Duration
-	globalBcastIntv  time.Duration
-	errorRetryIntv   time.Duration
-	cacheLifetime    time.Duration
-	broadcastBeacon  beacon.Interface
-	multicastBeacon  beacon.Interface
-	registry         map[protocol.DeviceID][]CacheEntry
-	registryLock     sync.RWMutex
-	extServer        string
-	extPort          uint16
-	localBcastTick   <-chan time.Time
-	stopGlobal       chan struct{}
-	globalWG         sync.WaitGroup
-	forcedBcastTick  chan time.Time
-	extAnnounceOK    bool
-	extAnnounceOKmut sync.Mutex
+	myID            protocol.DeviceID
+	listenAddrs     []string
+	relays          []string
+	localBcastIntv  time.Duration
+	globalBcastIntv time.Duration
+	errorRetryIntv  time.Duration
+	cacheLifetime   time.Duration
+	persistLifetime time.Duration
+	broadcastBeacon beacon.Interface
+	multicastBeacon beacon.Interface
+	registry        map[protocol.DeviceID][]CacheEntry
+	registryLock    sync.RWMutex
+	db              *leveldb.DB
+	extServers      []string
+	extPort         uint16
+	localBcastTick  <-chan time.Time
+	stopGlobal      chan struct{}
+	globalWG        sync.WaitGroup
+	forcedBcastTick chan time.Time
+	extStatus       map[string]ServerStatus
+	extStatusMut    sync.Mutex
 }
 
 type CacheEntry struct {
-	Address string
-	Seen    time.Time
+	Address       string
+	Seen          time.Time // Last time the address was announced or looked up
+	Source        string    // One of the Source* constants
+	LastConnected time.Time // Last successful connection to the address
+	LastFailed    time.Time // Last failed connection attempt to the address
+}
+
+// ServerStatus describes the health of a global discovery server, as seen
+// by our announcements to it and lookups against it.
+type ServerStatus struct {
+	AnnounceOK   bool      `json:"announceOK"`
+	LastAnnounce time.Time `json:"lastAnnounce"`
+	LookupOK     bool      `json:"lookupOK"`
+	LastLookup   time.Time `json:"lastLookup"`
+	Error        string    `json:"error,omitempty"`
 }
 
 var (
 	ErrIncorrectMagic = errors.New("incorrect magic number")
 )
 
-func NewDiscoverer(id protocol.DeviceID, addresses []string) *Discoverer {
-	return &Discoverer{
+// NewDiscoverer returns a Discoverer that announces the given addresses and
+// relays. The cache of discovered addresses is persisted in the database,
+// unless it is nil.
+func NewDiscoverer(id protocol.DeviceID, addresses []string, relays []string, db *leveldb.DB) *Discoverer {
+	d := &Discoverer{
 		myID:            id,
 		listenAddrs:     addresses,
+		relays:          relays,
 		localBcastIntv:  30 * time.Second,
 		globalBcastIntv: 1800 * time.Second,
 		errorRetryIntv:  60 * time.Second,
 		cacheLifetime:   5 * time.Minute,
+		persistLifetime: 24 * time.Hour,
 		registry:        make(map[protocol.DeviceID][]CacheEntry),
+		extStatus:       make(map[string]ServerStatus),
+		db:              db,
 	}
+	d.loadCache()
+	return d
 }
 
 func (d *Discoverer) StartLocal(localPort int, localMCAddr string) {
@@ -108,14 +133,26 @@ func (d *Discoverer) StartLocal(localPort int, localMCAddr string) {
 	}
 }
 
-func (d *Discoverer) StartGlobal(server string, extPort uint16) {
-	// Wait for any previous announcer to stop before starting a new one.
+// StartGlobal starts announcing to the given global discovery servers, which
+// are also the servers used for lookups.
+func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
+	// Wait for any previous announcers to stop before starting new ones.
 	d.globalWG.Wait()
-	d.extServer = server
+	d.extServers = servers
 	d.extPort = extPort
 	d.stopGlobal = make(chan struct{})
-	d.globalWG.Add(1)
-	go d.sendExternalAnnouncements()
+
+	d.extStatusMut.Lock()
+	d.extStatus = make(map[string]ServerStatus, len(servers))
+	for _, server := range servers {
+		d.extStatus[server] = ServerStatus{}
+	}
+	d.extStatusMut.Unlock()
+
+	for _, server := range servers {
+		d.globalWG.Add(1)
+		go d.sendExternalAnnouncements(server)
+	}
 }
 
 func (d *Discoverer) StopGlobal() {
@@ -125,38 +162,107 @@ func (d *Discoverer) StopGlobal() {
 	}
 }
 
+// ExtAnnounceOK returns true if at least one global discovery server has
+// accepted our announcement.
 func (d *Discoverer) ExtAnnounceOK() bool {
-	d.extAnnounceOKmut.Lock()
-	defer d.extAnnounceOKmut.Unlock()
-	return d.extAnnounceOK
+	d.extStatusMut.Lock()
+	defer d.extStatusMut.Unlock()
+	for _, status := range d.extStatus {
+		if status.AnnounceOK {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtServerStatus returns the status of each global discovery server.
+func (d *Discoverer) ExtServerStatus() map[string]ServerStatus {
+	d.extStatusMut.Lock()
+	defer d.extStatusMut.Unlock()
+	res := make(map[string]ServerStatus, len(d.extStatus))
+	for server, status := range d.extStatus {
+		res[server] = status
+	}
+	return res
 }
 
+// Lookup returns the known addresses for the device, with the ones we have
+// successfully connected to first. The global discovery servers are queried
+// when no address has been seen recently.
 func (d *Discoverer) Lookup(device protocol.DeviceID) []string {
 	d.registryLock.RLock()
 	cached := d.filterCached(d.registry[device])
 	d.registryLock.RUnlock()
 
-	if len(cached) > 0 {
-		addrs := make([]string, len(cached))
-		for i := range cached {
-			addrs[i] = cached[i].Address
+	fresh := false
+	for _, e := range cached {
+		if time.Since(e.Seen) <= d.cacheLifetime {
+			fresh = true
+			break
 		}
-		return addrs
-	} else if len(d.extServer) != 0 {
+	}
+
+	if !fresh && len(d.extServers) != 0 {
 		addrs := d.externalLookup(device)
-		cached = make([]CacheEntry, len(addrs))
-		for i := range addrs {
-			cached[i] = CacheEntry{
-				Address: addrs[i],
-				Seen:    time.Now(),
-			}
-		}
 
 		d.registryLock.Lock()
+		cached = d.filterCached(d.registry[device])
+		cached = mergeEntries(cached, addrs, SourceGlobal)
 		d.registry[device] = cached
 		d.registryLock.Unlock()
+
+		d.saveCache(device, cached)
+	}
+
+	entries := make([]CacheEntry, len(cached))
+	copy(entries, cached)
+	rankEntries(entries)
+
+	var addrs []string
+	for _, e := range entries {
+		addrs = append(addrs, e.Address)
+	}
+	return addrs
+}
+
+// ConnectionSucceeded records a successful connection to the device at the
+// given address.
+func (d *Discoverer) ConnectionSucceeded(device protocol.DeviceID, address string) {
+	d.recordConnection(device, address, func(e *CacheEntry) {
+		e.LastConnected = time.Now()
+	})
+}
+
+// ConnectionFailed records a failed connection attempt to the device at the
+// given address.
+func (d *Discoverer) ConnectionFailed(device protocol.DeviceID, address string) {
+	d.recordConnection(device, address, func(e *CacheEntry) {
+		e.LastFailed = time.Now()
+	})
+}
+
+func (d *Discoverer) recordConnection(device protocol.DeviceID, address string, fn func(*CacheEntry)) {
+	d.registryLock.Lock()
+	entries := d.registry[device]
+	found := false
+	for i := range entries {
+		if entries[i].Address == address {
+			fn(&entries[i])
+			found = true
+		}
+	}
+	var saved []CacheEntry
+	if found {
+		saved = make([]CacheEntry, len(entries))
+		copy(saved, entries)
+	}
+	d.registryLock.Unlock()
+
+	// Addresses that aren't in the cache come from the configuration and
+	// need no bookkeeping.
+	if found {
+		d.saveCache(device, saved)
 	}
-	return nil
 }
 
 func (d *Discoverer) Hint(device string, addrs []string) {
@@ -166,7 +272,7 @@ func (d *Discoverer) Hint(device string, addrs []string) {
 	d.registerDevice(nil, Device{
 		Addresses: resAddrs,
 		ID:        id[:],
-	})
+	}, nil, SourceHint)
 }
 
 func (d *Discoverer) All() map[protocol.DeviceID][]CacheEntry {
@@ -200,8 +306,9 @@ func (d *Discoverer) announcementPkt() []byte {
 		}
 	}
 	var pkt = Announce{
-		Magic: AnnouncementMagic,
-		This:  Device{d.myID[:], addrs},
+		Magic:  AnnouncementMagic,
+		This:   Device{d.myID[:], addrs},
+		Relays: d.relayAddrs(),
 	}
 	return pkt.MustMarshalXDR()
 }
@@ -210,8 +317,9 @@ func (d *Discoverer) sendLocalAnnouncements() {
 	var addrs = resolveAddrs(d.listenAddrs)
 
 	var pkt = Announce{
-		Magic: AnnouncementMagic,
-		This:  Device{d.myID[:], addrs},
+		Magic:  AnnouncementMagic,
+		This:   Device{d.myID[:], addrs},
+		Relays: d.relayAddrs(),
 	}
 	msg := pkt.MustMarshalXDR()
 
@@ -230,14 +338,15 @@ func (d *Discoverer) sendLocalAnnouncements() {
 	}
 }
 
-func (d *Discoverer) sendExternalAnnouncements() {
+func (d *Discoverer) sendExternalAnnouncements(server string) {
 	defer d.globalWG.Done()
 
-	remote, err := net.ResolveUDPAddr("udp", d.extServer)
+	remote, err := net.ResolveUDPAddr("udp", server)
 	for err != nil {
-		l.Warnf("Global discovery: %v; trying again in %v", err, d.errorRetryIntv)
+		l.Warnf("Global discovery: %s: %v; trying again in %v", server, err, d.errorRetryIntv)
+		d.setAnnounceStatus(server, false, err)
 		time.Sleep(d.errorRetryIntv)
-		remote, err = net.ResolveUDPAddr("udp", d.extServer)
+		remote, err = net.ResolveUDPAddr("udp", server)
 	}
 
 	conn, err := net.ListenUDP("udp", nil)
@@ -250,8 +359,9 @@ func (d *Discoverer) sendExternalAnnouncements() {
 	var buf []byte
 	if d.extPort != 0 {
 		var pkt = Announce{
-			Magic: AnnouncementMagic,
-			This:  Device{d.myID[:], []Address{{Port: d.extPort}}},
+			Magic:  AnnouncementMagic,
+			This:   Device{d.myID[:], []Address{{Port: d.extPort}}},
+			Relays: d.relayAddrs(),
 		}
 		buf = pkt.MustMarshalXDR()
 	} else {
@@ -278,20 +388,22 @@ func (d *Discoverer) sendExternalAnnouncements() {
 			// Verify that the announce server responds positively for our device ID
 
 			time.Sleep(1 * time.Second)
-			res := d.externalLookup(d.myID)
+			var res []string
+			res, err = d.externalLookupServer(server, d.myID)
 			if debug {
-				l.Debugln("discover: external lookup check:", res)
+				l.Debugln("discover: external lookup check:", server, res, err)
 			}
 			ok = len(res) > 0
+			if !ok && err == nil {
+				err = errors.New("announcement not accepted")
+			}
 		}
 
-		d.extAnnounceOKmut.Lock()
-		d.extAnnounceOK = ok
-		d.extAnnounceOKmut.Unlock()
+		d.setAnnounceStatus(server, ok, err)
 
 		if ok {
 			errTick = nil
-		} else if errTick != nil {
+		} else if errTick == nil {
 			errTick = time.Tick(d.errorRetryIntv)
 		}
 	}
@@ -314,10 +426,36 @@ loop:
 	}
 
 	if debug {
-		l.Debugln("discover: stopping global")
+		l.Debugln("discover: stopping global", server)
 	}
 }
 
+func (d *Discoverer) setAnnounceStatus(server string, ok bool, err error) {
+	d.extStatusMut.Lock()
+	status := d.extStatus[server]
+	status.AnnounceOK = ok
+	status.LastAnnounce = time.Now()
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Error = ""
+	}
+	d.extStatus[server] = status
+	d.extStatusMut.Unlock()
+}
+
+func (d *Discoverer) setLookupStatus(server string, err error) {
+	d.extStatusMut.Lock()
+	status := d.extStatus[server]
+	status.LookupOK = err == nil
+	status.LastLookup = time.Now()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	d.extStatus[server] = status
+	d.extStatusMut.Unlock()
+}
+
 func (d *Discoverer) recvAnnouncements(b beacon.Interface) {
 	for {
 		buf, addr := b.Recv()
@@ -326,15 +464,14 @@ func (d *Discoverer) recvAnnouncements(b beacon.Interface) {
 			l.Debugf("discover: read announcement from %s:\n%s", addr, hex.Dump(buf))
 		}
 
-		var pkt Announce
-		err := pkt.UnmarshalXDR(buf)
-		if err != nil && err != io.EOF {
+		pkt, err := UnmarshalAnnouncement(buf)
+		if err != nil {
 			continue
 		}
 
 		var newDevice bool
 		if bytes.Compare(pkt.This.ID, d.myID[:]) != 0 {
-			newDevice = d.registerDevice(addr, pkt.This)
+			newDevice = d.registerDevice(addr, pkt.This, pkt.Relays, SourceLocal)
 		}
 
 		if newDevice {
@@ -345,7 +482,7 @@ func (d *Discoverer) recvAnnouncements(b beacon.Interface) {
 	}
 }
 
-func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
+func (d *Discoverer) registerDevice(addr net.Addr, device Device, relays []Relay, source string) bool {
 	var id protocol.DeviceID
 	copy(id[:], device.ID)
 
@@ -355,27 +492,21 @@ func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
 
 	orig := current
 
+	var deviceAddrs []string
 	for _, a := range device.Addresses {
-		var deviceAddr string
 		if len(a.IP) > 0 {
-			deviceAddr = net.JoinHostPort(net.IP(a.IP).String(), strconv.Itoa(int(a.Port)))
+			deviceAddrs = append(deviceAddrs, net.JoinHostPort(net.IP(a.IP).String(), strconv.Itoa(int(a.Port))))
 		} else if addr != nil {
 			ua := addr.(*net.UDPAddr)
 			ua.Port = int(a.Port)
-			deviceAddr = ua.String()
-		}
-		for i := range current {
-			if current[i].Address == deviceAddr {
-				current[i].Seen = time.Now()
-				goto done
-			}
+			deviceAddrs = append(deviceAddrs, ua.String())
 		}
-		current = append(current, CacheEntry{
-			Address: deviceAddr,
-			Seen:    time.Now(),
-		})
-	done:
 	}
+	for _, r := range relays {
+		deviceAddrs = append(deviceAddrs, r.Address)
+	}
+
+	current = mergeEntries(current, deviceAddrs, source)
 
 	if debug {
 		l.Debugf("discover: register: %v -> %v", id, current)
@@ -385,6 +516,8 @@ func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
 	d.registry[id] = current
 	d.registryLock.Unlock()
 
+	d.saveCache(id, current)
+
 	if len(current) > len(orig) {
 		addrs := make([]string, len(current))
 		for i := range current {
@@ -399,39 +532,67 @@ func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
 	return len(current) > len(orig)
 }
 
+// externalLookup queries all global discovery servers in parallel and
+// returns the union of their answers.
 func (d *Discoverer) externalLookup(device protocol.DeviceID) []string {
-	extIP, err := net.ResolveUDPAddr("udp", d.extServer)
-	if err != nil {
-		if debug {
-			l.Debugf("discover: %v; no external lookup", err)
+	type result struct {
+		addrs []string
+		err   error
+	}
+
+	results := make([]chan result, len(d.extServers))
+	for i, server := range d.extServers {
+		results[i] = make(chan result, 1)
+		go func(server string, res chan<- result) {
+			addrs, err := d.externalLookupServer(server, device)
+			res <- result{addrs, err}
+		}(server, results[i])
+	}
+
+	var addrs []string
+	seen := make(map[string]bool)
+	for i, server := range d.extServers {
+		res := <-results[i]
+		d.setLookupStatus(server, res.err)
+		if res.err != nil {
+			if debug {
+				l.Debugf("discover: %s: %v; no external lookup", server, res.err)
+			}
+			continue
+		}
+		for _, addr := range res.addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
 		}
-		return nil
+	}
+	return addrs
+}
+
+// externalLookupServer queries a single global discovery server. An unknown
+// device is not an error; the returned list is then empty.
+func (d *Discoverer) externalLookupServer(server string, device protocol.DeviceID) ([]string, error) {
+	extIP, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
 	}
 
 	conn, err := net.DialUDP("udp", nil, extIP)
 	if err != nil {
-		if debug {
-			l.Debugf("discover: %v; no external lookup", err)
-		}
-		return nil
+		return nil, err
 	}
 	defer conn.Close()
 
 	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
 	if err != nil {
-		if debug {
-			l.Debugf("discover: %v; no external lookup", err)
-		}
-		return nil
+		return nil, err
 	}
 
 	buf := Query{QueryMagic, device[:]}.MustMarshalXDR()
 	_, err = conn.Write(buf)
 	if err != nil {
-		if debug {
-			l.Debugf("discover: %v; no external lookup", err)
-		}
-		return nil
+		return nil, err
 	}
 
 	buf = make([]byte, 2048)
@@ -439,25 +600,18 @@ func (d *Discoverer) externalLookup(device protocol.DeviceID) []string {
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			// Expected if the server doesn't know about requested device ID
-			return nil
-		}
-		if debug {
-			l.Debugf("discover: %v; no external lookup", err)
+			return nil, nil
 		}
-		return nil
+		return nil, err
 	}
 
 	if debug {
-		l.Debugf("discover: read external:\n%s", hex.Dump(buf[:n]))
+		l.Debugf("discover: read external from %s:\n%s", server, hex.Dump(buf[:n]))
 	}
 
-	var pkt Announce
-	err = pkt.UnmarshalXDR(buf[:n])
-	if err != nil && err != io.EOF {
-		if debug {
-			l.Debugln("discover:", err)
-		}
-		return nil
+	pkt, err := UnmarshalAnnouncement(buf[:n])
+	if err != nil {
+		return nil, err
 	}
 
 	var addrs []string
@@ -465,14 +619,62 @@ func (d *Discoverer) externalLookup(device protocol.DeviceID) []string {
 		deviceAddr := net.JoinHostPort(net.IP(a.IP).String(), strconv.Itoa(int(a.Port)))
 		addrs = append(addrs, deviceAddr)
 	}
-	return addrs
+	for _, r := range pkt.Relays {
+		addrs = append(addrs, r.Address)
+	}
+	return addrs, nil
+}
+
+// UnmarshalAnnouncement decodes an announcement packet. Announcements from
+// older implementations lack the trailing relay list; they are decoded as
+// having an empty one.
+func UnmarshalAnnouncement(bs []byte) (Announce, error) {
+	var pkt Announce
+	err := pkt.UnmarshalXDR(bs)
+	if err != nil {
+		err = pkt.UnmarshalXDR(append(bs[:len(bs):len(bs)], 0, 0, 0, 0))
+	}
+	return pkt, err
+}
+
+// relayAddrs returns the relays we announce.
+func (d *Discoverer) relayAddrs() []Relay {
+	var relays []Relay
+	for _, addr := range d.relays {
+		if len(relays) == 16 {
+			break
+		}
+		relays = append(relays, Relay{Address: addr})
+	}
+	return relays
+}
+
+// mergeEntries marks the given addresses as seen now, adding the ones that
+// are not yet among the entries.
+func mergeEntries(entries []CacheEntry, addrs []string, source string) []CacheEntry {
+	for _, addr := range addrs {
+		for i := range entries {
+			if entries[i].Address == addr {
+				entries[i].Seen = time.Now()
+				entries[i].Source = source
+				goto done
+			}
+		}
+		entries = append(entries, CacheEntry{
+			Address: addr,
+			Seen:    time.Now(),
+			Source:  source,
+		})
+	done:
+	}
+	return entries
 }
 
 func (d *Discoverer) filterCached(c []CacheEntry) []CacheEntry {
 	for i := 0; i < len(c); {
-		if ago := time.Since(c[i].Seen); ago > d.cacheLifetime {
+		if d.expired(c[i]) {
 			if debug {
-				l.Debugf("removing cached address %s: seen %v ago", c[i].Address, ago)
+				l.Debugf("removing cached address %s: seen %v ago", c[i].Address, time.Since(c[i].Seen))
 			}
 			c[i] = c[len(c)-1]
 			c = c[:len(c)-1]
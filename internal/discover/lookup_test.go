@@ -0,0 +1,102 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"net"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// fakeServer answers every query with the given addresses.
+func fakeServer(t *testing.T, addrs []Address) (*net.UDPConn, string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var q Query
+			if err := q.UnmarshalXDR(buf[:n]); err != nil || q.Magic != QueryMagic {
+				continue
+			}
+			pkt := Announce{
+				Magic: AnnouncementMagic,
+				This:  Device{q.DeviceID, addrs},
+			}
+			conn.WriteToUDP(pkt.MustMarshalXDR(), addr)
+		}
+	}()
+
+	return conn, conn.LocalAddr().String()
+}
+
+func TestExternalLookupMultipleServers(t *testing.T) {
+	c1, srv1 := fakeServer(t, []Address{
+		{IP: []byte{192, 0, 2, 1}, Port: 22000},
+		{IP: []byte{192, 0, 2, 2}, Port: 22000},
+	})
+	defer c1.Close()
+	c2, srv2 := fakeServer(t, []Address{
+		{IP: []byte{192, 0, 2, 2}, Port: 22000},
+		{IP: []byte{192, 0, 2, 3}, Port: 22000},
+	})
+	defer c2.Close()
+
+	// A server that isn't running
+	c3, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv3 := c3.LocalAddr().String()
+	c3.Close()
+
+	d := NewDiscoverer(protocol.LocalDeviceID, nil, nil, nil)
+	d.extServers = []string{srv1, srv3, srv2}
+
+	addrs := d.Lookup(protocol.LocalDeviceID)
+	expected := []string{"192.0.2.1:22000", "192.0.2.2:22000", "192.0.2.3:22000"}
+	if len(addrs) != len(expected) {
+		t.Fatalf("incorrect addresses %v", addrs)
+	}
+	for i := range expected {
+		if addrs[i] != expected[i] {
+			t.Errorf("incorrect address %d: %s != %s", i, addrs[i], expected[i])
+		}
+	}
+
+	// The answer is cached
+	c1.Close()
+	c2.Close()
+	if addrs := d.Lookup(protocol.LocalDeviceID); len(addrs) != len(expected) {
+		t.Errorf("incorrect cached addresses %v", addrs)
+	}
+
+	status := d.ExtServerStatus()
+	if !status[srv1].LookupOK || !status[srv2].LookupOK {
+		t.Errorf("working servers should be OK: %+v", status)
+	}
+	if status[srv3].LookupOK || status[srv3].Error == "" {
+		t.Errorf("server that isn't running should have failed: %+v", status[srv3])
+	}
+}
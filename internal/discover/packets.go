@@ -26,9 +26,10 @@ type Query struct {
 }
 
 type Announce struct {
-	Magic uint32
-	This  Device
-	Extra []Device // max:16
+	Magic  uint32
+	This   Device
+	Extra  []Device // max:16
+	Relays []Relay  // max:16
 }
 
 type Device struct {
@@ -40,3 +41,10 @@ type Address struct {
 	IP   []byte // max:16
 	Port uint16
 }
+
+// Relay is a relay server through which the announcing device can be
+// reached, given as a relay://host:port/?id=... URI. Relays are sent last in
+// the announcement so that older implementations can ignore them.
+type Relay struct {
+	Address string // max:256
+}
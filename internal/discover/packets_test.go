@@ -0,0 +1,57 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import "testing"
+
+func TestAnnounceRelays(t *testing.T) {
+	pkt := Announce{
+		Magic:  AnnouncementMagic,
+		This:   Device{ID: make([]byte, 32), Addresses: []Address{{Port: 22000}}},
+		Relays: []Relay{{Address: "relay://192.0.2.42:22067/?id=foo"}},
+	}
+	bs := pkt.MustMarshalXDR()
+
+	var dec Announce
+	if err := dec.UnmarshalXDR(bs); err != nil {
+		t.Fatal(err)
+	}
+	if len(dec.Relays) != 1 || dec.Relays[0].Address != pkt.Relays[0].Address {
+		t.Errorf("incorrect relays %v", dec.Relays)
+	}
+}
+
+func TestAnnounceWithoutRelays(t *testing.T) {
+	// An announcement from an older implementation doesn't have the
+	// trailing relay list at all.
+	pkt := Announce{
+		Magic: AnnouncementMagic,
+		This:  Device{ID: make([]byte, 32), Addresses: []Address{{Port: 22000}}},
+	}
+	bs := pkt.MustMarshalXDR()
+	bs = bs[:len(bs)-4]
+
+	dec, err := UnmarshalAnnouncement(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dec.This.Addresses) != 1 || dec.This.Addresses[0].Port != 22000 {
+		t.Errorf("incorrect addresses %v", dec.This.Addresses)
+	}
+	if len(dec.Relays) != 0 {
+		t.Errorf("unexpected relays %v", dec.Relays)
+	}
+}
@@ -38,6 +38,9 @@ const (
 	StateChanged
 	FolderRejected
 	ConfigSaved
+	ConflictCreated
+	FolderErrors
+	DownloadProgress
 
 	AllEvents = (1 << iota) - 1
 )
@@ -70,6 +73,12 @@ func (t EventType) String() string {
 		return "FolderRejected"
 	case ConfigSaved:
 		return "ConfigSaved"
+	case ConflictCreated:
+		return "ConflictCreated"
+	case FolderErrors:
+		return "FolderErrors"
+	case DownloadProgress:
+		return "DownloadProgress"
 	default:
 		return "Unknown"
 	}
@@ -54,7 +54,7 @@ func (m *BlockMap) Add(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
 	buf := make([]byte, 4)
 	for _, file := range files {
-		if file.IsDirectory() || file.IsDeleted() || file.IsInvalid() {
+		if file.IsDirectory() || file.IsSymlink() || file.IsDeleted() || file.IsInvalid() {
 			continue
 		}
 
@@ -71,7 +71,9 @@ func (m *BlockMap) Update(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
 	buf := make([]byte, 4)
 	for _, file := range files {
-		if file.IsDirectory() {
+		// The blocks of a symlink describe the link target, not data that
+		// can be read from the file system.
+		if file.IsDirectory() || file.IsSymlink() {
 			continue
 		}
 
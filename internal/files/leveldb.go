@@ -17,12 +17,12 @@ package files
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"runtime"
 	"sort"
 	"sync"
 
-	"github.com/syncthing/syncthing/internal/lamport"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
@@ -50,10 +50,11 @@ const (
 	keyTypeDevice = iota
 	keyTypeGlobal
 	keyTypeBlock
+	keyTypeIndexID
 )
 
 type fileVersion struct {
-	version uint64
+	version versionVector
 	device  []byte
 }
 
@@ -70,7 +71,7 @@ func (l versionList) String() string {
 			b.WriteString(", ")
 		}
 		copy(id[:], v.device)
-		fmt.Fprintf(&b, "{%d, %v}", v.version, id)
+		fmt.Fprintf(&b, "{%v, %v}", v.version, id)
 	}
 	b.WriteString("}")
 	return b.String()
@@ -161,6 +162,30 @@ func globalKeyFolder(key []byte) []byte {
 	return folder[:izero]
 }
 
+// indexIDKey returns a byte slice encoding the following information:
+//	   keyTypeIndexID (1 byte)
+//	   folder (64 bytes)
+//	   device (32 bytes)
+func indexIDKey(folder, device []byte) []byte {
+	k := make([]byte, 1+64+32)
+	k[0] = keyTypeIndexID
+	if len(folder) > 64 {
+		panic("folder name too long")
+	}
+	copy(k[1:], []byte(folder))
+	copy(k[1+64:], device[:])
+	return k
+}
+
+func indexIDKeyFolder(key []byte) []byte {
+	folder := key[1 : 1+64]
+	izero := bytes.IndexByte(folder, 0)
+	if izero < 0 {
+		return folder
+	}
+	return folder[:izero]
+}
+
 type deletionHandler func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) uint64
 
 type fileIterator func(f protocol.FileIntf) bool
@@ -227,8 +252,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			// marked a file as invalid, so handle that too.
 			var ef protocol.FileInfoTruncated
 			ef.UnmarshalXDR(dbi.Value())
-			if fs[fsi].Version > ef.Version ||
-				(fs[fsi].Version == ef.Version && fs[fsi].Flags != ef.Flags) {
+			if !fs[fsi].Version.Equal(ef.Version) || fs[fsi].Flags != ef.Flags {
 				if lv := ldbInsert(batch, folder, device, fs[fsi]); lv > maxLocalVer {
 					maxLocalVer = lv
 				}
@@ -270,7 +294,7 @@ func ldbReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) u
 	})
 }
 
-func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) uint64 {
+func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo, myID uint64) uint64 {
 	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) uint64 {
 		var tf protocol.FileInfoTruncated
 		err := tf.UnmarshalXDR(dbi.Value())
@@ -284,7 +308,7 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 			ts := clock(tf.LocalVersion)
 			f := protocol.FileInfo{
 				Name:         tf.Name,
-				Version:      lamport.Default.Tick(tf.Version),
+				Version:      tf.Version.Update(myID),
 				LocalVersion: ts,
 				Flags:        tf.Flags | protocol.FlagDeleted,
 				Modified:     tf.Modified,
@@ -332,7 +356,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) ui
 		}
 		// Flags might change without the version being bumped when we set the
 		// invalid flag on an existing file.
-		if ef.Version != f.Version || ef.Flags != f.Flags {
+		if !ef.Version.Equal(f.Version) || ef.Flags != f.Flags {
 			if lv := ldbInsert(batch, folder, device, f); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
@@ -371,9 +395,9 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) ui
 // ldbUpdateGlobal adds this device+version to the version list for the given
 // file. If the device is already present in the list, the version is updated.
 // If the file does not have an entry in the global list, it is created.
-func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, version uint64) bool {
+func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, version protocol.Vector) bool {
 	if debug {
-		l.Debugf("update global; folder=%q device=%v file=%q version=%d", folder, protocol.DeviceIDFromBytes(device), file, version)
+		l.Debugf("update global; folder=%q device=%v file=%q version=%v", folder, protocol.DeviceIDFromBytes(device), file, version)
 	}
 	gk := globalKey(folder, file)
 	svl, err := db.Get(gk, nil)
@@ -384,7 +408,7 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, v
 	var fl versionList
 	nv := fileVersion{
 		device:  device,
-		version: version,
+		version: versionVector{version},
 	}
 	if svl != nil {
 		err = fl.UnmarshalXDR(svl)
@@ -394,7 +418,7 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, v
 
 		for i := range fl.versions {
 			if bytes.Compare(fl.versions[i].device, device) == 0 {
-				if fl.versions[i].version == version {
+				if fl.versions[i].version.Equal(version) {
 					// No need to do anything
 					return false
 				}
@@ -405,7 +429,11 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, v
 	}
 
 	for i := range fl.versions {
-		if fl.versions[i].version <= version {
+		// The list is kept sorted with the newest version first. Concurrent
+		// versions are sorted using the consistent tie break provided by
+		// Compare, so that all devices agree on which version is the global
+		// one.
+		if comp := fl.versions[i].version.Compare(version); comp == protocol.Equal || comp == protocol.Lesser || comp == protocol.ConcurrentLesser {
 			t := append(fl.versions, fileVersion{})
 			copy(t[i+1:], t[i:])
 			t[i] = nv
@@ -480,6 +508,67 @@ func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn fileIt
 	}
 }
 
+// ldbWithHaveSequence calls fn for the files of the device with a local
+// version above minLocalVer, in local version order.
+func ldbWithHaveSequence(db *leveldb.DB, folder, device []byte, minLocalVer uint64, fn fileIterator) {
+	start := deviceKey(folder, device, nil)                            // before all folder/device files
+	limit := deviceKey(folder, device, []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		panic(err)
+	}
+	defer snap.Release()
+
+	// Collect the keys of the files to visit first, as the database is
+	// ordered by name.
+	var keys localVersionList
+	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	for dbi.Next() {
+		var tf protocol.FileInfoTruncated
+		if err := tf.UnmarshalXDR(dbi.Value()); err != nil {
+			panic(err)
+		}
+		if tf.LocalVersion > minLocalVer {
+			keys = append(keys, localVersionKey{tf.LocalVersion, append([]byte(nil), dbi.Key()...)})
+		}
+	}
+	dbi.Release()
+	sort.Sort(keys)
+
+	for _, k := range keys {
+		bs, err := snap.Get(k.key, nil)
+		if err != nil {
+			panic(err)
+		}
+		var f protocol.FileInfo
+		if err := f.UnmarshalXDR(bs); err != nil {
+			panic(err)
+		}
+		if cont := fn(f); !cont {
+			return
+		}
+	}
+}
+
+type localVersionKey struct {
+	localVersion uint64
+	key          []byte
+}
+
+type localVersionList []localVersionKey
+
+func (l localVersionList) Len() int {
+	return len(l)
+}
+
+func (l localVersionList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l localVersionList) Less(a, b int) bool {
+	return l[a].localVersion < l[b].localVersion
+}
+
 func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []byte, f protocol.FileInfoTruncated) bool) {
 	runtime.GC()
 
@@ -628,7 +717,7 @@ func ldbAvailability(db *leveldb.DB, folder, file []byte) []protocol.DeviceID {
 
 	var devices []protocol.DeviceID
 	for _, v := range vl.versions {
-		if v.version != vl.versions[0].version {
+		if !v.version.Equal(vl.versions[0].version.Vector) {
 			break
 		}
 		n := protocol.DeviceIDFromBytes(v.device)
@@ -664,13 +753,13 @@ outer:
 		}
 
 		have := false // If we have the file, any version
-		need := false // If we have a lower version of the file
-		var haveVersion uint64
+		need := false // If we have a lower or concurrent version of the file
+		var haveVersion protocol.Vector
 		for _, v := range vl.versions {
 			if bytes.Compare(v.device, device) == 0 {
 				have = true
-				haveVersion = v.version
-				need = v.version < vl.versions[0].version
+				haveVersion = v.version.Vector
+				need = !v.version.GreaterEqual(vl.versions[0].version.Vector)
 				break
 			}
 		}
@@ -678,9 +767,24 @@ outer:
 		if need || !have {
 			name := globalKeyName(dbi.Key())
 			needVersion := vl.versions[0].version
+
+			if !have {
+				// Files changed locally in a receive only folder are not
+				// part of the global version list. We don't need the global
+				// version unless it is newer than the local change.
+				if bs, err := snap.Get(deviceKey(folder, device, name), nil); err == nil {
+					var lf protocol.FileInfoTruncated
+					if err := lf.UnmarshalXDR(bs); err != nil {
+						panic(err)
+					}
+					if lf.IsLocalChanged() && lf.Version.GreaterEqual(needVersion.Vector) {
+						continue outer
+					}
+				}
+			}
 		inner:
 			for i := range vl.versions {
-				if vl.versions[i].version != needVersion {
+				if !vl.versions[i].version.Equal(needVersion.Vector) {
 					// We haven't found a valid copy of the file with the needed version.
 					continue outer
 				}
@@ -715,7 +819,7 @@ outer:
 				}
 
 				if debug {
-					l.Debugf("need folder=%q device=%v name=%q need=%v have=%v haveV=%d globalV=%d", folder, protocol.DeviceIDFromBytes(device), name, need, have, haveVersion, vl.versions[0].version)
+					l.Debugf("need folder=%q device=%v name=%q need=%v have=%v haveV=%v globalV=%v", folder, protocol.DeviceIDFromBytes(device), name, need, have, haveVersion, vl.versions[0].version)
 				}
 
 				if cont := fn(gf); !cont {
@@ -729,6 +833,31 @@ outer:
 	}
 }
 
+func ldbGetIndexID(db *leveldb.DB, folder, device []byte) uint64 {
+	bs, err := db.Get(indexIDKey(folder, device), nil)
+	if err == leveldb.ErrNotFound {
+		return 0
+	}
+	if err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(bs)
+}
+
+func ldbSetIndexID(db *leveldb.DB, folder, device []byte, id uint64) {
+	var bs [8]byte
+	binary.BigEndian.PutUint64(bs[:], id)
+	if err := db.Put(indexIDKey(folder, device), bs[:], nil); err != nil {
+		panic(err)
+	}
+}
+
+func ldbDropIndexID(db *leveldb.DB, folder, device []byte) {
+	if err := db.Delete(indexIDKey(folder, device), nil); err != nil {
+		panic(err)
+	}
+}
+
 func ldbListFolders(db *leveldb.DB) []string {
 	runtime.GC()
 
@@ -791,6 +920,18 @@ func ldbDropFolder(db *leveldb.DB, folder []byte) {
 		}
 	}
 	dbi.Release()
+
+	// Remove the index IDs for the given folder
+	start = []byte{keyTypeIndexID}
+	limit = []byte{keyTypeIndexID + 1}
+	dbi = snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	for dbi.Next() {
+		itemFolder := indexIDKeyFolder(dbi.Key())
+		if bytes.Compare(folder, itemFolder) == 0 {
+			db.Delete(dbi.Key(), nil)
+		}
+	}
+	dbi.Release()
 }
 
 func unmarshalTrunc(bs []byte, truncate bool) (protocol.FileIntf, error) {
@@ -18,9 +18,7 @@ fileVersion Structure:
  0                   1                   2                   3
  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-|                                                               |
-+                       version (64 bits)                       +
-|                                                               |
+|                         versionVector                         |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 |                       Length of device                        |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
@@ -31,7 +29,7 @@ fileVersion Structure:
 
 
 struct fileVersion {
-	unsigned hyper version;
+	versionVector version;
 	opaque device<>;
 }
 
@@ -62,7 +60,10 @@ func (o fileVersion) AppendXDR(bs []byte) ([]byte, error) {
 }
 
 func (o fileVersion) encodeXDR(xw *xdr.Writer) (int, error) {
-	xw.WriteUint64(o.version)
+	_, err := o.version.encodeXDR(xw)
+	if err != nil {
+		return xw.Tot(), err
+	}
 	xw.WriteBytes(o.device)
 	return xw.Tot(), xw.Error()
 }
@@ -79,7 +80,7 @@ func (o *fileVersion) UnmarshalXDR(bs []byte) error {
 }
 
 func (o *fileVersion) decodeXDR(xr *xdr.Reader) error {
-	o.version = xr.ReadUint64()
+	(&o.version).decodeXDR(xr)
 	o.device = xr.ReadBytes()
 	return xr.Error()
 }
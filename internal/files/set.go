@@ -22,9 +22,10 @@
 package files
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"sync"
 
-	"github.com/syncthing/syncthing/internal/lamport"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
 )
@@ -37,12 +38,27 @@ type fileRecord struct {
 
 type bitset uint64
 
+// A ChangeMask selects which index changes a subscriber is notified about.
+type ChangeMask int
+
+const (
+	LocalChanges  ChangeMask = 1 << iota // changes to the local device index
+	RemoteChanges                        // changes to any other device index
+)
+
+type subscription struct {
+	mask ChangeMask
+	c    chan struct{}
+}
+
 type Set struct {
 	localVersion map[protocol.DeviceID]uint64
 	mutex        sync.Mutex
 	folder       string
 	db           *leveldb.DB
 	blockmap     *BlockMap
+	subs         []subscription
+	subsMut      sync.Mutex
 }
 
 func NewSet(folder string, db *leveldb.DB) *Set {
@@ -59,7 +75,6 @@ func NewSet(folder string, db *leveldb.DB) *Set {
 		if f.LocalVersion > s.localVersion[deviceID] {
 			s.localVersion[deviceID] = f.LocalVersion
 		}
-		lamport.Default.Tick(f.Version)
 		return true
 	})
 	if debug {
@@ -67,6 +82,10 @@ func NewSet(folder string, db *leveldb.DB) *Set {
 	}
 	clock(s.localVersion[protocol.LocalDeviceID])
 
+	if ldbGetIndexID(db, []byte(folder), protocol.LocalDeviceID[:]) == 0 {
+		s.newLocalIndexID()
+	}
+
 	return &s
 }
 
@@ -78,9 +97,16 @@ func (s *Set) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.localVersion[device] = ldbReplace(s.db, []byte(s.folder), device[:], fs)
+	s.notify(device)
 	if len(fs) == 0 {
-		// Reset the local version if all files were removed.
+		// Reset the local version if all files were removed. The index we
+		// had is gone, so the index ID no longer describes it.
 		s.localVersion[device] = 0
+		if device == protocol.LocalDeviceID {
+			s.newLocalIndexID()
+		} else {
+			ldbDropIndexID(s.db, []byte(s.folder), device[:])
+		}
 	}
 	if device == protocol.LocalDeviceID {
 		s.blockmap.Drop()
@@ -88,15 +114,19 @@ func (s *Set) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 	}
 }
 
-func (s *Set) ReplaceWithDelete(device protocol.DeviceID, fs []protocol.FileInfo) {
+// ReplaceWithDelete replaces the file list for the given device, marking
+// files not present in the new list as deleted. The version of each such
+// deleted file is updated using the given short device ID.
+func (s *Set) ReplaceWithDelete(device protocol.DeviceID, fs []protocol.FileInfo, myID uint64) {
 	if debug {
 		l.Debugf("%s ReplaceWithDelete(%v, [%d])", s.folder, device, len(fs))
 	}
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if lv := ldbReplaceWithDelete(s.db, []byte(s.folder), device[:], fs); lv > s.localVersion[device] {
+	if lv := ldbReplaceWithDelete(s.db, []byte(s.folder), device[:], fs, myID); lv > s.localVersion[device] {
 		s.localVersion[device] = lv
+		s.notify(device)
 	}
 	if device == protocol.LocalDeviceID {
 		s.blockmap.Drop()
@@ -113,6 +143,7 @@ func (s *Set) Update(device protocol.DeviceID, fs []protocol.FileInfo) {
 	defer s.mutex.Unlock()
 	if lv := ldbUpdate(s.db, []byte(s.folder), device[:], fs); lv > s.localVersion[device] {
 		s.localVersion[device] = lv
+		s.notify(device)
 	}
 	if device == protocol.LocalDeviceID {
 		s.blockmap.Update(fs)
@@ -147,6 +178,16 @@ func (s *Set) WithHaveTruncated(device protocol.DeviceID, fn fileIterator) {
 	ldbWithHave(s.db, []byte(s.folder), device[:], true, nativeFileIterator(fn))
 }
 
+// WithHaveSequence calls fn for the files of the device with a local version
+// above minLocalVer, in local version order. A receiver that got only part of
+// them has then seen everything up to the highest local version it got.
+func (s *Set) WithHaveSequence(device protocol.DeviceID, minLocalVer uint64, fn fileIterator) {
+	if debug {
+		l.Debugf("%s WithHaveSequence(%v, %d)", s.folder, device, minLocalVer)
+	}
+	ldbWithHaveSequence(s.db, []byte(s.folder), device[:], minLocalVer, nativeFileIterator(fn))
+}
+
 func (s *Set) WithGlobal(fn fileIterator) {
 	if debug {
 		l.Debugf("%s WithGlobal()", s.folder)
@@ -183,6 +224,77 @@ func (s *Set) LocalVersion(device protocol.DeviceID) uint64 {
 	return s.localVersion[device]
 }
 
+// Subscribe returns a channel that receives a value whenever the index of a
+// device selected by the mask changes. Changes that happen while a previous
+// notification is still waiting to be received are coalesced into that
+// notification, so a slow subscriber sees at most one pending notification.
+func (s *Set) Subscribe(mask ChangeMask) <-chan struct{} {
+	c := make(chan struct{}, 1)
+	s.subsMut.Lock()
+	s.subs = append(s.subs, subscription{mask, c})
+	s.subsMut.Unlock()
+	return c
+}
+
+// Unsubscribe stops notifications on a channel returned by Subscribe.
+func (s *Set) Unsubscribe(c <-chan struct{}) {
+	s.subsMut.Lock()
+	defer s.subsMut.Unlock()
+	for i, sub := range s.subs {
+		if sub.c == c {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Set) notify(device protocol.DeviceID) {
+	mask := RemoteChanges
+	if device == protocol.LocalDeviceID {
+		mask = LocalChanges
+	}
+
+	s.subsMut.Lock()
+	defer s.subsMut.Unlock()
+	for _, sub := range s.subs {
+		if sub.mask&mask == 0 {
+			continue
+		}
+		select {
+		case sub.c <- struct{}{}:
+		default:
+			// There is already a notification pending
+		}
+	}
+}
+
+// IndexID returns the ID of the index we hold for the given device, or zero
+// if no ID is known. The local device always has a nonzero index ID, which
+// changes whenever the local index is reset.
+func (s *Set) IndexID(device protocol.DeviceID) uint64 {
+	return ldbGetIndexID(s.db, []byte(s.folder), device[:])
+}
+
+// SetIndexID records the ID of the index we hold for the given device.
+func (s *Set) SetIndexID(device protocol.DeviceID, id uint64) {
+	if device == protocol.LocalDeviceID {
+		panic("bug: cannot set index ID for the local device")
+	}
+	ldbSetIndexID(s.db, []byte(s.folder), device[:], id)
+}
+
+func (s *Set) newLocalIndexID() {
+	var bs [8]byte
+	var id uint64
+	for id == 0 {
+		if _, err := rand.Read(bs[:]); err != nil {
+			panic(err)
+		}
+		id = binary.BigEndian.Uint64(bs[:])
+	}
+	ldbSetIndexID(s.db, []byte(s.folder), protocol.LocalDeviceID[:], id)
+}
+
 // ListFolders returns the folder IDs seen in the database.
 func ListFolders(db *leveldb.DB) []string {
 	return ldbListFolders(db)
@@ -23,7 +23,6 @@ import (
 	"testing"
 
 	"github.com/syncthing/syncthing/internal/files"
-	"github.com/syncthing/syncthing/internal/lamport"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -31,6 +30,8 @@ import (
 
 var remoteDevice0, remoteDevice1 protocol.DeviceID
 
+const myID = 1
+
 func init() {
 	remoteDevice0, _ = protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
 	remoteDevice1, _ = protocol.DeviceIDFromString("I6KAH76-66SLLLB-5PFXSOA-UFJCDZC-YAOMLEK-CP2GB32-BV5RQST-3PSROAU")
@@ -97,14 +98,13 @@ func (l fileList) String() string {
 	var b bytes.Buffer
 	b.WriteString("[]protocol.FileList{\n")
 	for _, f := range l {
-		fmt.Fprintf(&b, "  %q: #%d, %d bytes, %d blocks, flags=%o\n", f.Name, f.Version, f.Size(), len(f.Blocks), f.Flags)
+		fmt.Fprintf(&b, "  %q: #%v, %d bytes, %d blocks, flags=%o\n", f.Name, f.Version, f.Size(), len(f.Blocks), f.Flags)
 	}
 	b.WriteString("}")
 	return b.String()
 }
 
 func TestGlobalSet(t *testing.T) {
-	lamport.Default = lamport.Clock{}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -114,34 +114,34 @@ func TestGlobalSet(t *testing.T) {
 	m := files.NewSet("test", db)
 
 	local0 := fileList{
-		protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)},
-		protocol.FileInfo{Name: "b", Version: 1000, Blocks: genBlocks(2)},
-		protocol.FileInfo{Name: "c", Version: 1000, Blocks: genBlocks(3)},
-		protocol.FileInfo{Name: "d", Version: 1000, Blocks: genBlocks(4)},
-		protocol.FileInfo{Name: "z", Version: 1000, Blocks: genBlocks(8)},
+		protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(3)},
+		protocol.FileInfo{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "z", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(8)},
 	}
 	local1 := fileList{
-		protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)},
-		protocol.FileInfo{Name: "b", Version: 1000, Blocks: genBlocks(2)},
-		protocol.FileInfo{Name: "c", Version: 1000, Blocks: genBlocks(3)},
-		protocol.FileInfo{Name: "d", Version: 1000, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(3)},
+		protocol.FileInfo{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(4)},
 	}
 	localTot := fileList{
 		local0[0],
 		local0[1],
 		local0[2],
 		local0[3],
-		protocol.FileInfo{Name: "z", Version: 1001, Flags: protocol.FlagDeleted},
+		protocol.FileInfo{Name: "z", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagDeleted},
 	}
 
 	remote0 := fileList{
-		protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)},
-		protocol.FileInfo{Name: "b", Version: 1000, Blocks: genBlocks(2)},
-		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(5)},
+		protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(5)},
 	}
 	remote1 := fileList{
-		protocol.FileInfo{Name: "b", Version: 1001, Blocks: genBlocks(6)},
-		protocol.FileInfo{Name: "e", Version: 1000, Blocks: genBlocks(7)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}, Blocks: genBlocks(6)},
+		protocol.FileInfo{Name: "e", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(7)},
 	}
 	remoteTot := fileList{
 		remote0[0],
@@ -169,8 +169,8 @@ func TestGlobalSet(t *testing.T) {
 		local0[3],
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local0)
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local1)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local0, myID)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local1, myID)
 	m.Replace(remoteDevice0, remote0)
 	m.Update(remoteDevice0, remote1)
 
@@ -250,7 +250,6 @@ func TestGlobalSet(t *testing.T) {
 }
 
 func TestNeedWithInvalid(t *testing.T) {
-	lamport.Default = lamport.Clock{}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -260,26 +259,26 @@ func TestNeedWithInvalid(t *testing.T) {
 	s := files.NewSet("test", db)
 
 	localHave := fileList{
-		protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(1)},
 	}
 	remote0Have := fileList{
-		protocol.FileInfo{Name: "b", Version: 1001, Blocks: genBlocks(2)},
-		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
-		protocol.FileInfo{Name: "d", Version: 1003, Blocks: genBlocks(7)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1003}}, Blocks: genBlocks(7)},
 	}
 	remote1Have := fileList{
-		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(7)},
-		protocol.FileInfo{Name: "d", Version: 1003, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
-		protocol.FileInfo{Name: "e", Version: 1004, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(7)},
+		protocol.FileInfo{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1003}}, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "e", Version: protocol.Vector{{ID: myID, Value: 1004}}, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
 	}
 
 	expectedNeed := fileList{
-		protocol.FileInfo{Name: "b", Version: 1001, Blocks: genBlocks(2)},
-		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(7)},
-		protocol.FileInfo{Name: "d", Version: 1003, Blocks: genBlocks(7)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(7)},
+		protocol.FileInfo{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1003}}, Blocks: genBlocks(7)},
 	}
 
-	s.ReplaceWithDelete(protocol.LocalDeviceID, localHave)
+	s.ReplaceWithDelete(protocol.LocalDeviceID, localHave, myID)
 	s.Replace(remoteDevice0, remote0Have)
 	s.Replace(remoteDevice1, remote1Have)
 
@@ -291,8 +290,52 @@ func TestNeedWithInvalid(t *testing.T) {
 	}
 }
 
+func TestNeedWithLocalChanged(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := files.NewSet("test", db)
+
+	const remoteID = 2
+	base := protocol.Vector{{ID: remoteID, Value: 1}}
+	var localChanged uint32 = protocol.FlagInvalid | protocol.FlagLocalChanged
+
+	remote0Have := fileList{
+		protocol.FileInfo{Name: "a", Version: base, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "b", Version: base, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "c", Version: base.Update(remoteID), Blocks: genBlocks(3)},
+	}
+	localHave := fileList{
+		// Changed locally after syncing the global version
+		protocol.FileInfo{Name: "a", Version: base.Update(myID), Blocks: genBlocks(4), Flags: localChanged},
+		// Deleted locally after syncing the global version
+		protocol.FileInfo{Name: "b", Version: base.Update(myID), Flags: localChanged | protocol.FlagDeleted},
+		// Changed locally, but also changed remotely since
+		protocol.FileInfo{Name: "c", Version: base.Update(myID), Blocks: genBlocks(4), Flags: localChanged},
+		// Added locally
+		protocol.FileInfo{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1}}, Blocks: genBlocks(4), Flags: localChanged},
+	}
+
+	expectedNeed := fileList{
+		remote0Have[2],
+	}
+
+	s.Replace(protocol.LocalDeviceID, localHave)
+	s.Replace(remoteDevice0, remote0Have)
+
+	need := fileList(needList(s, protocol.LocalDeviceID))
+	if fmt.Sprint(need) != fmt.Sprint(expectedNeed) {
+		t.Errorf("Need incorrect;\n A: %v !=\n E: %v", need, expectedNeed)
+	}
+
+	if g := s.GetGlobal("d"); g.Name != "" {
+		t.Errorf("Locally added file should not be global: %v", g)
+	}
+}
+
 func TestUpdateToInvalid(t *testing.T) {
-	lamport.Default = lamport.Clock{}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -302,13 +345,13 @@ func TestUpdateToInvalid(t *testing.T) {
 	s := files.NewSet("test", db)
 
 	localHave := fileList{
-		protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)},
-		protocol.FileInfo{Name: "b", Version: 1001, Blocks: genBlocks(2)},
-		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
-		protocol.FileInfo{Name: "d", Version: 1003, Blocks: genBlocks(7)},
+		protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1003}}, Blocks: genBlocks(7)},
 	}
 
-	s.ReplaceWithDelete(protocol.LocalDeviceID, localHave)
+	s.ReplaceWithDelete(protocol.LocalDeviceID, localHave, myID)
 
 	have := fileList(haveList(s, protocol.LocalDeviceID))
 	sort.Sort(have)
@@ -317,7 +360,7 @@ func TestUpdateToInvalid(t *testing.T) {
 		t.Errorf("Have incorrect before invalidation;\n A: %v !=\n E: %v", have, localHave)
 	}
 
-	localHave[1] = protocol.FileInfo{Name: "b", Version: 1001, Flags: protocol.FlagInvalid}
+	localHave[1] = protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagInvalid}
 	s.Update(protocol.LocalDeviceID, localHave[1:2])
 
 	have = fileList(haveList(s, protocol.LocalDeviceID))
@@ -329,7 +372,6 @@ func TestUpdateToInvalid(t *testing.T) {
 }
 
 func TestInvalidAvailability(t *testing.T) {
-	lamport.Default = lamport.Clock{}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -339,16 +381,16 @@ func TestInvalidAvailability(t *testing.T) {
 	s := files.NewSet("test", db)
 
 	remote0Have := fileList{
-		protocol.FileInfo{Name: "both", Version: 1001, Blocks: genBlocks(2)},
-		protocol.FileInfo{Name: "r1only", Version: 1002, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
-		protocol.FileInfo{Name: "r0only", Version: 1003, Blocks: genBlocks(7)},
-		protocol.FileInfo{Name: "none", Version: 1004, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "both", Version: protocol.Vector{{ID: myID, Value: 1001}}, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "r1only", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "r0only", Version: protocol.Vector{{ID: myID, Value: 1003}}, Blocks: genBlocks(7)},
+		protocol.FileInfo{Name: "none", Version: protocol.Vector{{ID: myID, Value: 1004}}, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
 	}
 	remote1Have := fileList{
-		protocol.FileInfo{Name: "both", Version: 1001, Blocks: genBlocks(2)},
-		protocol.FileInfo{Name: "r1only", Version: 1002, Blocks: genBlocks(7)},
-		protocol.FileInfo{Name: "r0only", Version: 1003, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
-		protocol.FileInfo{Name: "none", Version: 1004, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "both", Version: protocol.Vector{{ID: myID, Value: 1001}}, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "r1only", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(7)},
+		protocol.FileInfo{Name: "r0only", Version: protocol.Vector{{ID: myID, Value: 1003}}, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "none", Version: protocol.Vector{{ID: myID, Value: 1004}}, Blocks: genBlocks(5), Flags: protocol.FlagInvalid},
 	}
 
 	s.Replace(remoteDevice0, remote0Have)
@@ -377,17 +419,16 @@ func TestLocalDeleted(t *testing.T) {
 		t.Fatal(err)
 	}
 	m := files.NewSet("test", db)
-	lamport.Default = lamport.Clock{}
 
 	local1 := []protocol.FileInfo{
-		{Name: "a", Version: 1000},
-		{Name: "b", Version: 1000},
-		{Name: "c", Version: 1000},
-		{Name: "d", Version: 1000},
-		{Name: "z", Version: 1000, Flags: protocol.FlagDirectory},
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "z", Version: protocol.Vector{{ID: myID, Value: 1000}}, Flags: protocol.FlagDirectory},
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local1)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local1, myID)
 
 	m.ReplaceWithDelete(protocol.LocalDeviceID, []protocol.FileInfo{
 		local1[0],
@@ -395,25 +436,25 @@ func TestLocalDeleted(t *testing.T) {
 		local1[2],
 		local1[3],
 		local1[4],
-	})
+	}, myID)
 	m.ReplaceWithDelete(protocol.LocalDeviceID, []protocol.FileInfo{
 		local1[0],
 		local1[2],
 		// [3] removed
 		local1[4],
-	})
+	}, myID)
 	m.ReplaceWithDelete(protocol.LocalDeviceID, []protocol.FileInfo{
 		local1[0],
 		local1[2],
 		// [4] removed
-	})
+	}, myID)
 
 	expectedGlobal1 := []protocol.FileInfo{
 		local1[0],
-		{Name: "b", Version: 1001, Flags: protocol.FlagDeleted},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagDeleted},
 		local1[2],
-		{Name: "d", Version: 1002, Flags: protocol.FlagDeleted},
-		{Name: "z", Version: 1003, Flags: protocol.FlagDeleted | protocol.FlagDirectory},
+		{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagDeleted},
+		{Name: "z", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagDeleted | protocol.FlagDirectory},
 	}
 
 	g := globalList(m)
@@ -427,14 +468,14 @@ func TestLocalDeleted(t *testing.T) {
 	m.ReplaceWithDelete(protocol.LocalDeviceID, []protocol.FileInfo{
 		local1[0],
 		// [2] removed
-	})
+	}, myID)
 
 	expectedGlobal2 := []protocol.FileInfo{
 		local1[0],
-		{Name: "b", Version: 1001, Flags: protocol.FlagDeleted},
-		{Name: "c", Version: 1004, Flags: protocol.FlagDeleted},
-		{Name: "d", Version: 1002, Flags: protocol.FlagDeleted},
-		{Name: "z", Version: 1003, Flags: protocol.FlagDeleted | protocol.FlagDirectory},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagDeleted},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagDeleted},
+		{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagDeleted},
+		{Name: "z", Version: protocol.Vector{{ID: myID, Value: 1001}}, Flags: protocol.FlagDeleted | protocol.FlagDirectory},
 	}
 
 	g = globalList(m)
@@ -446,6 +487,77 @@ func TestLocalDeleted(t *testing.T) {
 	}
 }
 
+func TestConcurrentVersions(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := files.NewSet("test", db)
+
+	// All devices start out with the same version of the file. Then the
+	// local device and remote device 0 both modify it independently, while
+	// remote device 1 modifies another file that is based on what we have.
+
+	base := protocol.Vector{{ID: myID, Value: 1}}
+	remote0ID := remoteDevice0.Short()
+
+	local := []protocol.FileInfo{
+		{Name: "a", Version: base.Update(myID), Blocks: genBlocks(1)},
+		{Name: "b", Version: base, Blocks: genBlocks(1)},
+	}
+	remote0 := []protocol.FileInfo{
+		{Name: "a", Version: base.Update(remote0ID), Blocks: genBlocks(2)},
+		{Name: "b", Version: base, Blocks: genBlocks(1)},
+	}
+	remote1 := []protocol.FileInfo{
+		{Name: "a", Version: base, Blocks: genBlocks(1)},
+		{Name: "b", Version: base.Update(remoteDevice1.Short()), Blocks: genBlocks(3)},
+	}
+
+	s.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
+	s.Replace(remoteDevice0, remote0)
+	s.Replace(remoteDevice1, remote1)
+
+	if !local[0].Version.Concurrent(remote0[0].Version) {
+		t.Fatal("Expected concurrent versions for a")
+	}
+
+	// The winner of the concurrent versions of "a" is decided by the tie
+	// break in Vector.Compare.
+	var winner protocol.FileInfo
+	var winnerDevice protocol.DeviceID
+	if local[0].Version.Compare(remote0[0].Version) == protocol.ConcurrentGreater {
+		winner, winnerDevice = local[0], protocol.LocalDeviceID
+	} else {
+		winner, winnerDevice = remote0[0], remoteDevice0
+	}
+
+	if g := s.GetGlobal("a"); !g.Version.Equal(winner.Version) {
+		t.Errorf("Global version of a incorrect; %v != %v", g.Version, winner.Version)
+	}
+	if g := s.GetGlobal("b"); !g.Version.Equal(remote1[1].Version) {
+		t.Errorf("Global version of b incorrect; %v != %v", g.Version, remote1[1].Version)
+	}
+
+	if av := s.Availability("a"); len(av) != 1 || av[0] != winnerDevice {
+		t.Errorf("Availability of a incorrect; %v", av)
+	}
+
+	// Whoever lost the conflict on "a" needs the winning version, and
+	// everyone needs the newer "b".
+	need := needList(s, protocol.LocalDeviceID)
+	if winnerDevice == protocol.LocalDeviceID {
+		if len(need) != 1 || need[0].Name != "b" {
+			t.Errorf("Need incorrect; %v", need)
+		}
+	} else {
+		if len(need) != 2 || need[0].Name != "a" || need[1].Name != "b" {
+			t.Errorf("Need incorrect; %v", need)
+		}
+	}
+}
+
 func Benchmark10kReplace(b *testing.B) {
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -454,20 +566,20 @@ func Benchmark10kReplace(b *testing.B) {
 
 	var local []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		m := files.NewSet("test", db)
-		m.ReplaceWithDelete(protocol.LocalDeviceID, local)
+		m.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 	}
 }
 
 func Benchmark10kUpdateChg(b *testing.B) {
 	var remote []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
-		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
@@ -480,16 +592,16 @@ func Benchmark10kUpdateChg(b *testing.B) {
 
 	var local []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
 		for j := range local {
-			local[j].Version++
+			local[j].Version = local[j].Version.Update(myID)
 		}
 		b.StartTimer()
 		m.Update(protocol.LocalDeviceID, local)
@@ -499,7 +611,7 @@ func Benchmark10kUpdateChg(b *testing.B) {
 func Benchmark10kUpdateSme(b *testing.B) {
 	var remote []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
-		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
@@ -511,10 +623,10 @@ func Benchmark10kUpdateSme(b *testing.B) {
 
 	var local []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -525,7 +637,7 @@ func Benchmark10kUpdateSme(b *testing.B) {
 func Benchmark10kNeed2k(b *testing.B) {
 	var remote []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
-		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
@@ -538,13 +650,13 @@ func Benchmark10kNeed2k(b *testing.B) {
 
 	var local []protocol.FileInfo
 	for i := 0; i < 8000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 	for i := 8000; i < 10000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 980})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 980}}})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -558,7 +670,7 @@ func Benchmark10kNeed2k(b *testing.B) {
 func Benchmark10kHaveFullList(b *testing.B) {
 	var remote []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
-		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
@@ -571,13 +683,13 @@ func Benchmark10kHaveFullList(b *testing.B) {
 
 	var local []protocol.FileInfo
 	for i := 0; i < 2000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 	for i := 2000; i < 10000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 980})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 980}}})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -591,7 +703,7 @@ func Benchmark10kHaveFullList(b *testing.B) {
 func Benchmark10kGlobal(b *testing.B) {
 	var remote []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
-		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
@@ -604,13 +716,13 @@ func Benchmark10kGlobal(b *testing.B) {
 
 	var local []protocol.FileInfo
 	for i := 0; i < 2000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 	for i := 2000; i < 10000; i++ {
-		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 980})
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 980}}})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -630,20 +742,20 @@ func TestGlobalReset(t *testing.T) {
 	m := files.NewSet("test", db)
 
 	local := []protocol.FileInfo{
-		{Name: "a", Version: 1000},
-		{Name: "b", Version: 1000},
-		{Name: "c", Version: 1000},
-		{Name: "d", Version: 1000},
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 
 	remote := []protocol.FileInfo{
-		{Name: "a", Version: 1000},
-		{Name: "b", Version: 1001},
-		{Name: "c", Version: 1002},
-		{Name: "e", Version: 1000},
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}},
+		{Name: "e", Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 	g := globalList(m)
 	sort.Sort(fileList(g))
 
@@ -671,26 +783,26 @@ func TestNeed(t *testing.T) {
 	m := files.NewSet("test", db)
 
 	local := []protocol.FileInfo{
-		{Name: "a", Version: 1000},
-		{Name: "b", Version: 1000},
-		{Name: "c", Version: 1000},
-		{Name: "d", Version: 1000},
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 
 	remote := []protocol.FileInfo{
-		{Name: "a", Version: 1000},
-		{Name: "b", Version: 1001},
-		{Name: "c", Version: 1002},
-		{Name: "e", Version: 1000},
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}},
+		{Name: "e", Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 
 	shouldNeed := []protocol.FileInfo{
-		{Name: "b", Version: 1001},
-		{Name: "c", Version: 1002},
-		{Name: "e", Version: 1000},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1001}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}},
+		{Name: "e", Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 	m.Replace(remoteDevice0, remote)
 
 	need := needList(m, protocol.LocalDeviceID)
@@ -712,36 +824,73 @@ func TestLocalVersion(t *testing.T) {
 	m := files.NewSet("test", db)
 
 	local1 := []protocol.FileInfo{
-		{Name: "a", Version: 1000},
-		{Name: "b", Version: 1000},
-		{Name: "c", Version: 1000},
-		{Name: "d", Version: 1000},
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 
 	local2 := []protocol.FileInfo{
 		local1[0],
 		// [1] deleted
 		local1[2],
-		{Name: "d", Version: 1002},
-		{Name: "e", Version: 1000},
+		{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1002}}},
+		{Name: "e", Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local1)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local1, myID)
 	c0 := m.LocalVersion(protocol.LocalDeviceID)
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local2)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local2, myID)
 	c1 := m.LocalVersion(protocol.LocalDeviceID)
 	if !(c1 > c0) {
 		t.Fatal("Local version number should have incremented")
 	}
 
-	m.ReplaceWithDelete(protocol.LocalDeviceID, local2)
+	m.ReplaceWithDelete(protocol.LocalDeviceID, local2, myID)
 	c2 := m.LocalVersion(protocol.LocalDeviceID)
 	if c2 != c1 {
 		t.Fatal("Local version number should be unchanged")
 	}
 }
 
+func TestWithHaveSequence(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := files.NewSet("test", db)
+
+	// Files are updated in a different order than their names
+	for _, name := range []string{"z", "a", "m"} {
+		m.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: name, Version: protocol.Vector{{ID: myID, Value: 1000}}}})
+	}
+
+	var names []string
+	var first uint64
+	m.WithHaveSequence(protocol.LocalDeviceID, 0, func(fi protocol.FileIntf) bool {
+		f := fi.(protocol.FileInfo)
+		if first == 0 {
+			first = f.LocalVersion
+		}
+		names = append(names, f.Name)
+		return true
+	})
+	if fmt.Sprint(names) != "[z a m]" {
+		t.Errorf("files not in local version order: %v", names)
+	}
+
+	names = nil
+	m.WithHaveSequence(protocol.LocalDeviceID, first, func(fi protocol.FileIntf) bool {
+		names = append(names, fi.(protocol.FileInfo).Name)
+		return true
+	})
+	if fmt.Sprint(names) != "[a m]" {
+		t.Errorf("incorrect files after local version %d: %v", first, names)
+	}
+}
+
 func TestListDropFolder(t *testing.T) {
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -750,17 +899,17 @@ func TestListDropFolder(t *testing.T) {
 
 	s0 := files.NewSet("test0", db)
 	local1 := []protocol.FileInfo{
-		{Name: "a", Version: 1000},
-		{Name: "b", Version: 1000},
-		{Name: "c", Version: 1000},
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 	s0.Replace(protocol.LocalDeviceID, local1)
 
 	s1 := files.NewSet("test1", db)
 	local2 := []protocol.FileInfo{
-		{Name: "d", Version: 1002},
-		{Name: "e", Version: 1002},
-		{Name: "f", Version: 1002},
+		{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1002}}},
+		{Name: "e", Version: protocol.Vector{{ID: myID, Value: 1002}}},
+		{Name: "f", Version: protocol.Vector{{ID: myID, Value: 1002}}},
 	}
 	s1.Replace(remoteDevice0, local2)
 
@@ -802,24 +951,24 @@ func TestGlobalNeedWithInvalid(t *testing.T) {
 	s := files.NewSet("test1", db)
 
 	rem0 := fileList{
-		protocol.FileInfo{Name: "a", Version: 1002, Blocks: genBlocks(4)},
-		protocol.FileInfo{Name: "b", Version: 1002, Flags: protocol.FlagInvalid},
-		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1002}}, Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(4)},
 	}
 	s.Replace(remoteDevice0, rem0)
 
 	rem1 := fileList{
-		protocol.FileInfo{Name: "a", Version: 1002, Blocks: genBlocks(4)},
-		protocol.FileInfo{Name: "b", Version: 1002, Blocks: genBlocks(4)},
-		protocol.FileInfo{Name: "c", Version: 1002, Flags: protocol.FlagInvalid},
+		protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}, Flags: protocol.FlagInvalid},
 	}
 	s.Replace(remoteDevice1, rem1)
 
 	total := fileList{
 		// There's a valid copy of each file, so it should be merged
-		protocol.FileInfo{Name: "a", Version: 1002, Blocks: genBlocks(4)},
-		protocol.FileInfo{Name: "b", Version: 1002, Blocks: genBlocks(4)},
-		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1002}}, Blocks: genBlocks(4)},
 	}
 
 	need := fileList(needList(s, protocol.LocalDeviceID))
@@ -848,10 +997,10 @@ func TestLongPath(t *testing.T) {
 	name := b.String() // 5000 characters
 
 	local := []protocol.FileInfo{
-		{Name: string(name), Version: 1000},
+		{Name: string(name), Version: protocol.Vector{{ID: myID, Value: 1000}}},
 	}
 
-	s.ReplaceWithDelete(protocol.LocalDeviceID, local)
+	s.ReplaceWithDelete(protocol.LocalDeviceID, local, myID)
 
 	gf := globalList(s)
 	if l := len(gf); l != 1 {
@@ -862,3 +1011,112 @@ func TestLongPath(t *testing.T) {
 			gf[0].Name, local[0].Name)
 	}
 }
+
+func TestIndexID(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := files.NewSet("test", db)
+
+	// The local index ID is generated on creation and is persistent.
+
+	localID := s.IndexID(protocol.LocalDeviceID)
+	if localID == 0 {
+		t.Fatal("local index ID should be nonzero")
+	}
+	if id := files.NewSet("test", db).IndexID(protocol.LocalDeviceID); id != localID {
+		t.Errorf("local index ID changed on reopen, %x != %x", id, localID)
+	}
+
+	// Remote index IDs are unknown until set
+
+	if id := s.IndexID(remoteDevice0); id != 0 {
+		t.Errorf("unexpected remote index ID %x", id)
+	}
+	s.SetIndexID(remoteDevice0, 42)
+	if id := s.IndexID(remoteDevice0); id != 42 {
+		t.Errorf("incorrect remote index ID %x != 42", id)
+	}
+
+	// Dropping an index also drops, or for the local device regenerates, the
+	// index ID.
+
+	s.Replace(remoteDevice0, nil)
+	if id := s.IndexID(remoteDevice0); id != 0 {
+		t.Errorf("remote index ID should be forgotten, not %x", id)
+	}
+	s.Replace(protocol.LocalDeviceID, nil)
+	if id := s.IndexID(protocol.LocalDeviceID); id == 0 || id == localID {
+		t.Errorf("local index ID should be regenerated, not %x", id)
+	}
+
+	// Dropping the folder removes the index IDs
+
+	s.SetIndexID(remoteDevice0, 42)
+	files.DropFolder(db, "test")
+	if id := s.IndexID(remoteDevice0); id != 0 {
+		t.Errorf("remote index ID should be dropped with the folder, not %x", id)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := files.NewSet("test", db)
+	local := s.Subscribe(files.LocalChanges)
+	remote := s.Subscribe(files.RemoteChanges)
+
+	pending := func(c <-chan struct{}) bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Multiple local changes are coalesced into one notification, and not
+	// seen by the remote subscriber.
+
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1}}}})
+	s.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1}}}})
+	if !pending(local) {
+		t.Error("expected a local change notification")
+	}
+	if pending(local) {
+		t.Error("local change notifications should be coalesced")
+	}
+	if pending(remote) {
+		t.Error("unexpected remote change notification")
+	}
+
+	// Updates that don't change anything don't notify
+
+	s.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1}}}})
+	if pending(local) {
+		t.Error("unexpected local change notification")
+	}
+
+	// Remote changes
+
+	s.Update(remoteDevice0, []protocol.FileInfo{{Name: "c", Version: protocol.Vector{{ID: myID, Value: 1}}, LocalVersion: 10}})
+	if !pending(remote) {
+		t.Error("expected a remote change notification")
+	}
+	if pending(local) {
+		t.Error("unexpected local change notification")
+	}
+
+	// No notifications after unsubscribing
+
+	s.Unsubscribe(local)
+	s.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "d", Version: protocol.Vector{{ID: myID, Value: 1}}}})
+	if pending(local) {
+		t.Error("unexpected local change notification after unsubscribe")
+	}
+}
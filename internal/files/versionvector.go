@@ -0,0 +1,36 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package files
+
+import (
+	"github.com/calmh/xdr"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// versionVector wraps a protocol.Vector so that genxdr can serialize it as
+// part of a fileVersion. It lives outside of leveldb.go since genxdr would
+// otherwise try to generate (empty) encoders for it.
+type versionVector struct {
+	protocol.Vector
+}
+
+func (v versionVector) encodeXDR(xw *xdr.Writer) (int, error) {
+	return v.Vector.EncodeXDRInto(xw)
+}
+
+func (v *versionVector) decodeXDR(xr *xdr.Reader) error {
+	return v.Vector.DecodeXDRFrom(xr)
+}
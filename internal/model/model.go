@@ -34,12 +34,12 @@ import (
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/files"
 	"github.com/syncthing/syncthing/internal/ignore"
-	"github.com/syncthing/syncthing/internal/lamport"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/stats"
 	"github.com/syncthing/syncthing/internal/versioner"
+	"github.com/syncthing/syncthing/internal/watcher"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
@@ -50,6 +50,8 @@ const (
 	FolderScanning
 	FolderSyncing
 	FolderCleaning
+	FolderPaused
+	FolderOutOfSpace
 )
 
 func (s folderState) String() string {
@@ -62,6 +64,10 @@ func (s folderState) String() string {
 		return "cleaning"
 	case FolderSyncing:
 		return "syncing"
+	case FolderPaused:
+		return "paused"
+	case FolderOutOfSpace:
+		return "outOfSpace"
 	default:
 		return "unknown"
 	}
@@ -73,8 +79,16 @@ const (
 	indexPerFileSize  = 250        // Each FileInfo is approximately this big, in bytes, excluding BlockInfos
 	IndexPerBlockSize = 40         // Each BlockInfo is approximately this big
 	indexBatchSize    = 1000       // Either way, don't include more files than this
+
+	// Local changes happening within this interval of an index update being
+	// sent are batched into the next update.
+	indexCoalesceIntv = 100 * time.Millisecond
 )
 
+// Filesystem changes are collected for this long before the affected paths
+// are rescanned, unless the folder configures another delay.
+const defaultWatchDelay = 10 * time.Second
+
 type service interface {
 	Serve()
 	Stop()
@@ -85,6 +99,8 @@ type Model struct {
 	db     *leveldb.DB
 	finder *files.BlockFinder
 
+	id            protocol.DeviceID
+	shortID       uint64
 	deviceName    string
 	clientName    string
 	clientVersion string
@@ -100,12 +116,18 @@ type Model struct {
 
 	folderState        map[string]folderState // folder -> state
 	folderStateChanged map[string]time.Time   // folder -> time when state changed
+	folderStateErr     map[string]error       // folder -> why it's in the state, if not by choice
 	smut               sync.RWMutex
 
-	protoConn map[protocol.DeviceID]protocol.Connection
-	rawConn   map[protocol.DeviceID]io.Closer
-	deviceVer map[protocol.DeviceID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	protoConn      map[protocol.DeviceID]protocol.Connection
+	rawConn        map[protocol.DeviceID]io.Closer
+	closed         map[protocol.DeviceID]chan struct{} // closed when the connection is closed
+	deviceVer      map[protocol.DeviceID]string
+	deviceProgress map[protocol.DeviceID]bool            // devices that understand DownloadProgress messages
+	indexSenders   map[protocol.DeviceID]map[string]bool // folders we send indexes for over the connection
+	pmut           sync.RWMutex                          // protects protoConn, rawConn and closed
+
+	remoteProgress *remoteProgress
 
 	addedFolder bool
 	started     bool
@@ -119,10 +141,12 @@ var (
 // NewModel creates and starts a new model. The model starts in read-only mode,
 // where it sends index information to connected peers and responds to requests
 // for file data without altering the local folder in any way.
-func NewModel(cfg *config.ConfigWrapper, deviceName, clientName, clientVersion string, db *leveldb.DB) *Model {
+func NewModel(cfg *config.ConfigWrapper, id protocol.DeviceID, deviceName, clientName, clientVersion string, db *leveldb.DB) *Model {
 	m := &Model{
 		cfg:                cfg,
 		db:                 db,
+		id:                 id,
+		shortID:            id.Short(),
 		deviceName:         deviceName,
 		clientName:         clientName,
 		clientVersion:      clientVersion,
@@ -135,9 +159,14 @@ func NewModel(cfg *config.ConfigWrapper, deviceName, clientName, clientVersion s
 		folderRunners:      make(map[string]service),
 		folderState:        make(map[string]folderState),
 		folderStateChanged: make(map[string]time.Time),
+		folderStateErr:     make(map[string]error),
 		protoConn:          make(map[protocol.DeviceID]protocol.Connection),
 		rawConn:            make(map[protocol.DeviceID]io.Closer),
+		closed:             make(map[protocol.DeviceID]chan struct{}),
 		deviceVer:          make(map[protocol.DeviceID]string),
+		deviceProgress:     make(map[protocol.DeviceID]bool),
+		indexSenders:       make(map[protocol.DeviceID]map[string]bool),
+		remoteProgress:     newRemoteProgress(),
 		finder:             files.NewBlockFinder(db, cfg),
 	}
 
@@ -169,12 +198,24 @@ func (m *Model) StartFolderRW(folder string) {
 		panic("cannot start already running folder " + folder)
 	}
 	p := &Puller{
-		folder:        folder,
-		dir:           cfg.Path,
-		scanIntv:      time.Duration(cfg.RescanIntervalS) * time.Second,
-		model:         m,
-		ignorePerms:   cfg.IgnorePerms,
-		lenientMtimes: cfg.LenientMtimes,
+		folder:          folder,
+		dir:             cfg.Path,
+		scanIntv:        time.Duration(cfg.RescanIntervalS) * time.Second,
+		model:           m,
+		ignorePerms:     cfg.IgnorePerms,
+		ignoreSymlinks:  cfg.IgnoreSymlinks,
+		lenientMtimes:   cfg.LenientMtimes,
+		revert:          make(chan struct{}, 1),
+		connected:       make(chan struct{}, 1),
+		maxDeletes:      cfg.MaxDeletes,
+		maxDeletesPct:   cfg.MaxDeletesPct,
+		order:           cfg.Order,
+		minDiskFree:     cfg.MinDiskFreeSize(),
+		deletionsAction: make(chan bool, 1),
+		progressIntv:    time.Duration(m.cfg.Options().ProgressIntervalS) * time.Second,
+	}
+	if cfg.WatchFS {
+		p.watcher = m.newWatcher(cfg)
 	}
 	m.folderRunners[folder] = p
 	m.fmut.Unlock()
@@ -213,12 +254,48 @@ func (m *Model) StartFolderRO(folder string) {
 		intv:   time.Duration(cfg.RescanIntervalS) * time.Second,
 		model:  m,
 	}
+	if cfg.WatchFS {
+		s.watcher = m.newWatcher(cfg)
+	}
 	m.folderRunners[folder] = s
 	m.fmut.Unlock()
 
 	go s.Serve()
 }
 
+// newWatcher returns a filesystem watcher for the given folder.
+func (m *Model) newWatcher(cfg config.FolderConfiguration) *watcher.Watcher {
+	delay := time.Duration(cfg.WatchDelayS) * time.Second
+	if delay <= 0 {
+		delay = defaultWatchDelay
+	}
+	return watcher.New(cfg.Path, delay, m.watchIgnored(cfg.ID))
+}
+
+// watchIgnored returns a function that tells whether the filesystem watcher
+// should ignore changes to the given path in the folder. That's the case
+// for temporary files, our internal files and files matched by the ignore
+// patterns.
+func (m *Model) watchIgnored(folder string) func(rel string) bool {
+	return func(rel string) bool {
+		if rel == ".stignore" {
+			// Changes to the ignore patterns trigger a full rescan, even
+			// if the patterns happen to match the ignore file itself.
+			return false
+		}
+		if defTempNamer.IsTemporary(rel) {
+			return true
+		}
+		if sn := filepath.Base(rel); sn == ".stversions" || sn == ".stfolder" {
+			return true
+		}
+		m.fmut.RLock()
+		ignores := m.folderIgnores[folder]
+		m.fmut.RUnlock()
+		return ignores != nil && ignores.Match(rel)
+	}
+}
+
 type ConnectionInfo struct {
 	protocol.Statistics
 	Address       string
@@ -439,7 +516,6 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 	}
 
 	for i := 0; i < len(fs); {
-		lamport.Default.Tick(fs[i].Version)
 		if ignores != nil && ignores.Match(fs[i].Name) {
 			if debug {
 				l.Debugln("dropping update for ignored", fs[i])
@@ -483,7 +559,6 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 	}
 
 	for i := 0; i < len(fs); {
-		lamport.Default.Tick(fs[i].Version)
 		if ignores != nil && ignores.Match(fs[i].Name) {
 			if debug {
 				l.Debugln("dropping update for ignored", fs[i])
@@ -518,11 +593,15 @@ func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool
 
 func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
 	m.pmut.Lock()
+	// The client version is forgotten when the connection closes, so it
+	// tells us whether this is the first cluster config on the connection.
+	_, repeated := m.deviceVer[deviceID]
 	if cm.ClientName == "syncthing" {
 		m.deviceVer[deviceID] = cm.ClientVersion
 	} else {
 		m.deviceVer[deviceID] = cm.ClientName + " " + cm.ClientVersion
 	}
+	m.deviceProgress[deviceID] = cm.GetOption("downloadProgress") != ""
 	m.pmut.Unlock()
 
 	l.Infof(`Device %s client is "%s %s"`, deviceID, cm.ClientName, cm.ClientVersion)
@@ -536,15 +615,28 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		}
 	}
 
+	// Folders we don't have are remembered, to be accepted or ignored by
+	// the user.
+	m.fmut.RLock()
+	var unknown []string
+	for _, folder := range cm.Folders {
+		if _, ok := m.folderDevices[folder.ID]; !ok {
+			unknown = append(unknown, folder.ID)
+		}
+	}
+	m.fmut.RUnlock()
+	for _, folder := range unknown {
+		m.recordPendingFolder(deviceID, folder, cm.GetOption("name"), !repeated)
+	}
+
 	if m.cfg.Devices()[deviceID].Introducer {
 		// This device is an introducer. Go through the announced lists of folders
 		// and devices and add what we are missing.
 
 		var changed bool
 		for _, folder := range cm.Folders {
-			// If we don't have this folder yet, skip it. Ideally, we'd
-			// offer up something in the GUI to create the folder, but for the
-			// moment we only handle folders that we already have.
+			// If we don't have this folder yet, skip it. It has been
+			// recorded as a pending folder above.
 			if _, ok := m.folderDevices[folder.ID]; !ok {
 				continue
 			}
@@ -604,6 +696,133 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 			m.cfg.Save()
 		}
 	}
+
+	// The index senders run until the connection is closed. The set of
+	// folders they were started for is only used by the cluster config
+	// handler of the connection, which doesn't run concurrently with itself.
+	m.pmut.Lock()
+	conn, ok := m.protoConn[deviceID]
+	closed := m.closed[deviceID]
+	senders := m.indexSenders[deviceID]
+	if ok && senders == nil {
+		senders = make(map[string]bool)
+		m.indexSenders[deviceID] = senders
+	}
+	m.pmut.Unlock()
+	if !ok {
+		return
+	}
+
+	var pullers []*Puller
+	m.fmut.RLock()
+	for _, folder := range m.deviceFolders[deviceID] {
+		fs := m.folderFiles[folder]
+		startLocalVer := m.indexExchangeStart(deviceID, folder, fs, cm)
+		if !senders[folder] {
+			// A device that sends another cluster config over the same
+			// connection keeps the sender it has.
+			senders[folder] = true
+			go sendIndexes(conn, closed, folder, fs, m.folderIgnores[folder], startLocalVer)
+		}
+		if p, ok := m.folderRunners[folder].(*Puller); ok {
+			pullers = append(pullers, p)
+		}
+	}
+	m.fmut.RUnlock()
+
+	for _, p := range pullers {
+		p.deviceConnected()
+	}
+
+	// Tell the device about the files we are in the middle of pulling, as it
+	// missed the progress advertised so far.
+	if cm.GetOption("downloadProgress") != "" {
+		for _, p := range pullers {
+			if updates := p.progress.advertised(); len(updates) > 0 {
+				conn.DownloadProgress(p.folder, updates)
+			}
+		}
+	}
+}
+
+// DownloadProgress records the blocks the device has of files it is
+// downloading, so that we can pull them from it too.
+// Implements the protocol.Model interface.
+func (m *Model) DownloadProgress(deviceID protocol.DeviceID, folder string, updates []protocol.FileDownloadProgressUpdate) {
+	if !m.folderSharedWith(folder, deviceID) {
+		if debug {
+			l.Debugf("%v: ignoring download progress for unshared folder %q from %s", m, folder, deviceID)
+		}
+		return
+	}
+	m.remoteProgress.update(deviceID, folder, updates)
+}
+
+// sendDownloadProgress advertises the progress of files being pulled in the
+// folder to the connected devices that share it.
+func (m *Model) sendDownloadProgress(folder string, updates []protocol.FileDownloadProgressUpdate) {
+	m.fmut.RLock()
+	devices := m.folderDevices[folder]
+	m.fmut.RUnlock()
+
+	var conns []protocol.Connection
+	m.pmut.RLock()
+	for _, deviceID := range devices {
+		if conn, ok := m.protoConn[deviceID]; ok && m.deviceProgress[deviceID] {
+			conns = append(conns, conn)
+		}
+	}
+	m.pmut.RUnlock()
+
+	for _, conn := range conns {
+		conn.DownloadProgress(folder, updates)
+	}
+}
+
+// indexExchangeStart looks at what the remote device announced about the
+// given folder in its cluster config. It drops our copy of the remote index
+// if the remote has reset its index since we last saw it, and returns the
+// local version from which we need to send our own index. A return value of
+// zero means that the full index must be sent.
+func (m *Model) indexExchangeStart(deviceID protocol.DeviceID, folder string, fs *files.Set, cm protocol.ClusterConfigMessage) uint64 {
+	var startLocalVer uint64
+	for _, cmFolder := range cm.Folders {
+		if cmFolder.ID != folder {
+			continue
+		}
+
+		for _, dev := range cmFolder.Devices {
+			var id protocol.DeviceID
+			copy(id[:], dev.ID)
+
+			switch id {
+			case m.id:
+				// This is what the remote device knows about our index. We can
+				// continue where it left off, as long as it is the index we
+				// still have.
+				if dev.IndexID == fs.IndexID(protocol.LocalDeviceID) && dev.MaxLocalVersion <= fs.LocalVersion(protocol.LocalDeviceID) {
+					startLocalVer = dev.MaxLocalVersion
+				} else if debug {
+					l.Debugf("%v: %s/%q: index ID or version mismatch (%x/%d), sending full index", m, deviceID, folder, dev.IndexID, dev.MaxLocalVersion)
+				}
+
+			case deviceID:
+				// This is the remote device's current index ID. If it is not
+				// the one we have stored the index for, that index is stale.
+				if dev.IndexID != fs.IndexID(deviceID) {
+					if debug {
+						l.Debugf("%v: %s/%q: remote index ID changed to %x, dropping index", m, deviceID, folder, dev.IndexID)
+					}
+					fs.Replace(deviceID, nil)
+					if dev.IndexID != 0 {
+						fs.SetIndexID(deviceID, dev.IndexID)
+					}
+				}
+			}
+		}
+	}
+
+	return startLocalVer
 }
 
 // Close removes the peer from the model and closes the underlying connection if possible.
@@ -615,13 +834,10 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 		"error": err.Error(),
 	})
 
-	m.pmut.Lock()
-	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[device] {
-		m.folderFiles[folder].Replace(device, nil)
-	}
-	m.fmut.RUnlock()
+	// The index for the device is kept, so that we only need to exchange the
+	// changes since the last connection when it reconnects.
 
+	m.pmut.Lock()
 	conn, ok := m.rawConn[device]
 	if ok {
 		if conn, ok := conn.(*tls.Conn); ok {
@@ -633,10 +849,18 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 		}
 		conn.Close()
 	}
+	if closed, ok := m.closed[device]; ok {
+		close(closed)
+	}
 	delete(m.protoConn, device)
 	delete(m.rawConn, device)
+	delete(m.closed, device)
 	delete(m.deviceVer, device)
+	delete(m.deviceProgress, device)
+	delete(m.indexSenders, device)
 	m.pmut.Unlock()
+
+	m.remoteProgress.forget(device)
 }
 
 // Request returns the specified data segment by reading it from local disk.
@@ -653,6 +877,20 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	}
 
 	lf := r.Get(protocol.LocalDeviceID, name)
+
+	// A block of a file we are still pulling can be served from the
+	// temporary file, as advertised in our download progress. A device that
+	// asks for a block of the file we already have is served from that
+	// instead, as it may not want the newer version.
+	if p, err := m.folderPuller(folder); err == nil && !hasBlock(lf, offset, size) {
+		if buf, err := p.progress.readBlock(name, offset, size); err == nil {
+			if debug {
+				l.Debugf("%v REQ(in; temp): %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, size)
+			}
+			return buf, nil
+		}
+	}
+
 	if protocol.IsInvalid(lf.Flags) || protocol.IsDeleted(lf.Flags) {
 		if debug {
 			l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d; invalid: %v", m, deviceID, folder, name, offset, size, lf)
@@ -670,9 +908,24 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	if debug && deviceID != protocol.LocalDeviceID {
 		l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, size)
 	}
+
 	m.fmut.RLock()
 	fn := filepath.Join(m.folderCfgs[folder].Path, name)
 	m.fmut.RUnlock()
+
+	if lf.IsSymlink() {
+		// The contents of a symlink is the link target.
+		target, err := os.Readlink(fn)
+		if err != nil {
+			return nil, err
+		}
+		bs := []byte(filepath.ToSlash(target))
+		if offset+int64(size) > int64(len(bs)) {
+			return nil, ErrNoSuchFile
+		}
+		return bs[offset : offset+int64(size)], nil
+	}
+
 	fd, err := os.Open(fn) // XXX: Inefficient, should cache fd?
 	if err != nil {
 		return nil, err
@@ -688,10 +941,20 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	return buf, nil
 }
 
+// hasBlock returns true if the file is valid and has a block at the given
+// offset and of the given size.
+func hasBlock(f protocol.FileInfo, offset int64, size int) bool {
+	if f.Name == "" || protocol.IsInvalid(f.Flags) || protocol.IsDeleted(f.Flags) || offset%protocol.BlockSize != 0 {
+		return false
+	}
+	index := offset / protocol.BlockSize
+	return index < int64(len(f.Blocks)) && f.Blocks[index].Size == uint32(size)
+}
+
 // ReplaceLocal replaces the local folder index with the given list of files.
 func (m *Model) ReplaceLocal(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
-	m.folderFiles[folder].ReplaceWithDelete(protocol.LocalDeviceID, fs)
+	m.folderFiles[folder].ReplaceWithDelete(protocol.LocalDeviceID, fs, m.shortID)
 	m.fmut.RUnlock()
 }
 
@@ -796,8 +1059,9 @@ func (m *Model) SetIgnores(folder string, content []string) error {
 	return m.ScanFolder(folder)
 }
 
-// AddConnection adds a new peer connection to the model. An initial index will
-// be sent to the connected peer, thereafter index updates whenever the local
+// AddConnection adds a new peer connection to the model. Once the peer's
+// cluster config has been received, an initial index or index update will be
+// sent to the connected peer, thereafter index updates whenever the local
 // folder changes.
 func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection) {
 	deviceID := protoConn.ID()
@@ -811,16 +1075,12 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 		panic("add existing device")
 	}
 	m.rawConn[deviceID] = rawConn
+	m.closed[deviceID] = make(chan struct{})
+
+	protoConn.Start()
 
 	cm := m.clusterConfig(deviceID)
 	protoConn.ClusterConfig(cm)
-
-	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[deviceID] {
-		fs := m.folderFiles[folder]
-		go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder])
-	}
-	m.fmut.RUnlock()
 	m.pmut.Unlock()
 
 	m.deviceWasSeen(deviceID)
@@ -843,19 +1103,37 @@ func (m *Model) deviceWasSeen(deviceID protocol.DeviceID) {
 	m.deviceStatRef(deviceID).WasSeen()
 }
 
-func sendIndexes(conn protocol.Connection, folder string, fs *files.Set, ignores *ignore.Matcher) {
+func sendIndexes(conn protocol.Connection, closed <-chan struct{}, folder string, fs *files.Set, ignores *ignore.Matcher, startLocalVer uint64) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	var err error
 
 	if debug {
-		l.Debugf("sendIndexes for %s-%s/%q starting", deviceID, name, folder)
+		l.Debugf("sendIndexes for %s-%s/%q starting (slv=%d)", deviceID, name, folder, startLocalVer)
 	}
 
-	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores)
+	// Subscribe before sending the initial index, so that we don't miss any
+	// changes happening while it's being sent.
+	changed := fs.Subscribe(files.LocalChanges)
+	defer fs.Unsubscribe(changed)
+
+	// If the remote device already has our index up to startLocalVer, we
+	// only send the changes after that as index updates.
+	minLocalVer, err := sendIndexTo(startLocalVer == 0, startLocalVer, conn, folder, fs, ignores)
 
 	for err == nil {
-		time.Sleep(5 * time.Second)
+		// Give further changes a chance to accumulate, so that a burst of
+		// changes results in a few larger index updates instead of very
+		// many small ones.
+		time.Sleep(indexCoalesceIntv)
+
+		select {
+		case <-changed:
+		case <-closed:
+			err = protocol.ErrClosed
+			continue
+		}
+
 		if fs.LocalVersion(protocol.LocalDeviceID) <= minLocalVer {
 			continue
 		}
@@ -868,30 +1146,21 @@ func sendIndexes(conn protocol.Connection, folder string, fs *files.Set, ignores
 	}
 }
 
+// sendIndexTo sends the local files with a local version above minLocalVer
+// to the device, and returns the highest local version it has been sent. The
+// files are sent in local version order, so that a device which only got part
+// of them can later ask for the rest by the highest local version it has.
 func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, folder string, fs *files.Set, ignores *ignore.Matcher) (uint64, error) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
 	currentBatchSize := 0
-	maxLocalVer := uint64(0)
+	maxLocalVer := minLocalVer
+	batchLocalVer := minLocalVer
 	var err error
 
-	fs.WithHave(protocol.LocalDeviceID, func(fi protocol.FileIntf) bool {
+	fs.WithHaveSequence(protocol.LocalDeviceID, minLocalVer, func(fi protocol.FileIntf) bool {
 		f := fi.(protocol.FileInfo)
-		if f.LocalVersion <= minLocalVer {
-			return true
-		}
-
-		if f.LocalVersion > maxLocalVer {
-			maxLocalVer = f.LocalVersion
-		}
-
-		if ignores != nil && ignores.Match(f.Name) {
-			if debug {
-				l.Debugln("not sending update for ignored", f)
-			}
-			return true
-		}
 
 		if len(batch) == indexBatchSize || currentBatchSize > indexTargetSize {
 			if initial {
@@ -911,26 +1180,48 @@ func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, fol
 				}
 			}
 
+			maxLocalVer = batchLocalVer
 			batch = make([]protocol.FileInfo, 0, indexBatchSize)
 			currentBatchSize = 0
 		}
 
+		// Ignored files are passed over, and count as sent along with the
+		// batch they would have been in.
+		batchLocalVer = f.LocalVersion
+
+		if ignores != nil && ignores.Match(f.Name) {
+			if debug {
+				l.Debugln("not sending update for ignored", f)
+			}
+			return true
+		}
+
+		// The local change flag is for our own use only
+		f.Flags &^= protocol.FlagLocalChanged
+
 		batch = append(batch, f)
 		currentBatchSize += indexPerFileSize + len(f.Blocks)*IndexPerBlockSize
 		return true
 	})
 
-	if initial && err == nil {
+	if err != nil {
+		return maxLocalVer, err
+	}
+
+	if initial {
 		err = conn.Index(folder, batch)
 		if debug && err == nil {
 			l.Debugf("sendIndexes for %s-%s/%q: %d files (small initial index)", deviceID, name, folder, len(batch))
 		}
-	} else if len(batch) > 0 && err == nil {
+	} else if len(batch) > 0 {
 		err = conn.IndexUpdate(folder, batch)
 		if debug && err == nil {
 			l.Debugf("sendIndexes for %s-%s/%q: %d files (last batch)", deviceID, name, folder, len(batch))
 		}
 	}
+	if err == nil {
+		maxLocalVer = batchLocalVer
+	}
 
 	return maxLocalVer, err
 }
@@ -1014,28 +1305,56 @@ func (m *Model) ScanFolder(folder string) error {
 	return m.ScanFolderSub(folder, "")
 }
 
+// scanFolderSubs rescans the given subpaths of the folder. A change to the
+// ignore file causes a rescan of the entire folder instead, since any file
+// may have become ignored or unignored.
+func (m *Model) scanFolderSubs(folder string, subs []string) error {
+	for _, sub := range subs {
+		if sub == ".stignore" {
+			subs = []string{""}
+			break
+		}
+	}
+	for _, sub := range subs {
+		if err := m.ScanFolderSub(folder, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *Model) ScanFolderSub(folder, sub string) error {
 	if p := filepath.Clean(filepath.Join(folder, sub)); !strings.HasPrefix(p, folder) {
 		return errors.New("invalid subpath")
 	}
 
 	m.fmut.RLock()
-	fs, ok := m.folderFiles[folder]
 	dir := m.folderCfgs[folder].Path
+	m.fmut.RUnlock()
 
+	// The ignores are loaded without holding the lock, but stored under the
+	// write lock as they are read concurrently, e.g. by the watcher.
 	ignores, _ := ignore.Load(filepath.Join(dir, ".stignore"), m.cfg.Options().CacheIgnoredFiles)
-	m.folderIgnores[folder] = ignores
 
-	w := &scanner.Walker{
-		Dir:          dir,
-		Sub:          sub,
-		Matcher:      ignores,
-		BlockSize:    protocol.BlockSize,
-		TempNamer:    defTempNamer,
-		CurrentFiler: cFiler{m, folder},
-		IgnorePerms:  m.folderCfgs[folder].IgnorePerms,
+	m.fmut.Lock()
+	fs, ok := m.folderFiles[folder]
+	if ok {
+		m.folderIgnores[folder] = ignores
 	}
-	m.fmut.RUnlock()
+
+	w := &scanner.Walker{
+		Dir:            dir,
+		Sub:            sub,
+		Matcher:        ignores,
+		BlockSize:      protocol.BlockSize,
+		TempNamer:      defTempNamer,
+		CurrentFiler:   cFiler{m, folder},
+		IgnorePerms:    m.folderCfgs[folder].IgnorePerms,
+		IgnoreSymlinks: m.folderCfgs[folder].IgnoreSymlinks,
+		ShortID:        m.shortID,
+	}
+	receiveOnly := m.folderCfgs[folder].ReceiveOnly
+	m.fmut.Unlock()
 	if !ok {
 		return errors.New("no such folder")
 	}
@@ -1049,6 +1368,11 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 	batchSize := 100
 	batch := make([]protocol.FileInfo, 0, 00)
 	for f := range fchan {
+		if receiveOnly {
+			// Local changes in a receive only folder are not announced to
+			// the cluster, but flagged so that they can be reverted.
+			f.Flags |= protocol.FlagInvalid | protocol.FlagLocalChanged
+		}
 		events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 			"folder":   folder,
 			"name":     f.Name,
@@ -1080,7 +1404,7 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 
 		seenPrefix = true
 		if !protocol.IsDeleted(f.Flags) {
-			if f.IsInvalid() {
+			if f.IsInvalid() && !f.IsLocalChanged() {
 				return true
 			}
 
@@ -1106,13 +1430,16 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 					"size":     f.Size(),
 				})
 				batch = append(batch, nf)
-			} else if _, err := os.Stat(filepath.Join(dir, f.Name)); err != nil && os.IsNotExist(err) {
+			} else if _, err := os.Lstat(filepath.Join(dir, f.Name)); err != nil && os.IsNotExist(err) {
 				// File has been deleted
 				nf := protocol.FileInfo{
 					Name:     f.Name,
 					Flags:    f.Flags | protocol.FlagDeleted,
 					Modified: f.Modified,
-					Version:  lamport.Default.Tick(f.Version),
+					Version:  f.Version.Update(m.shortID),
+				}
+				if receiveOnly {
+					nf.Flags |= protocol.FlagInvalid | protocol.FlagLocalChanged
 				}
 				events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 					"folder":   folder,
@@ -1135,7 +1462,7 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 }
 
 // clusterConfig returns a ClusterConfigMessage that is correct for the given peer device
-func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMessage {
+func (m *Model) clusterConfig(deviceID protocol.DeviceID) protocol.ClusterConfigMessage {
 	cm := protocol.ClusterConfigMessage{
 		ClientName:    m.clientName,
 		ClientVersion: m.clientVersion,
@@ -1144,11 +1471,16 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 				Key:   "name",
 				Value: m.deviceName,
 			},
+			{
+				Key:   "downloadProgress",
+				Value: "1",
+			},
 		},
 	}
 
 	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[device] {
+	for _, folder := range m.deviceFolders[deviceID] {
+		fs := m.folderFiles[folder]
 		cr := protocol.Folder{
 			ID: folder,
 		}
@@ -1164,6 +1496,16 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 			if deviceCfg := m.cfg.Devices()[device]; deviceCfg.Introducer {
 				cn.Flags |= protocol.FlagIntroducer
 			}
+			// Announce what we know about our own and the peer's index, so
+			// that only the changes since then need to be exchanged.
+			switch device {
+			case m.id:
+				cn.IndexID = fs.IndexID(protocol.LocalDeviceID)
+				cn.MaxLocalVersion = fs.LocalVersion(protocol.LocalDeviceID)
+			case deviceID:
+				cn.IndexID = fs.IndexID(deviceID)
+				cn.MaxLocalVersion = fs.LocalVersion(deviceID)
+			}
 			cr.Devices = append(cr.Devices, cn)
 		}
 		cm.Folders = append(cm.Folders, cr)
@@ -1174,12 +1516,23 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 }
 
 func (m *Model) setState(folder string, state folderState) {
+	m.setStateError(folder, state, nil)
+}
+
+// setStateError sets the state of the folder along with the error that put
+// it there, such as the reason it can't be synced. The error is included in
+// the StateChanged event, which is also emitted when only the error changes.
+func (m *Model) setStateError(folder string, state folderState, err error) {
 	m.smut.Lock()
 	oldState := m.folderState[folder]
+	oldErr := m.folderStateErr[folder]
 	changed, ok := m.folderStateChanged[folder]
-	if state != oldState {
+	if state != oldState || errorString(err) != errorString(oldErr) {
 		m.folderState[folder] = state
-		m.folderStateChanged[folder] = time.Now()
+		m.folderStateErr[folder] = err
+		if state != oldState {
+			m.folderStateChanged[folder] = time.Now()
+		}
 		eventData := map[string]interface{}{
 			"folder": folder,
 			"to":     state.String(),
@@ -1188,17 +1541,23 @@ func (m *Model) setState(folder string, state folderState) {
 			eventData["duration"] = time.Since(changed).Seconds()
 			eventData["from"] = oldState.String()
 		}
+		if err != nil {
+			eventData["error"] = err.Error()
+		}
 		events.Default.Log(events.StateChanged, eventData)
 	}
 	m.smut.Unlock()
 }
 
-func (m *Model) State(folder string) (string, time.Time) {
+// State returns the state of the folder, when it was entered and the error
+// that caused it, if any.
+func (m *Model) State(folder string) (string, time.Time, error) {
 	m.smut.RLock()
 	state := m.folderState[folder]
 	changed := m.folderStateChanged[folder]
+	err := m.folderStateErr[folder]
 	m.smut.RUnlock()
-	return state.String(), changed
+	return state.String(), changed, err
 }
 
 func (m *Model) Override(folder string) {
@@ -1221,10 +1580,12 @@ func (m *Model) Override(folder string) {
 			need.Flags |= protocol.FlagDeleted
 			need.Blocks = nil
 		} else {
-			// We have the file, replace with our version
+			// We have the file, replace with our version. The version
+			// vector must dominate the global one for our version to win.
+			have.Version = have.Version.Merge(need.Version)
 			need = have
 		}
-		need.Version = lamport.Default.Tick(need.Version)
+		need.Version = need.Version.Update(m.shortID)
 		need.LocalVersion = 0
 		batch = append(batch, need)
 		return true
@@ -1235,6 +1596,139 @@ func (m *Model) Override(folder string) {
 	m.setState(folder, FolderIdle)
 }
 
+// Revert reverts the local changes in a receive only folder. Changed files
+// are replaced with their global versions and files that were added locally
+// are removed. The revert is performed asynchronously by the folder's
+// puller.
+func (m *Model) Revert(folder string) error {
+	p, err := m.folderPuller(folder)
+	if err != nil {
+		return err
+	}
+
+	m.fmut.RLock()
+	receiveOnly := m.folderCfgs[folder].ReceiveOnly
+	m.fmut.RUnlock()
+	if !receiveOnly {
+		return errors.New("folder is not receive only")
+	}
+
+	p.Revert()
+	return nil
+}
+
+// PendingDeletions returns the names of the items in the given folder whose
+// deletion is held back because it exceeds the configured limits.
+func (m *Model) PendingDeletions(folder string) ([]string, error) {
+	p, err := m.folderPuller(folder)
+	if err != nil {
+		return nil, err
+	}
+	return p.PendingDeletions(), nil
+}
+
+// ConfirmDeletions lets the pending deletions in the given folder proceed.
+func (m *Model) ConfirmDeletions(folder string) error {
+	p, err := m.folderPuller(folder)
+	if err != nil {
+		return err
+	}
+	if !p.DeletionsAction(true) {
+		return errors.New("no pending deletions")
+	}
+	return nil
+}
+
+// AbortDeletions cancels the pending deletions in the given folder. The
+// files are kept and announced to the cluster as the newest version.
+func (m *Model) AbortDeletions(folder string) error {
+	p, err := m.folderPuller(folder)
+	if err != nil {
+		return err
+	}
+	if !p.DeletionsAction(false) {
+		return errors.New("no pending deletions")
+	}
+	return nil
+}
+
+// folderPuller returns the puller of the given read/write folder.
+func (m *Model) folderPuller(folder string) (*Puller, error) {
+	m.fmut.RLock()
+	_, ok := m.folderCfgs[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+	p, ok := runner.(*Puller)
+	if !ok {
+		return nil, errors.New("folder is not running or read only")
+	}
+	return p, nil
+}
+
+// FolderErrors returns the files that failed to sync in the last pull of
+// the given folder.
+func (m *Model) FolderErrors(folder string) ([]FileError, error) {
+	m.fmut.RLock()
+	_, ok := m.folderCfgs[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+	if p, ok := runner.(*Puller); ok {
+		return p.Errors(), nil
+	}
+	// Read only folders don't pull and so have no errors.
+	return []FileError{}, nil
+}
+
+// FolderProgress returns the progress of the files currently being pulled in
+// the given folder.
+func (m *Model) FolderProgress(folder string) (FolderProgress, error) {
+	m.fmut.RLock()
+	_, ok := m.folderCfgs[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return FolderProgress{}, errors.New("no such folder")
+	}
+	if p, ok := runner.(*Puller); ok {
+		return p.Progress(), nil
+	}
+	// Read only folders don't pull anything.
+	return FolderProgress{Files: map[string]PullerProgress{}}, nil
+}
+
+// LocalChangedSize returns the number and total size of files that have been
+// changed locally in a receive only folder.
+func (m *Model) LocalChangedSize(folder string) (files int, bytes int64) {
+	defer m.leveldbPanicWorkaround()
+
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	if !m.folderCfgs[folder].ReceiveOnly {
+		return
+	}
+	if rf, ok := m.folderFiles[folder]; ok {
+		rf.WithHaveTruncated(protocol.LocalDeviceID, func(f protocol.FileIntf) bool {
+			if !f.(protocol.FileInfoTruncated).IsLocalChanged() {
+				return true
+			}
+			fs, de, by := sizeOfFile(f)
+			files += fs + de
+			bytes += by
+			return true
+		})
+	}
+	return
+}
+
 // CurrentLocalVersion returns the change version for the given folder.
 // This is guaranteed to increment if the contents of the local folder has
 // changed.
@@ -1272,16 +1766,43 @@ func (m *Model) RemoteLocalVersion(folder string) uint64 {
 	return ver
 }
 
-func (m *Model) availability(folder string, file string) []protocol.DeviceID {
-	m.fmut.Lock()
-	defer m.fmut.Unlock()
+// progressAvailability returns the devices that are still downloading the
+// file but have advertised that they have the given block.
+func (m *Model) progressAvailability(folder string, file protocol.FileInfo, block protocol.BlockInfo) []protocol.DeviceID {
+	devices := m.remoteProgress.devices(folder, file, block)
+
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	available := devices[:0]
+	for _, deviceID := range devices {
+		if _, ok := m.protoConn[deviceID]; ok {
+			available = append(available, deviceID)
+		}
+	}
+	return available
+}
 
+// availability returns the connected devices that have the global version
+// of the file.
+func (m *Model) availability(folder string, file string) []protocol.DeviceID {
+	m.fmut.RLock()
 	fs, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
 	if !ok {
 		return nil
 	}
 
-	return fs.Availability(file)
+	devices := fs.Availability(file)
+
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	available := devices[:0]
+	for _, deviceID := range devices {
+		if _, ok := m.protoConn[deviceID]; ok {
+			available = append(available, deviceID)
+		}
+	}
+	return available
 }
 
 func (m *Model) String() string {
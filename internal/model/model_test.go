@@ -18,11 +18,16 @@ package model
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/files"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -68,7 +73,7 @@ func init() {
 
 func TestRequest(t *testing.T) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
 
@@ -89,6 +94,48 @@ func TestRequest(t *testing.T) {
 	}
 }
 
+func TestRequestTempBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("old data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tempName := filepath.Join(dir, defTempNamer.TempName("file"))
+	if err := ioutil.WriteFile(tempName, []byte("new data, longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	m.ScanFolder("default")
+
+	// A newer, longer version of the file is being pulled
+	p := &Puller{folder: "default", dir: dir, model: m}
+	m.folderRunners["default"] = p
+	p.progress.register(&sharedPullerState{
+		file:      protocol.FileInfo{Name: "file", Blocks: []protocol.BlockInfo{{Size: 16}}},
+		tempName:  tempName,
+		available: []uint32{0},
+	})
+
+	// A block of the version we have comes from the file itself
+	bs, err := m.Request(device2, "default", "file", 0, 8)
+	if err != nil || string(bs) != "old data" {
+		t.Errorf("incorrect block %q (%v) of the local version", bs, err)
+	}
+
+	// A block of the version being pulled comes from the temp file
+	bs, err = m.Request(device2, "default", "file", 0, 16)
+	if err != nil || string(bs) != "new data, longer" {
+		t.Errorf("incorrect block %q (%v) of the version being pulled", bs, err)
+	}
+}
+
 func genFiles(n int) []protocol.FileInfo {
 	files := make([]protocol.FileInfo, n)
 	t := time.Now().Unix()
@@ -105,7 +152,7 @@ func genFiles(n int) []protocol.FileInfo {
 
 func BenchmarkIndex10000(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(nil, "device", "syncthing", "dev", db)
+	m := NewModel(nil, device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
 	files := genFiles(10000)
@@ -118,7 +165,7 @@ func BenchmarkIndex10000(b *testing.B) {
 
 func BenchmarkIndex00100(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(nil, "device", "syncthing", "dev", db)
+	m := NewModel(nil, device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
 	files := genFiles(100)
@@ -131,7 +178,7 @@ func BenchmarkIndex00100(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(nil, "device", "syncthing", "dev", db)
+	m := NewModel(nil, device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
 	files := genFiles(10000)
@@ -145,7 +192,7 @@ func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(nil, "device", "syncthing", "dev", db)
+	m := NewModel(nil, device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
 	files := genFiles(10000)
@@ -160,7 +207,7 @@ func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(nil, "device", "syncthing", "dev", db)
+	m := NewModel(nil, device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
 	files := genFiles(10000)
@@ -176,12 +223,15 @@ func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 type FakeConnection struct {
 	id          protocol.DeviceID
 	requestData []byte
+	requestErr  error
 }
 
 func (FakeConnection) Close() error {
 	return nil
 }
 
+func (FakeConnection) Start() {}
+
 func (f FakeConnection) ID() protocol.DeviceID {
 	return f.id
 }
@@ -203,11 +253,16 @@ func (FakeConnection) IndexUpdate(string, []protocol.FileInfo) error {
 }
 
 func (f FakeConnection) Request(folder, name string, offset int64, size int) ([]byte, error) {
+	if f.requestErr != nil {
+		return nil, f.requestErr
+	}
 	return f.requestData, nil
 }
 
 func (FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
 
+func (FakeConnection) DownloadProgress(string, []protocol.FileDownloadProgressUpdate) {}
+
 func (FakeConnection) Ping() bool {
 	return true
 }
@@ -218,7 +273,7 @@ func (FakeConnection) Statistics() protocol.Statistics {
 
 func BenchmarkRequest(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(nil, "device", "syncthing", "dev", db)
+	m := NewModel(nil, device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
 
@@ -266,7 +321,7 @@ func TestDeviceRename(t *testing.T) {
 	}
 
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
 	if cfg.Devices[0].Name != "" {
 		t.Errorf("Device already has a name")
 	}
@@ -324,7 +379,7 @@ func TestClusterConfig(t *testing.T) {
 
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
 
-	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
 	m.AddFolder(cfg.Folders[0])
 	m.AddFolder(cfg.Folders[1])
 
@@ -375,6 +430,249 @@ func TestClusterConfig(t *testing.T) {
 	}
 }
 
+func TestClusterConfigIndexIDs(t *testing.T) {
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1},
+		{DeviceID: device2},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID: "folder1",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2},
+			},
+		},
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	fs := m.folderFiles["folder1"]
+	localFiles := []protocol.FileInfo{
+		{Name: "a", Version: protocol.Vector{{ID: 1, Value: 1}}},
+		{Name: "b", Version: protocol.Vector{{ID: 1, Value: 1}}},
+	}
+	fs.Replace(protocol.LocalDeviceID, localFiles)
+	remoteFiles := []protocol.FileInfo{
+		{Name: "c", Version: protocol.Vector{{ID: 2, Value: 1}}, LocalVersion: 42},
+	}
+	fs.SetIndexID(device2, 1234)
+	fs.Replace(device2, remoteFiles)
+
+	// Our cluster config announces both our index and what we have of theirs
+
+	cm := m.clusterConfig(device2)
+	devs := cm.Folders[0].Devices
+	if devs[0].IndexID != fs.IndexID(protocol.LocalDeviceID) || devs[0].MaxLocalVersion != fs.LocalVersion(protocol.LocalDeviceID) {
+		t.Errorf("Incorrect local index announcement %d/%d", devs[0].IndexID, devs[0].MaxLocalVersion)
+	}
+	if devs[1].IndexID != 1234 || devs[1].MaxLocalVersion != 42 {
+		t.Errorf("Incorrect remote index announcement %d/%d", devs[1].IndexID, devs[1].MaxLocalVersion)
+	}
+
+	// The remote knows our current index up to some point, and its own index
+	// is the one we have. We continue from where it left off.
+
+	localVer := fs.LocalVersion(protocol.LocalDeviceID)
+	rcm := protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{
+			{
+				ID: "folder1",
+				Devices: []protocol.Device{
+					{ID: device1[:], IndexID: fs.IndexID(protocol.LocalDeviceID), MaxLocalVersion: localVer - 1},
+					{ID: device2[:], IndexID: 1234, MaxLocalVersion: 42},
+				},
+			},
+		},
+	}
+	if slv := m.indexExchangeStart(device2, "folder1", fs, rcm); slv != localVer-1 {
+		t.Errorf("Incorrect start local version %d != %d", slv, localVer-1)
+	}
+	if f := fs.Get(device2, "c"); f.Name != "c" {
+		t.Error("Remote index should have been kept")
+	}
+
+	// The remote has seen an older incarnation of our index, and has reset
+	// its own. We send a full index and forget what we had of theirs.
+
+	rcm.Folders[0].Devices[0].IndexID = 1
+	rcm.Folders[0].Devices[1].IndexID = 5678
+	if slv := m.indexExchangeStart(device2, "folder1", fs, rcm); slv != 0 {
+		t.Errorf("Incorrect start local version %d != 0", slv)
+	}
+	if f := fs.Get(device2, "c"); f.Name != "" {
+		t.Error("Remote index should have been dropped")
+	}
+	if id := fs.IndexID(device2); id != 5678 {
+		t.Errorf("Incorrect remote index ID %d != 5678", id)
+	}
+}
+
+type indexRecordingConnection struct {
+	FakeConnection
+	updates chan []protocol.FileInfo
+}
+
+func (c indexRecordingConnection) IndexUpdate(folder string, fs []protocol.FileInfo) error {
+	c.updates <- fs
+	return nil
+}
+
+func TestSendIndexesOnChange(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fs := files.NewSet("default", db)
+	fs.Replace(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "a", Version: protocol.Vector{{ID: 1, Value: 1}}}})
+
+	conn := indexRecordingConnection{
+		FakeConnection: FakeConnection{id: device1},
+		updates:        make(chan []protocol.FileInfo, 10),
+	}
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	startLocalVer := fs.LocalVersion(protocol.LocalDeviceID)
+	go func() {
+		sendIndexes(conn, closed, "default", fs, nil, startLocalVer)
+		close(done)
+	}()
+
+	// The remote device is already up to date, so a change is sent as an
+	// update as soon as it happens.
+
+	fs.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "b", Version: protocol.Vector{{ID: 1, Value: 1}}}})
+
+	select {
+	case up := <-conn.updates:
+		if len(up) != 1 || up[0].Name != "b" {
+			t.Errorf("Incorrect index update %v", up)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for index update")
+	}
+
+	close(closed)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendIndexes did not exit on close")
+	}
+}
+
+// droppingConnection records the index messages sent over it, and fails
+// after the given number of them as if the connection went away.
+type droppingConnection struct {
+	FakeConnection
+	sent  *[][]protocol.FileInfo
+	after int
+}
+
+func (c droppingConnection) Index(folder string, fs []protocol.FileInfo) error {
+	return c.IndexUpdate(folder, fs)
+}
+
+func (c droppingConnection) IndexUpdate(folder string, fs []protocol.FileInfo) error {
+	if len(*c.sent) == c.after {
+		return protocol.ErrClosed
+	}
+	*c.sent = append(*c.sent, fs)
+	return nil
+}
+
+func TestSendIndexResume(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fs := files.NewSet("default", db)
+
+	// Files are changed in the reverse order of their names, so the file
+	// with the last name has the lowest local version.
+	n := indexBatchSize + 10
+	for i := n - 1; i >= 0; i-- {
+		fs.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: fmt.Sprintf("f%04d", i), Version: protocol.Vector{{ID: 1, Value: 1}}}})
+	}
+
+	// The connection drops after the first batch
+	var sent [][]protocol.FileInfo
+	conn := droppingConnection{FakeConnection{id: device1}, &sent, 1}
+	maxLocalVer, err := sendIndexTo(true, 0, conn, "default", fs, nil)
+	if err != protocol.ErrClosed || len(sent) != 1 {
+		t.Fatalf("unexpected result %v after %d batches", err, len(sent))
+	}
+
+	// The remote device has seen up to the highest local version it got
+	var seen uint64
+	have := make(map[string]bool)
+	for _, f := range sent[0] {
+		if f.LocalVersion > seen {
+			seen = f.LocalVersion
+		}
+		have[f.Name] = true
+	}
+	if seen != maxLocalVer {
+		t.Errorf("returned local version %d, but the device has seen up to %d", maxLocalVer, seen)
+	}
+
+	// On reconnect it gets everything it's missing
+	sent = nil
+	conn.after = -1
+	if _, err := sendIndexTo(false, seen, conn, "default", fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range sent {
+		for _, f := range batch {
+			have[f.Name] = true
+		}
+	}
+	if len(have) != n {
+		t.Errorf("the device has %d files after resuming, expected %d", len(have), n)
+	}
+}
+
+// indexCountingConnection reports each initial index sent over it.
+type indexCountingConnection struct {
+	FakeConnection
+	indexes chan string
+}
+
+func (c indexCountingConnection) Index(folder string, fs []protocol.FileInfo) error {
+	c.indexes <- folder
+	return nil
+}
+
+func TestClusterConfigOneSender(t *testing.T) {
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}}
+	cfg.Folders = []config.FolderConfiguration{{
+		ID:      "default",
+		Path:    "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	}}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	conn := indexCountingConnection{FakeConnection{id: device2}, make(chan string, 10)}
+	m.AddConnection(conn, conn)
+	defer m.Close(device2, protocol.ErrClosed)
+
+	// The device sends its cluster config twice over the same connection
+	cm := protocol.ClusterConfigMessage{Folders: []protocol.Folder{{ID: "default"}}}
+	m.ClusterConfig(device2, cm)
+	m.ClusterConfig(device2, cm)
+
+	select {
+	case <-conn.indexes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no index sent")
+	}
+	select {
+	case <-conn.indexes:
+		t.Error("a second index sender was started for the connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
 func TestIgnores(t *testing.T) {
 	arrEqual := func(a, b []string) bool {
 		if len(a) != len(b) {
@@ -394,7 +692,7 @@ func TestIgnores(t *testing.T) {
 	cfg := config.Wrap("/tmp", config.Configuration{
 		Folders: []config.FolderConfiguration{fcfg},
 	})
-	m := NewModel(cfg, "device", "syncthing", "dev", db)
+	m := NewModel(cfg, device1, "device", "syncthing", "dev", db)
 	m.AddFolder(fcfg)
 
 	expected := []string{
@@ -464,3 +762,190 @@ func TestIgnores(t *testing.T) {
 		t.Errorf("Expected no ignores, got: %v", ignores)
 	}
 }
+
+func TestWatcherIgnores(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata"}
+	cfg := config.Wrap("/tmp", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+	})
+	m := NewModel(cfg, device1, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	ignoredFn := m.watchIgnored("default")
+	ignored := map[string]bool{
+		"foo":             false,
+		"dir/foo":         false,
+		".stignore":       false,
+		"quux":            true,
+		".hidden":         true,
+		".stfolder":       true,
+		".stversions":     true,
+		"dir/.stversions": true,
+	}
+	ignored[defTempNamer.TempName("foo")] = true
+	ignored[defTempNamer.TempName("dir/foo")] = true
+	for name, exp := range ignored {
+		name = filepath.FromSlash(name)
+		if res := ignoredFn(name); res != exp {
+			t.Errorf("Ignored(%q) == %v, expected %v", name, res, exp)
+		}
+	}
+}
+
+func TestPendingOffers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{{DeviceID: device1}}
+	wrapper := config.Wrap(filepath.Join(dir, "config.xml"), cfg)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(wrapper, device1, "device", "syncthing", "dev", db)
+
+	// An unknown device connects and is accepted
+
+	m.RecordPendingDevice(device2, "other", "192.0.2.1:22000", []string{"shared"})
+	devs := m.PendingDevices()
+	if len(devs) != 1 || devs[0].DeviceID != device2 || devs[0].Name != "other" || devs[0].Address != "192.0.2.1:22000" {
+		t.Fatalf("incorrect pending devices %+v", devs)
+	}
+	if len(devs[0].Folders) != 1 || devs[0].Folders[0] != "shared" {
+		t.Errorf("incorrect pending folders %v", devs[0].Folders)
+	}
+
+	if err := m.AcceptPendingDevice(device2, ""); err != nil {
+		t.Fatal(err)
+	}
+	if dev, ok := wrapper.Devices()[device2]; !ok || dev.Name != "other" {
+		t.Errorf("device not added to config: %+v", dev)
+	}
+	if devs := m.PendingDevices(); len(devs) != 0 {
+		t.Errorf("device still pending: %+v", devs)
+	}
+
+	// It shares two folders with us; one is accepted, one is ignored
+
+	m.ClusterConfig(device2, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "shared"}, {ID: "other"}},
+		Options: []protocol.Option{{Key: "name", Value: "other"}},
+	})
+	folders := m.PendingFolders()
+	if len(folders) != 2 {
+		t.Fatalf("incorrect pending folders %+v", folders)
+	}
+	for _, f := range folders {
+		if f.DeviceID != device2 || f.DeviceName != "other" {
+			t.Errorf("incorrect pending folder %+v", f)
+		}
+	}
+
+	if err := m.AcceptPendingFolder("shared", device2, ""); err != ErrEmptyPath {
+		t.Errorf("unexpected error %v for empty path", err)
+	}
+	if err := m.AcceptPendingFolder("shared", device2, filepath.Join(dir, "shared")); err != nil {
+		t.Fatal(err)
+	}
+	fcfg, ok := wrapper.Folders()["shared"]
+	if !ok || len(fcfg.Devices) != 2 || fcfg.Devices[1].DeviceID != device2 {
+		t.Errorf("folder not added to config: %+v", fcfg)
+	}
+	if err := m.IgnorePendingFolder("other", device2); err != nil {
+		t.Fatal(err)
+	}
+	if folders := m.PendingFolders(); len(folders) != 0 {
+		t.Errorf("folders still pending: %+v", folders)
+	}
+
+	// Ignored offers stay ignored
+
+	m.ClusterConfig(device2, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "other"}},
+	})
+	if folders := m.PendingFolders(); len(folders) != 0 {
+		t.Errorf("ignored folder offered again: %+v", folders)
+	}
+	if err := m.AcceptPendingFolder("missing", device2, dir); err != ErrNoSuchOffer {
+		t.Errorf("unexpected error %v for missing offer", err)
+	}
+}
+
+func TestPendingLimits(t *testing.T) {
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
+
+	// Made up devices don't fill the database
+	for i := 0; i < maxPendingDevices+10; i++ {
+		m.RecordPendingDevice(protocol.NewDeviceID([]byte{byte(i), byte(i >> 8)}), "", "192.0.2.1:22000", nil)
+	}
+	if devs := m.PendingDevices(); len(devs) != maxPendingDevices {
+		t.Errorf("%d pending devices, expected %d", len(devs), maxPendingDevices)
+	}
+
+	// Values longer than the database record allows are cut down
+	long := strings.Repeat("ä", 100)
+	folders := make([]string, 100)
+	longDevice := protocol.NewDeviceID([]byte("long"))
+	m.RecordPendingDevice(longDevice, long, strings.Repeat("a", 1000), folders)
+	var found bool
+	for _, dev := range m.PendingDevices() {
+		if dev.DeviceID != longDevice {
+			continue
+		}
+		found = true
+		if len(dev.Name) != 64 || !strings.HasPrefix(long, dev.Name) {
+			t.Errorf("incorrectly truncated name %q", dev.Name)
+		}
+		if len(dev.Address) != 256 || len(dev.Folders) != 64 {
+			t.Errorf("incorrectly truncated address or folders, %d bytes, %d folders", len(dev.Address), len(dev.Folders))
+		}
+	}
+	if !found {
+		t.Error("device with a long name not recorded")
+	}
+	m.ClusterConfig(device2, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "long"}},
+		Options: []protocol.Option{{Key: "name", Value: long}},
+	})
+	if pf := m.PendingFolders(); len(pf) != 1 || len(pf[0].DeviceName) != 64 {
+		t.Errorf("incorrect pending folders %+v", pf)
+	}
+
+	// A folder offered on every reconnect is only announced once
+	sub := events.Default.Subscribe(events.FolderRejected)
+	defer events.Default.Unsubscribe(sub)
+	for i := 0; i < 2; i++ {
+		m.ClusterConfig(device2, protocol.ClusterConfigMessage{
+			Folders: []protocol.Folder{{ID: "offered"}},
+		})
+	}
+	if _, err := sub.Poll(time.Second); err != nil {
+		t.Fatal("no event for the offered folder:", err)
+	}
+	if _, err := sub.Poll(100 * time.Millisecond); err != events.ErrTimeout {
+		t.Error("unexpected event for a folder offered again")
+	}
+
+	// The offer is only written again on a new connection
+	key := pendingFolderKey(device2, "offered")
+	rec, _ := m.getPending(key)
+	rec.Time = 1
+	m.putPending(key, rec)
+	cm := protocol.ClusterConfigMessage{Folders: []protocol.Folder{{ID: "offered"}}}
+	m.ClusterConfig(device2, cm)
+	if rec, _ := m.getPending(key); rec.Time != 1 {
+		t.Error("offer updated by a repeated cluster config")
+	}
+	m.Close(device2, protocol.ErrClosed)
+	m.ClusterConfig(device2, cm)
+	if rec, _ := m.getPending(key); rec.Time == 1 {
+		t.Error("offer not updated on a new connection")
+	}
+}
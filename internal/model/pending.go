@@ -0,0 +1,313 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The most pending devices that are remembered. Anyone can make up a device
+// ID and connect, so when there are more the oldest offers are forgotten.
+const maxPendingDevices = 100
+
+var (
+	ErrNoSuchOffer  = errors.New("no such pending offer")
+	ErrFolderExists = errors.New("folder already exists")
+	ErrDeviceExists = errors.New("device already exists")
+	ErrEmptyPath    = errors.New("folder path must be given")
+)
+
+// A PendingDevice is a device that connected to us without being in the
+// configuration.
+type PendingDevice struct {
+	DeviceID protocol.DeviceID
+	Name     string
+	Address  string
+	Folders  []string // the folders the device shares with us
+	Time     time.Time
+}
+
+// A PendingFolder is a folder that a configured device shares with us, but
+// which we don't have.
+type PendingFolder struct {
+	ID         string
+	DeviceID   protocol.DeviceID
+	DeviceName string
+	Time       time.Time
+}
+
+func (m *Model) getPending(key []byte) (pendingRecord, bool) {
+	var rec pendingRecord
+	bs, err := m.db.Get(key, nil)
+	if err != nil {
+		return rec, false
+	}
+	if err := rec.UnmarshalXDR(bs); err != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+func (m *Model) putPending(key []byte, rec pendingRecord) error {
+	rec.truncate()
+	bs, err := rec.MarshalXDR()
+	if err != nil {
+		return err
+	}
+	return m.db.Put(key, bs, nil)
+}
+
+// RecordPendingDevice remembers that the given device, which is not in the
+// configuration, tried to connect to us from the given address.
+func (m *Model) RecordPendingDevice(device protocol.DeviceID, name, address string, folders []string) {
+	key := pendingDeviceKey(device)
+	rec, existing := m.getPending(key)
+	if rec.Ignored {
+		if debug {
+			l.Debugln("pending: ignoring offer from device", device)
+		}
+		return
+	}
+	if !existing {
+		m.prunePendingDevices(maxPendingDevices - 1)
+	}
+
+	rec.Name = name
+	rec.Address = address
+	rec.Folders = folders
+	rec.Time = time.Now().Unix()
+	if err := m.putPending(key, rec); err != nil {
+		l.Warnln("Recording pending device:", err)
+	}
+}
+
+// prunePendingDevices forgets the oldest pending devices, so that no more
+// than max remain. Ignored devices are kept, and don't count.
+func (m *Model) prunePendingDevices(max int) {
+	type pending struct {
+		key  []byte
+		time int64
+	}
+	var recs []pending
+	m.iteratePending(keyTypePendingDevice, func(key []byte, rec pendingRecord) {
+		if !rec.Ignored {
+			recs = append(recs, pending{append([]byte(nil), key...), rec.Time})
+		}
+	})
+	for len(recs) > max {
+		oldest := 0
+		for i := range recs {
+			if recs[i].time < recs[oldest].time {
+				oldest = i
+			}
+		}
+		if debug {
+			l.Debugf("pending: forgetting device %x", recs[oldest].key[1:])
+		}
+		m.db.Delete(recs[oldest].key, nil)
+		recs = append(recs[:oldest], recs[oldest+1:]...)
+	}
+}
+
+// recordPendingFolder remembers that the given device shares a folder with
+// us that we don't have. The user is only told about it the first time. The
+// time of the offer is only updated when refresh is true, which is once per
+// connection, or when the device name changed.
+func (m *Model) recordPendingFolder(device protocol.DeviceID, folder, name string, refresh bool) {
+	key := pendingFolderKey(device, folder)
+	rec, existing := m.getPending(key)
+	if rec.Ignored {
+		if debug {
+			l.Debugf("pending: ignoring offer of folder %q from device %v", folder, device)
+		}
+		return
+	}
+
+	oldName := rec.Name
+	rec.Name = name
+	rec.truncate()
+	if existing && !refresh && rec.Name == oldName {
+		return
+	}
+
+	rec.Time = time.Now().Unix()
+	if err := m.putPending(key, rec); err != nil {
+		l.Warnln("Recording pending folder:", err)
+		return
+	}
+	if existing {
+		return
+	}
+
+	events.Default.Log(events.FolderRejected, map[string]string{
+		"folder": folder,
+		"device": device.String(),
+	})
+	l.Infof("Device %v shares unknown folder %q; it is available to be accepted.", device, folder)
+}
+
+// PendingDevices returns the devices that have tried to connect to us and
+// are neither configured nor ignored.
+func (m *Model) PendingDevices() []PendingDevice {
+	devices := m.cfg.Devices()
+	var res []PendingDevice
+	m.iteratePending(keyTypePendingDevice, func(key []byte, rec pendingRecord) {
+		var id protocol.DeviceID
+		copy(id[:], key[1:])
+		if _, ok := devices[id]; ok || rec.Ignored {
+			return
+		}
+		res = append(res, PendingDevice{
+			DeviceID: id,
+			Name:     rec.Name,
+			Address:  rec.Address,
+			Folders:  rec.Folders,
+			Time:     time.Unix(rec.Time, 0),
+		})
+	})
+	return res
+}
+
+// PendingFolders returns the folders that are shared with us by configured
+// devices and that we neither have nor have ignored.
+func (m *Model) PendingFolders() []PendingFolder {
+	devices := m.cfg.Devices()
+	folders := m.cfg.Folders()
+	var res []PendingFolder
+	m.iteratePending(keyTypePendingFolder, func(key []byte, rec pendingRecord) {
+		var id protocol.DeviceID
+		copy(id[:], key[1:])
+		folder := string(key[1+32:])
+		if _, ok := folders[folder]; ok || rec.Ignored {
+			return
+		}
+		if _, ok := devices[id]; !ok {
+			return
+		}
+		res = append(res, PendingFolder{
+			ID:         folder,
+			DeviceID:   id,
+			DeviceName: rec.Name,
+			Time:       time.Unix(rec.Time, 0),
+		})
+	})
+	return res
+}
+
+func (m *Model) iteratePending(keyType byte, fn func(key []byte, rec pendingRecord)) {
+	it := m.db.NewIterator(util.BytesPrefix([]byte{keyType}), nil)
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()
+		if len(key) < 1+32 {
+			continue
+		}
+		var rec pendingRecord
+		if err := rec.UnmarshalXDR(it.Value()); err != nil {
+			if debug {
+				l.Debugln("pending: bad record:", err)
+			}
+			continue
+		}
+		fn(key, rec)
+	}
+}
+
+// AcceptPendingDevice adds the pending device to the configuration, under
+// the given name or the name it announced if none is given.
+func (m *Model) AcceptPendingDevice(device protocol.DeviceID, name string) error {
+	if _, ok := m.cfg.Devices()[device]; ok {
+		return ErrDeviceExists
+	}
+	key := pendingDeviceKey(device)
+	rec, ok := m.getPending(key)
+	if !ok {
+		return ErrNoSuchOffer
+	}
+	if name == "" {
+		name = rec.Name
+	}
+
+	l.Infof("Adding device %v to config (accepted pending offer)", device)
+	m.cfg.SetDevice(config.DeviceConfiguration{
+		DeviceID:    device,
+		Name:        name,
+		Addresses:   []string{"dynamic"},
+		Compression: true,
+	})
+	if err := m.cfg.Save(); err != nil {
+		return err
+	}
+	return m.db.Delete(key, nil)
+}
+
+// IgnorePendingDevice drops the pending device and stops it from being
+// offered again.
+func (m *Model) IgnorePendingDevice(device protocol.DeviceID) error {
+	return m.ignorePending(pendingDeviceKey(device))
+}
+
+// AcceptPendingFolder adds the folder offered by the device to the
+// configuration, at the given path and shared with the device. The folder is
+// started on the next restart.
+func (m *Model) AcceptPendingFolder(folder string, device protocol.DeviceID, path string) error {
+	if path == "" {
+		return ErrEmptyPath
+	}
+	if _, ok := m.cfg.Folders()[folder]; ok {
+		return ErrFolderExists
+	}
+	key := pendingFolderKey(device, folder)
+	if _, ok := m.getPending(key); !ok {
+		return ErrNoSuchOffer
+	}
+
+	l.Infof("Adding folder %q to config (accepted pending offer from %v)", folder, device)
+	m.cfg.SetFolder(config.FolderConfiguration{
+		ID:              folder,
+		Path:            path,
+		RescanIntervalS: 60,
+		Devices: []config.FolderDeviceConfiguration{
+			{DeviceID: m.id},
+			{DeviceID: device},
+		},
+	})
+	if err := m.cfg.Save(); err != nil {
+		return err
+	}
+	return m.db.Delete(key, nil)
+}
+
+// IgnorePendingFolder drops the folder offered by the device and stops it
+// from being offered again.
+func (m *Model) IgnorePendingFolder(folder string, device protocol.DeviceID) error {
+	return m.ignorePending(pendingFolderKey(device, folder))
+}
+
+func (m *Model) ignorePending(key []byte) error {
+	rec, ok := m.getPending(key)
+	if !ok {
+		return ErrNoSuchOffer
+	}
+	rec.Ignored = true
+	return m.putPending(key, rec)
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"unicode/utf8"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// Same key space as files/leveldb.go keyType* constants
+const (
+	keyTypePendingDevice = iota + 50
+	keyTypePendingFolder
+)
+
+// pendingRecord is the database representation of a pending device or
+// folder offer. Ignored offers are kept so that they aren't offered again.
+type pendingRecord struct {
+	Name    string   // max:64
+	Address string   // max:256
+	Folders []string // max:64
+	Time    int64
+	Ignored bool
+}
+
+// truncate cuts the record down to the sizes allowed by its encoding. The
+// values come from other devices, which may send longer ones.
+func (r *pendingRecord) truncate() {
+	r.Name = truncateString(r.Name, 64)
+	r.Address = truncateString(r.Address, 256)
+	if len(r.Folders) > 64 {
+		r.Folders = r.Folders[:64]
+	}
+}
+
+// truncateString returns at most max bytes of s, without splitting a
+// character.
+func truncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// pendingDeviceKey returns a byte slice encoding the following information:
+//
+//	keyTypePendingDevice (1 byte)
+//	device (32 bytes)
+func pendingDeviceKey(device protocol.DeviceID) []byte {
+	k := make([]byte, 1+32)
+	k[0] = keyTypePendingDevice
+	copy(k[1:], device[:])
+	return k
+}
+
+// pendingFolderKey returns a byte slice encoding the following information:
+//
+//	keyTypePendingFolder (1 byte)
+//	device (32 bytes)
+//	folder (variable size)
+func pendingFolderKey(device protocol.DeviceID, folder string) []byte {
+	k := make([]byte, 1+32+len(folder))
+	k[0] = keyTypePendingFolder
+	copy(k[1:], device[:])
+	copy(k[1+32:], folder)
+	return k
+}
@@ -0,0 +1,229 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// PullerProgress is the progress of a single file being pulled. Everything
+// but the byte counts is counted in blocks.
+type PullerProgress struct {
+	Total               int   `json:"total"`
+	Reused              int   `json:"reused"`
+	CopiedFromOrigin    int   `json:"copiedFromOrigin"`
+	CopiedFromElsewhere int   `json:"copiedFromElsewhere"`
+	Pulled              int   `json:"pulled"`
+	Pulling             int   `json:"pulling"`
+	BytesDone           int64 `json:"bytesDone"`
+	BytesTotal          int64 `json:"bytesTotal"`
+}
+
+// transferred returns the number of bytes copied or pulled, i.e. those done
+// but not reused from a previous temporary file.
+func (p PullerProgress) transferred() int64 {
+	reused := int64(p.Reused) * protocol.BlockSize
+	if reused > p.BytesTotal {
+		reused = p.BytesTotal
+	}
+	return p.BytesDone - reused
+}
+
+// FolderProgress is the progress of the files currently being pulled in a
+// folder.
+type FolderProgress struct {
+	Files          map[string]PullerProgress `json:"files"`
+	BytesDone      int64                     `json:"bytesDone"`
+	BytesTotal     int64                     `json:"bytesTotal"`
+	BytesPerSecond int64                     `json:"bytesPerSecond"` // Copied or pulled, between the last two updates
+}
+
+// A progressTracker keeps track of the files being pulled in a folder. Files
+// are registered when the puller starts on them and forgotten when they are
+// closed, successfully or not.
+type progressTracker struct {
+	states      map[string]*sharedPullerState
+	sent        map[string]sentProgress // What has been advertised to other devices
+	transferred int64                   // Bytes transferred for files no longer tracked
+	lastBytes   int64                   // Bytes transferred in total, as of the last update
+	lastUpdate  time.Time
+	rate        int64
+	mut         sync.Mutex
+}
+
+type sentProgress struct {
+	state  *sharedPullerState
+	blocks int // Number of available blocks advertised
+}
+
+func (t *progressTracker) register(s *sharedPullerState) {
+	t.mut.Lock()
+	if t.states == nil {
+		t.states = make(map[string]*sharedPullerState)
+	}
+	t.states[s.file.Name] = s
+	t.mut.Unlock()
+}
+
+func (t *progressTracker) deregister(s *sharedPullerState) {
+	t.mut.Lock()
+	t.forgetLocked(s)
+	t.mut.Unlock()
+}
+
+func (t *progressTracker) forgetLocked(s *sharedPullerState) {
+	if t.states[s.file.Name] != s {
+		return
+	}
+	delete(t.states, s.file.Name)
+	t.transferred += s.progress().transferred()
+}
+
+// update recalculates the transfer rate and returns the current progress.
+func (t *progressTracker) update() FolderProgress {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	prog, transferred := t.progressLocked()
+
+	now := time.Now()
+	if !t.lastUpdate.IsZero() {
+		if d := now.Sub(t.lastUpdate); d > 0 {
+			t.rate = int64(float64(transferred-t.lastBytes) / d.Seconds())
+		}
+	}
+	t.lastBytes = transferred
+	t.lastUpdate = now
+
+	prog.BytesPerSecond = t.rate
+	return prog
+}
+
+// snapshot returns the current progress, with the transfer rate as of the
+// last update.
+func (t *progressTracker) snapshot() FolderProgress {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	prog, _ := t.progressLocked()
+	prog.BytesPerSecond = t.rate
+	return prog
+}
+
+func (t *progressTracker) progressLocked() (FolderProgress, int64) {
+	t.pruneLocked()
+
+	prog := FolderProgress{
+		Files: make(map[string]PullerProgress, len(t.states)),
+	}
+	transferred := t.transferred
+	for name, s := range t.states {
+		p := s.progress()
+		prog.Files[name] = p
+		prog.BytesDone += p.BytesDone
+		prog.BytesTotal += p.BytesTotal
+		transferred += p.transferred()
+	}
+	if len(prog.Files) == 0 {
+		t.rate = 0
+	}
+	return prog, transferred
+}
+
+// pruneLocked forgets about closed files. Files that failed are closed but
+// may never reach a finisher to be deregistered.
+func (t *progressTracker) pruneLocked() {
+	for _, s := range t.states {
+		if s.isClosed() {
+			t.forgetLocked(s)
+		}
+	}
+}
+
+// advertise returns the updates to send to other devices since the last
+// call; blocks that have become available in files being pulled, and the
+// files that are no longer being pulled.
+func (t *progressTracker) advertise() []protocol.FileDownloadProgressUpdate {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	t.pruneLocked()
+	if t.sent == nil {
+		t.sent = make(map[string]sentProgress)
+	}
+
+	var updates []protocol.FileDownloadProgressUpdate
+	for name, sent := range t.sent {
+		if t.states[name] != sent.state {
+			updates = append(updates, protocol.FileDownloadProgressUpdate{
+				UpdateType: protocol.UpdateTypeForget,
+				Name:       name,
+				Version:    sent.state.file.Version,
+			})
+			delete(t.sent, name)
+		}
+	}
+
+	for name, s := range t.states {
+		sent := t.sent[name]
+		blocks := s.availableBlocks(sent.blocks)
+		if len(blocks) == 0 {
+			continue
+		}
+		updates = append(updates, protocol.FileDownloadProgressUpdate{
+			UpdateType:   protocol.UpdateTypeAppend,
+			Name:         name,
+			Version:      s.file.Version,
+			BlockIndexes: blocks,
+		})
+		t.sent[name] = sentProgress{s, sent.blocks + len(blocks)}
+	}
+
+	return updates
+}
+
+// advertised returns everything advertised so far, for devices that connect
+// after the fact.
+func (t *progressTracker) advertised() []protocol.FileDownloadProgressUpdate {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	updates := make([]protocol.FileDownloadProgressUpdate, 0, len(t.sent))
+	for name, sent := range t.sent {
+		updates = append(updates, protocol.FileDownloadProgressUpdate{
+			UpdateType:   protocol.UpdateTypeAppend,
+			Name:         name,
+			Version:      sent.state.file.Version,
+			BlockIndexes: sent.state.availableBlocks(0)[:sent.blocks],
+		})
+	}
+	return updates
+}
+
+// readBlock reads a block of a file being pulled from its temp file.
+func (t *progressTracker) readBlock(name string, offset int64, size int) ([]byte, error) {
+	t.mut.Lock()
+	s, ok := t.states[name]
+	t.mut.Unlock()
+
+	if !ok {
+		return nil, ErrNoSuchFile
+	}
+	return s.readBlock(offset, size)
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+func TestProgressTracker(t *testing.T) {
+	file := protocol.FileInfo{
+		Name: "file",
+		Blocks: []protocol.BlockInfo{
+			{Offset: 0, Size: protocol.BlockSize},
+			{Offset: protocol.BlockSize, Size: protocol.BlockSize},
+			{Offset: 2 * protocol.BlockSize, Size: protocol.BlockSize},
+			{Offset: 3 * protocol.BlockSize, Size: 1000},
+		},
+	}
+	size := 3*protocol.BlockSize + 1000
+
+	// One block reused from a previous temporary file, one copied from the
+	// original file and two pulled, of which one is still outstanding.
+	s := &sharedPullerState{
+		file:       file,
+		reused:     1,
+		copyTotal:  3,
+		copyNeeded: 3,
+		available:  []uint32{0},
+	}
+	s.copiedFromOrigin()
+	s.copyDone(file.Blocks[1])
+	s.pullStarted()
+	s.pullStarted()
+	s.pullDone(file.Blocks[2])
+
+	var pt progressTracker
+	pt.register(s)
+
+	prog := pt.update()
+	expected := PullerProgress{
+		Total:            4,
+		Reused:           1,
+		CopiedFromOrigin: 1,
+		Pulled:           1,
+		Pulling:          1,
+		BytesDone:        3 * protocol.BlockSize,
+		BytesTotal:       int64(size),
+	}
+	if p := prog.Files["file"]; p != expected {
+		t.Errorf("incorrect file progress\n  got: %+v\n  expected: %+v", p, expected)
+	}
+	if prog.BytesDone != expected.BytesDone || prog.BytesTotal != expected.BytesTotal {
+		t.Errorf("incorrect folder progress %d/%d", prog.BytesDone, prog.BytesTotal)
+	}
+
+	// Completing the file caps the bytes done at the file size. Once closed
+	// the file is forgotten, but the bytes transferred are kept.
+	s.pullDone(file.Blocks[3])
+	if p := s.progress(); p.BytesDone != int64(size) {
+		t.Errorf("incorrect bytes done %d, expected %d", p.BytesDone, size)
+	}
+	if closed, err := s.finalClose(); !closed || err != nil {
+		t.Fatal("file not closed:", closed, err)
+	}
+
+	prog = pt.snapshot()
+	if len(prog.Files) != 0 {
+		t.Errorf("closed file still tracked: %+v", prog.Files)
+	}
+	if exp := int64(size) - protocol.BlockSize; pt.transferred != exp {
+		t.Errorf("incorrect bytes transferred %d, expected %d", pt.transferred, exp)
+	}
+}
+
+func TestProgressAdvertise(t *testing.T) {
+	file := protocol.FileInfo{
+		Name:    "file",
+		Version: protocol.Vector{{ID: 1, Value: 1}},
+		Blocks: []protocol.BlockInfo{
+			{Offset: 0, Size: protocol.BlockSize},
+			{Offset: protocol.BlockSize, Size: protocol.BlockSize},
+			{Offset: 2 * protocol.BlockSize, Size: 1000},
+		},
+	}
+	s := &sharedPullerState{
+		file:       file,
+		reused:     1,
+		copyTotal:  2,
+		copyNeeded: 2,
+		available:  []uint32{0},
+	}
+
+	var pt progressTracker
+	pt.register(s)
+
+	updates := pt.advertise()
+	if len(updates) != 1 || updates[0].UpdateType != protocol.UpdateTypeAppend || !reflect.DeepEqual(updates[0].BlockIndexes, []uint32{0}) {
+		t.Fatalf("incorrect initial updates %+v", updates)
+	}
+
+	// Only what is new since the last call is advertised.
+	if updates := pt.advertise(); len(updates) != 0 {
+		t.Errorf("unexpected updates %+v", updates)
+	}
+	s.copyDone(file.Blocks[2])
+	updates = pt.advertise()
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].BlockIndexes, []uint32{2}) {
+		t.Errorf("incorrect updates %+v", updates)
+	}
+
+	// Devices connecting now get everything at once.
+	updates = pt.advertised()
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].BlockIndexes, []uint32{0, 2}) {
+		t.Errorf("incorrect advertised progress %+v", updates)
+	}
+
+	// A file that is no longer pulled is forgotten.
+	s.earlyClose("test", errors.New("test"))
+	updates = pt.advertise()
+	if len(updates) != 1 || updates[0].UpdateType != protocol.UpdateTypeForget || updates[0].Name != "file" {
+		t.Errorf("incorrect updates %+v", updates)
+	}
+	if updates := pt.advertised(); len(updates) != 0 {
+		t.Errorf("unexpected advertised progress %+v", updates)
+	}
+}
@@ -17,10 +17,13 @@ package model
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,10 +31,12 @@ import (
 
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/files"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/versioner"
+	"github.com/syncthing/syncthing/internal/watcher"
 )
 
 // TODO: Stop on errors
@@ -41,8 +46,7 @@ const (
 	pullersPerFolder   = 16
 	finishersPerFolder = 2
 	pauseIntv          = 60 * time.Second
-	nextPullIntv       = 10 * time.Second
-	checkPullIntv      = 1 * time.Second
+	shortPullIntv      = 100 * time.Millisecond
 )
 
 // A pullBlockState is passed to the puller routine for each block that needs
@@ -60,19 +64,50 @@ type copyBlocksState struct {
 }
 
 var (
-	activity    = newDeviceActivity()
-	errNoDevice = errors.New("no available source device")
+	activity     = newDeviceActivity()
+	errNoDevice  = errors.New("no available source device")
+	errNotDir    = errors.New("should be dir, but is not")
+	errBlockHash = errors.New("block data does not match the expected hash")
 )
 
+// A FileError is an error that prevented a file from being synced.
+type FileError struct {
+	Path string    `json:"path"`
+	Err  string    `json:"error"`
+	Time time.Time `json:"time"`
+}
+
 type Puller struct {
-	folder        string
-	dir           string
-	scanIntv      time.Duration
-	model         *Model
-	stop          chan struct{}
-	versioner     versioner.Versioner
-	ignorePerms   bool
-	lenientMtimes bool
+	folder         string
+	dir            string
+	scanIntv       time.Duration
+	model          *Model
+	stop           chan struct{}
+	versioner      versioner.Versioner
+	ignorePerms    bool
+	ignoreSymlinks bool
+	lenientMtimes  bool
+	watcher        *watcher.Watcher
+	revert         chan struct{}
+	connected      chan struct{} // a device sharing the folder connected
+	maxDeletes     int
+	maxDeletesPct  int
+	progressIntv   time.Duration // 0 for no DownloadProgress events
+	order          config.PullOrder
+	minDiskFree    config.Size
+	spaceErr       error // Why the folder can't be pulled, when the disk is full
+
+	deletionsAction    chan bool // true to confirm, false to abort
+	deletionsMut       sync.Mutex
+	pendingDeletions   []string        // Deletions held back, awaiting confirmation
+	confirmedDeletions map[string]bool // Held deletions that may be performed regardless of the limits
+
+	errorsMut  sync.Mutex
+	curErrors  map[string]FileError // Errors from the running iteration
+	fileErrors []FileError          // Errors from the last finished iteration
+
+	progress progressTracker
+	retries  retryTracker
 }
 
 // Serve will run scans and pulls. It will return when Stop()ed or on a
@@ -85,13 +120,42 @@ func (p *Puller) Serve() {
 
 	p.stop = make(chan struct{})
 
-	pullTimer := time.NewTimer(checkPullIntv)
+	// The pull timer is only armed when there is reason to believe that we
+	// need to pull something; a change in a remote index, the initial scan
+	// completing or a previous pull not being able to complete.
+	pullTimer := time.NewTimer(time.Hour)
+	pullTimer.Stop()
+	pullScheduled := false
+	schedulePull := func(intv time.Duration) {
+		pullTimer.Reset(intv)
+		pullScheduled = true
+	}
 	scanTimer := time.NewTimer(time.Millisecond) // The first scan should be done immediately.
+	retryTimer := time.NewTimer(time.Hour)       // Armed while there are failed files to retry.
+	retryTimer.Stop()
 	cleanTimer := time.NewTicker(time.Hour)
 
+	p.model.fmut.RLock()
+	fs := p.model.folderFiles[p.folder]
+	p.model.fmut.RUnlock()
+	remoteChanged := fs.Subscribe(files.RemoteChanges)
+	defer fs.Unsubscribe(remoteChanged)
+
+	if p.progressIntv > 0 {
+		go p.reportProgress(p.stop)
+	}
+
+	var watchChanges <-chan []string
+	if p.watcher != nil {
+		go p.watcher.Serve()
+		defer p.watcher.Stop()
+		watchChanges = p.watcher.Changes()
+	}
+
 	defer func() {
 		pullTimer.Stop()
 		scanTimer.Stop()
+		retryTimer.Stop()
 		cleanTimer.Stop()
 		// TODO: Should there be an actual FolderStopped state?
 		p.model.setState(p.folder, FolderIdle)
@@ -111,18 +175,22 @@ loop:
 		case <-p.stop:
 			return
 
-		// TODO: We could easily add a channel here for notifications from
-		// Index(), so that we immediately start a pull when new index
-		// information is available. Before that though, I'd like to build a
-		// repeatable benchmark of how long it takes to sync a change from
-		// device A to device B, so we have something to work against.
+		// A remote index was updated. Schedule a pull shortly, unless one is
+		// already scheduled. Updates arriving in the meantime are handled by
+		// that pull.
+		case <-remoteChanged:
+			if !pullScheduled {
+				schedulePull(shortPullIntv)
+			}
+
 		case <-pullTimer.C:
+			pullScheduled = false
+
 			if !initialScanCompleted {
-				// How did we even get here?
+				// We'll pull once the initial scan completes.
 				if debug {
 					l.Debugln(p, "skip (initial)")
 				}
-				pullTimer.Reset(nextPullIntv)
 				continue
 			}
 
@@ -132,10 +200,25 @@ loop:
 				if debug {
 					l.Debugln(p, "skip (curVer == prevVer)", prevVer)
 				}
-				pullTimer.Reset(checkPullIntv)
 				continue
 			}
 
+			// Pulling onto a full disk only leaves a trail of write errors
+			// and partial temporary files, so we wait until there is space.
+			if err := p.checkDiskSpace(); err != nil {
+				if errorString(err) != errorString(p.spaceErr) {
+					l.Warnf("Folder %q is not being pulled: %v", p.folder, err)
+				}
+				p.spaceErr = err
+				p.setIdleState()
+				schedulePull(pauseIntv)
+				continue
+			}
+			if p.spaceErr != nil {
+				l.Infof("Folder %q has enough free disk space again", p.folder)
+				p.spaceErr = nil
+			}
+
 			if debug {
 				l.Debugln(p, "pulling", prevVer, curVer)
 			}
@@ -150,43 +233,62 @@ loop:
 
 				if changed == 0 {
 					// No files were changed by the puller, so we are in
-					// sync. Remember the local version number and
-					// schedule a resync a little bit into the future.
+					// sync. Remember the local version number and wait
+					// for the next remote index change.
 
 					if lv := p.model.RemoteLocalVersion(p.folder); lv < curVer {
-						// There's a corner case where the device we needed
-						// files from disconnected during the puller
-						// iteration. The files will have been removed from
-						// the index, so we've concluded that we don't need
-						// them, but at the same time we have the local
-						// version that includes those files in curVer. So we
-						// catch the case that localVersion might have
-						// decresed here.
+						// There's a corner case where a device we needed
+						// files from reset its index during the puller
+						// iteration. Its index will have been dropped, so
+						// we've concluded that we don't need those files,
+						// but at the same time we have the local version
+						// that includes them in curVer. So we catch the case
+						// that localVersion might have decreased here.
 						l.Debugln(p, "adjusting curVer", lv)
 						curVer = lv
 					}
 					prevVer = curVer
-					if debug {
-						l.Debugln(p, "next pull in", nextPullIntv)
-					}
-					pullTimer.Reset(nextPullIntv)
 					break
 				}
 
 				if tries > 10 {
 					// We've tried a bunch of times to get in sync, but
-					// we're not making it. Probably there are write
-					// errors preventing us. Flag this with a warning and
-					// wait a bit longer before retrying.
+					// we're not making it. Files that fail are retried on
+					// their own, so something is changing the files
+					// under us. Flag this with a warning and wait a bit
+					// longer before retrying.
 					l.Warnf("Folder %q isn't making progress - check logs for possible root cause. Pausing puller for %v.", p.folder, pauseIntv)
 					if debug {
 						l.Debugln(p, "next pull in", pauseIntv)
 					}
-					pullTimer.Reset(pauseIntv)
+					schedulePull(pauseIntv)
 					break
 				}
 			}
-			p.model.setState(p.folder, FolderIdle)
+
+			// Files that failed are retried on their own schedule, without
+			// holding up the rest of the folder in the meantime.
+			if next, ok := p.retries.next(); ok {
+				intv := next.Sub(time.Now())
+				if intv < shortPullIntv {
+					intv = shortPullIntv
+				}
+				if debug {
+					l.Debugln(p, "next retry in", intv)
+				}
+				retryTimer.Reset(intv)
+			} else {
+				retryTimer.Stop()
+			}
+			p.setIdleState()
+
+		// Some failed files are due to be retried. The remote index hasn't
+		// necessarily changed, so the pull must happen regardless.
+		case <-retryTimer.C:
+			prevVer = 0
+			if !pullScheduled {
+				schedulePull(shortPullIntv)
+			}
 
 		// The reason for running the scanner from within the puller is that
 		// this is the easiest way to make sure we are not doing both at the
@@ -200,7 +302,7 @@ loop:
 				p.model.cfg.InvalidateFolder(p.folder, err.Error())
 				break loop
 			}
-			p.model.setState(p.folder, FolderIdle)
+			p.setIdleState()
 			if p.scanIntv > 0 {
 				if debug {
 					l.Debugln(p, "next rescan in", p.scanIntv)
@@ -210,8 +312,59 @@ loop:
 			if !initialScanCompleted {
 				l.Infoln("Completed initial scan (rw) of folder", p.folder)
 				initialScanCompleted = true
+				if !pullScheduled {
+					schedulePull(shortPullIntv)
+				}
+			}
+
+		// The filesystem watcher has seen changes. Rescan only the affected
+		// parts of the folder.
+		case subs := <-watchChanges:
+			if debug {
+				l.Debugln(p, "rescan", subs)
+			}
+			p.model.setState(p.folder, FolderScanning)
+			if err := p.model.scanFolderSubs(p.folder, subs); err != nil {
+				p.model.cfg.InvalidateFolder(p.folder, err.Error())
+				break loop
+			}
+			p.setIdleState()
+
+		// Local changes in a receive only folder should be reverted. We then
+		// need to pull the global versions, even if nothing changed
+		// remotely.
+		case <-p.revert:
+			p.model.setState(p.folder, FolderSyncing)
+			p.revertLocalChanges()
+			p.setIdleState()
+			prevVer = 0
+			if initialScanCompleted && !pullScheduled {
+				schedulePull(shortPullIntv)
+			}
+
+		// A device connected. It may have files that we couldn't pull while
+		// it was away, even though its index hasn't changed since.
+		case <-p.connected:
+			prevVer = 0
+			if initialScanCompleted && !pullScheduled {
+				schedulePull(shortPullIntv)
 			}
 
+		// The user has decided what to do about deletions that were held
+		// back. Confirmed deletions are performed by the next pull.
+		case confirm := <-p.deletionsAction:
+			if confirm {
+				p.confirmDeletions()
+				prevVer = 0
+				if !pullScheduled {
+					schedulePull(shortPullIntv)
+				}
+			} else {
+				p.model.setState(p.folder, FolderSyncing)
+				p.abortDeletions()
+			}
+			p.setIdleState()
+
 		// Clean out old temporaries
 		case <-cleanTimer.C:
 			p.clean()
@@ -219,22 +372,82 @@ loop:
 	}
 }
 
+// reportProgress emits a DownloadProgress event every progressIntv while
+// files are being pulled, and a final one when there no longer are any. The
+// blocks we have of those files are advertised to other devices at the same
+// time.
+func (p *Puller) reportProgress(stop chan struct{}) {
+	ticker := time.NewTicker(p.progressIntv)
+	defer ticker.Stop()
+
+	reported := false
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ticker.C:
+			if updates := p.progress.advertise(); len(updates) > 0 {
+				p.model.sendDownloadProgress(p.folder, updates)
+			}
+
+			prog := p.progress.update()
+			if len(prog.Files) == 0 && !reported {
+				continue
+			}
+			reported = len(prog.Files) > 0
+			events.Default.Log(events.DownloadProgress, map[string]interface{}{
+				"folder":   p.folder,
+				"progress": prog,
+			})
+		}
+	}
+}
+
+// Progress returns the progress of the files currently being pulled.
+func (p *Puller) Progress() FolderProgress {
+	return p.progress.snapshot()
+}
+
 func (p *Puller) Stop() {
 	close(p.stop)
 }
 
+// Revert requests that local changes be reverted. Requests made while a
+// revert is already pending are merged with it.
+func (p *Puller) Revert() {
+	select {
+	case p.revert <- struct{}{}:
+	default:
+	}
+}
+
+// deviceConnected requests a pull, as the device that connected may be the
+// only source for files that are still needed.
+func (p *Puller) deviceConnected() {
+	select {
+	case p.connected <- struct{}{}:
+	default:
+	}
+}
+
 func (p *Puller) String() string {
 	return fmt.Sprintf("puller/%s@%p", p.folder, p)
 }
 
 // pullerIteration runs a single puller iteration for the given folder and
 // returns the number items that should have been synced (even those that
-// might have failed). One puller iteration handles all files currently
-// flagged as needed in the folder. The specified number of copier, puller and
-// finisher routines are used. It's seldom efficient to use more than one
-// copier routine, while multiple pullers are essential and multiple finishers
-// may be useful (they are primarily CPU bound due to hashing).
+// might have failed). Items that failed in an earlier iteration and are
+// waiting to be retried are not counted. One puller iteration handles all
+// files currently flagged as needed in the folder. The specified number of
+// copier, puller and finisher routines are used. It's seldom efficient to use
+// more than one copier routine, while multiple pullers are essential and
+// multiple finishers may be useful (they are primarily CPU bound due to
+// hashing).
 func (p *Puller) pullerIteration(ncopiers, npullers, nfinishers int) int {
+	p.clearErrors()
+	defer p.publishErrors()
+
 	pullChan := make(chan pullBlockState)
 	copyChan := make(chan copyBlocksState)
 	finisherChan := make(chan *sharedPullerState)
@@ -283,44 +496,140 @@ func (p *Puller) pullerIteration(ncopiers, npullers, nfinishers int) int {
 	changed := 0
 
 	var deletions []protocol.FileInfo
+	var dirs []protocol.FileInfo
+
+	// Files are handled after all deletions are known, so that a file that
+	// was moved can be renamed locally instead of being copied. Only what is
+	// needed to order them is kept, to not hold on to all the block lists.
+	// The buckets map the contents of files about to be deleted to those
+	// files.
+	var needed []neededFile
+	buckets := make(map[string][]renameSource)
+
+	// Items that failed recently are left alone until their backoff has
+	// passed. The others are tried, and remembered so that their failures
+	// can be recorded once the iteration is done.
+	now := time.Now()
+	stillNeeded := make(map[string]bool)
+	attempted := make(map[string]protocol.Vector)
+	var started []string
 
 	files.WithNeed(protocol.LocalDeviceID, func(intf protocol.FileIntf) bool {
 
-		// Needed items are delivered sorted lexicographically. This isn't
-		// really optimal from a performance point of view - it would be
-		// better if files were handled in random order, to spread the load
-		// over the cluster. But it means that we can be sure that we fully
-		// handle directories before the files that go inside them, which is
-		// nice.
+		// Needed items are delivered sorted lexicographically, which means
+		// that directories are handled before the items that go inside them.
+		// Files are pulled later, in the configured order.
 
 		file := intf.(protocol.FileInfo)
 
-		events.Default.Log(events.ItemStarted, map[string]string{
-			"folder": p.folder,
-			"item":   file.Name,
-		})
+		stillNeeded[file.Name] = true
+		if fe, ok := p.retries.blocked(file, now); ok {
+			if debug {
+				l.Debugln(p, "skipping failed", file.Name)
+			}
+			p.keepError(fe)
+			return true
+		}
+		attempted[file.Name] = file.Version
+		started = append(started, file.Name)
 
 		if debug {
 			l.Debugln(p, "handling", file.Name)
 		}
 
 		switch {
+		case file.IsSymlink() && !file.IsDeleted() && (p.ignoreSymlinks || !osutil.SymlinksSupported):
+			// We can't, or shouldn't, create symlinks in this folder. Leave
+			// the item as needed without counting it as a change.
+			if debug {
+				l.Debugln(p, "skipping symlink", file.Name)
+			}
+			return true
 		case protocol.IsDeleted(file.Flags):
-			// A deleted file or directory
+			// A deleted file, directory or symlink
 			deletions = append(deletions, file)
+			if p.versioner == nil && !file.IsDirectory() {
+				// The versioner needs to archive the deleted file, so we
+				// can only use it as a rename source when there is none.
+				cur := p.model.CurrentFolderFile(p.folder, file.Name)
+				if cur.Name != "" && !cur.IsDeleted() && !cur.IsInvalid() && !cur.IsSymlink() && len(cur.Blocks) > 0 && !p.inConflict(cur, file) {
+					key := blocksKey(cur.Blocks)
+					buckets[key] = append(buckets[key], renameSource{cur, file})
+				}
+			}
 		case protocol.IsDirectory(file.Flags):
-			// A new or changed directory
-			p.handleDir(file)
+			// A new or changed directory, handled below once we know that
+			// the deletions aren't held back.
+			dirs = append(dirs, file)
 		default:
-			// A new or changed file. This is the only case where we do stuff
-			// in the background; the other three are done synchronously.
-			p.handleFile(file, copyChan, finisherChan)
+			// A new or changed file, handled below.
+			needed = append(needed, neededFile{
+				name:     file.Name,
+				size:     file.Size(),
+				modified: file.Modified,
+			})
 		}
 
 		changed++
 		return true
 	})
 
+	if p.holdDeletions(deletions) {
+		// Nothing else happens in the folder until the deletions are
+		// confirmed or aborted. Returning no changes makes the caller
+		// consider the folder in sync for now.
+		needed = nil
+		deletions = nil
+		dirs = nil
+		started = nil
+		changed = 0
+	}
+
+	// Items are announced once we know that they will be worked on.
+	for _, name := range started {
+		events.Default.Log(events.ItemStarted, map[string]string{
+			"folder": p.folder,
+			"item":   name,
+		})
+	}
+
+	// Directories are handled in the order they were delivered in, i.e.
+	// parents before the items that go inside them.
+	for _, dir := range dirs {
+		p.handleDir(dir)
+	}
+
+	// Deletions that have been handled by renaming the file.
+	renamed := make(map[string]bool)
+
+	orderNeeded(needed, p.order)
+
+	for _, nf := range needed {
+		file := files.GetGlobal(nf.name)
+		if file.Name != nf.name {
+			continue
+		}
+
+		if p.renameFile(file, buckets, renamed) {
+			continue
+		}
+
+		if len(p.model.availability(p.folder, file.Name)) == 0 {
+			// Only disconnected devices have the file. Leave it as needed
+			// without counting it as a change; we'll pull again when a
+			// device connects.
+			if debug {
+				l.Debugln(p, "no connected source for", file.Name)
+			}
+			changed--
+			continue
+		}
+
+		// This is the only case where we do stuff in the background; the
+		// other three are done synchronously.
+		p.handleFile(file, copyChan, finisherChan)
+	}
+
 	// Signal copy and puller routines that we are done with the in data for
 	// this iteration. Wait for them to finish.
 	close(copyChan)
@@ -336,6 +645,9 @@ func (p *Puller) pullerIteration(ncopiers, npullers, nfinishers int) int {
 
 	for i := range deletions {
 		deletion := deletions[len(deletions)-i-1]
+		if renamed[deletion.Name] {
+			continue
+		}
 		if deletion.IsDirectory() {
 			p.deleteDir(deletion)
 		} else {
@@ -343,11 +655,380 @@ func (p *Puller) pullerIteration(ncopiers, npullers, nfinishers int) int {
 		}
 	}
 
+	p.retries.prune(stillNeeded)
+	p.recordFailures(attempted)
+
 	return changed
 }
 
+// holdDeletions returns true if the given deletions must not be performed
+// without confirmation, because there are more of them than the configured
+// thresholds allow. The deletions are then recorded as pending. Both an
+// absolute count and a percentage of the local files can be configured;
+// exceeding either of them holds the deletions. Deletions the user has
+// already confirmed don't count against the thresholds.
+func (p *Puller) holdDeletions(deletions []protocol.FileInfo) bool {
+	p.deletionsMut.Lock()
+	defer p.deletionsMut.Unlock()
+
+	p.pendingDeletions = nil
+
+	unconfirmed := 0
+	for _, f := range deletions {
+		if !p.confirmedDeletions[f.Name] {
+			unconfirmed++
+		}
+	}
+	exceeded := p.maxDeletes > 0 && unconfirmed > p.maxDeletes
+	if !exceeded && p.maxDeletesPct > 0 && unconfirmed > 0 {
+		localFiles, _, _ := p.model.LocalSize(p.folder)
+		exceeded = unconfirmed*100 > localFiles*p.maxDeletesPct
+	}
+	if !exceeded {
+		p.confirmedDeletions = nil
+		return false
+	}
+
+	p.pendingDeletions = make([]string, len(deletions))
+	for i, f := range deletions {
+		p.pendingDeletions[i] = f.Name
+	}
+
+	l.Warnf("Folder %q: %d items would be deleted, which exceeds the configured limit. Waiting for the deletions to be confirmed or aborted.", p.folder, len(deletions))
+	return true
+}
+
+// PendingDeletions returns the names of the items whose deletion is being
+// held back, awaiting confirmation.
+func (p *Puller) PendingDeletions() []string {
+	p.deletionsMut.Lock()
+	defer p.deletionsMut.Unlock()
+
+	names := make([]string, len(p.pendingDeletions))
+	copy(names, p.pendingDeletions)
+	return names
+}
+
+// DeletionsAction confirms or aborts the pending deletions. It returns false
+// if there are none.
+func (p *Puller) DeletionsAction(confirm bool) bool {
+	p.deletionsMut.Lock()
+	pending := len(p.pendingDeletions) > 0
+	p.deletionsMut.Unlock()
+
+	if !pending {
+		return false
+	}
+	select {
+	case p.deletionsAction <- confirm:
+	default:
+	}
+	return true
+}
+
+func (p *Puller) confirmDeletions() {
+	p.deletionsMut.Lock()
+	if len(p.pendingDeletions) > 0 {
+		l.Infof("Folder %q: %d pending deletions confirmed", p.folder, len(p.pendingDeletions))
+		if p.confirmedDeletions == nil {
+			p.confirmedDeletions = make(map[string]bool, len(p.pendingDeletions))
+		}
+		for _, name := range p.pendingDeletions {
+			p.confirmedDeletions[name] = true
+		}
+		p.pendingDeletions = nil
+	}
+	p.deletionsMut.Unlock()
+}
+
+// abortDeletions cancels the pending deletions. The files we have are
+// announced as newer than their deletion, so that they are restored on the
+// other devices instead.
+func (p *Puller) abortDeletions() {
+	p.deletionsMut.Lock()
+	names := p.pendingDeletions
+	p.pendingDeletions = nil
+	p.deletionsMut.Unlock()
+
+	if len(names) == 0 {
+		return
+	}
+	l.Infof("Folder %q: %d pending deletions aborted", p.folder, len(names))
+
+	p.model.fmut.RLock()
+	fs := p.model.folderFiles[p.folder]
+	p.model.fmut.RUnlock()
+
+	batch := make([]protocol.FileInfo, 0, indexBatchSize)
+	for _, name := range names {
+		have := fs.Get(protocol.LocalDeviceID, name)
+		if have.Name != name || have.IsDeleted() || have.IsInvalid() {
+			continue
+		}
+		if len(batch) == indexBatchSize {
+			fs.Update(protocol.LocalDeviceID, batch)
+			batch = batch[:0]
+		}
+		// The version vector must dominate the deletion for our version
+		// to win.
+		have.Version = have.Version.Merge(fs.GetGlobal(name).Version).Update(p.model.shortID)
+		have.LocalVersion = 0
+		batch = append(batch, have)
+	}
+	if len(batch) > 0 {
+		fs.Update(protocol.LocalDeviceID, batch)
+	}
+}
+
+// setIdleState sets the state the folder rests in between scans and pulls.
+func (p *Puller) setIdleState() {
+	if p.spaceErr != nil {
+		p.model.setStateError(p.folder, FolderOutOfSpace, p.spaceErr)
+		return
+	}
+	p.model.setState(p.folder, p.idleState())
+}
+
+// checkDiskSpace returns an error if the disk holding the folder, or the one
+// holding the database, has less free space than configured.
+func (p *Puller) checkDiskSpace() error {
+	if err := checkFreeSpace("the folder", p.dir, p.minDiskFree, 0); err != nil {
+		return err
+	}
+	home := filepath.Dir(p.model.cfg.ConfigPath())
+	return checkFreeSpace("the database", home, p.model.cfg.Options().MinHomeDiskFreeSize(), 0)
+}
+
+// checkFreeSpace returns an error if the disk holding path would have less
+// than the minimum free space after writing need more bytes to it. A disk
+// that can't be checked is assumed to have enough.
+func checkFreeSpace(what, path string, min config.Size, need int64) error {
+	if min.Value <= 0 && need <= 0 {
+		return nil
+	}
+	free, total, err := osutil.DiskFree(path)
+	if err != nil {
+		if debug {
+			l.Debugln("free space of", path, err)
+		}
+		return nil
+	}
+	if free >= need && min.Satisfied(free-need, total) {
+		return nil
+	}
+	if need > 0 {
+		return fmt.Errorf("insufficient free space on the disk holding %s for %v more (%v free, the minimum is %v)", what, config.Size{Value: float64(need)}, config.Size{Value: float64(free)}, min)
+	}
+	pct := 0.0
+	if total > 0 {
+		pct = 100 * float64(free) / float64(total)
+	}
+	return fmt.Errorf("insufficient free space on the disk holding %s (%v, %.1f%%, is below the minimum of %v)", what, config.Size{Value: float64(free)}, pct, min)
+}
+
+// idleState returns the state the folder is in when not scanning or
+// syncing.
+func (p *Puller) idleState() folderState {
+	p.deletionsMut.Lock()
+	defer p.deletionsMut.Unlock()
+
+	if len(p.pendingDeletions) > 0 {
+		return FolderPaused
+	}
+	return FolderIdle
+}
+
+// newError records an error for the given file in the running puller
+// iteration. Only the first error for each file is kept, as the following
+// ones are usually consequences of it.
+func (p *Puller) newError(path string, err error) {
+	p.errorsMut.Lock()
+	defer p.errorsMut.Unlock()
+
+	if p.curErrors == nil {
+		p.curErrors = make(map[string]FileError)
+	}
+	if _, ok := p.curErrors[path]; ok {
+		return
+	}
+	p.curErrors[path] = FileError{Path: path, Err: err.Error(), Time: time.Now()}
+}
+
+// keepError carries an error over from an earlier iteration, for a file
+// that is not retried in the running one.
+func (p *Puller) keepError(fe FileError) {
+	p.errorsMut.Lock()
+	if p.curErrors == nil {
+		p.curErrors = make(map[string]FileError)
+	}
+	p.curErrors[fe.Path] = fe
+	p.errorsMut.Unlock()
+}
+
+// recordFailures schedules a retry for each of the attempted items that
+// failed in the running iteration.
+func (p *Puller) recordFailures(attempted map[string]protocol.Vector) {
+	p.errorsMut.Lock()
+	defer p.errorsMut.Unlock()
+
+	now := time.Now()
+	for name, fe := range p.curErrors {
+		version, ok := attempted[name]
+		if !ok {
+			continue
+		}
+		intv := p.retries.failed(name, version, fe, now)
+		if debug {
+			l.Debugln(p, "retrying", name, "in", intv)
+		}
+	}
+}
+
+func (p *Puller) clearErrors() {
+	p.errorsMut.Lock()
+	p.curErrors = make(map[string]FileError)
+	p.errorsMut.Unlock()
+}
+
+// publishErrors makes the errors of the finished puller iteration available
+// through Errors, and emits a FolderErrors event when they differ from the
+// errors of the previous iteration.
+func (p *Puller) publishErrors() {
+	p.errorsMut.Lock()
+	errs := make([]FileError, 0, len(p.curErrors))
+	for _, fe := range p.curErrors {
+		errs = append(errs, fe)
+	}
+	sort.Sort(fileErrorList(errs))
+
+	changed := len(errs) != len(p.fileErrors)
+	for i := 0; !changed && i < len(errs); i++ {
+		changed = errs[i].Path != p.fileErrors[i].Path || errs[i].Err != p.fileErrors[i].Err
+	}
+	p.fileErrors = errs
+	p.errorsMut.Unlock()
+
+	if changed {
+		events.Default.Log(events.FolderErrors, map[string]interface{}{
+			"folder": p.folder,
+			"errors": errs,
+		})
+	}
+}
+
+// Errors returns the files that failed to sync in the last puller
+// iteration, sorted by path.
+func (p *Puller) Errors() []FileError {
+	p.errorsMut.Lock()
+	defer p.errorsMut.Unlock()
+
+	errs := make([]FileError, len(p.fileErrors))
+	copy(errs, p.fileErrors)
+	return errs
+}
+
+type fileErrorList []FileError
+
+func (l fileErrorList) Len() int {
+	return len(l)
+}
+
+func (l fileErrorList) Less(a, b int) bool {
+	return l[a].Path < l[b].Path
+}
+
+func (l fileErrorList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+// A renameSource is a file about to be deleted, that may be renamed to a new
+// file with the same contents instead.
+type renameSource struct {
+	cur      protocol.FileInfo // the current local version
+	deletion protocol.FileInfo // the needed deletion
+}
+
+// renameFile looks for a file about to be deleted that has the same contents
+// as the given new file. If there is one, it is renamed into place and true
+// is returned. Sources that have changed on disk since they were last
+// scanned, or that have been modified concurrently with their deletion, are
+// not used.
+func (p *Puller) renameFile(file protocol.FileInfo, buckets map[string][]renameSource, renamed map[string]bool) bool {
+	if len(buckets) == 0 || file.IsSymlink() || len(file.Blocks) == 0 {
+		return false
+	}
+	if cur := p.model.CurrentFolderFile(p.folder, file.Name); cur.Name != "" && !cur.IsDeleted() {
+		// There is something in the way at the target, which handleFile
+		// knows how to take care of.
+		return false
+	}
+
+	key := blocksKey(file.Blocks)
+	for i, rs := range buckets[key] {
+		source := rs.cur
+
+		if p.checkParent(source.Name) != nil || p.checkParent(file.Name) != nil {
+			// handleFile reports the problem with the target
+			continue
+		}
+
+		sourceName := filepath.Join(p.dir, source.Name)
+		info, err := os.Lstat(sourceName)
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().Unix() != source.Modified || info.Size() != source.Size() {
+			// The file has changed since it was scanned
+			continue
+		}
+
+		if debug {
+			l.Debugln(p, "renaming", source.Name, "to", file.Name)
+		}
+
+		targetName := filepath.Join(p.dir, file.Name)
+		err = osutil.InWritableDir(func(path string) error {
+			return osutil.Rename(path, targetName)
+		}, sourceName)
+		if err != nil {
+			l.Infof("Puller (folder %q, file %q): rename from %q: %v", p.folder, file.Name, source.Name, err)
+			continue
+		}
+
+		buckets[key] = append(buckets[key][:i], buckets[key][i+1:]...)
+		renamed[source.Name] = true
+
+		// The source is gone, whether or not updating the metadata of the
+		// target works out.
+		p.model.updateLocal(p.folder, rs.deletion)
+		p.shortcutFile(file)
+		return true
+	}
+
+	return false
+}
+
+// blocksKey returns a string identifying the contents described by the
+// given block list.
+func blocksKey(blocks []protocol.BlockInfo) string {
+	h := sha256.New()
+	for _, b := range blocks {
+		h.Write(b.Hash)
+	}
+	return string(h.Sum(nil))
+}
+
+// checkParent returns an error if the directory holding the named file can
+// only be reached through a symlink, which could lead out of the folder.
+func (p *Puller) checkParent(name string) error {
+	return osutil.TraversesSymlink(p.dir, filepath.Dir(name))
+}
+
 // handleDir creates or updates the given directory
 func (p *Puller) handleDir(file protocol.FileInfo) {
+	if err := p.checkParent(file.Name); err != nil {
+		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
+		return
+	}
+
 	realName := filepath.Join(p.dir, file.Name)
 	mode := os.FileMode(file.Flags & 0777)
 	if p.ignorePerms {
@@ -375,6 +1056,7 @@ func (p *Puller) handleDir(file protocol.FileInfo) {
 				p.model.updateLocal(p.folder, file)
 			} else {
 				l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+				p.newError(file.Name, err)
 			}
 			return
 		}
@@ -382,9 +1064,11 @@ func (p *Puller) handleDir(file protocol.FileInfo) {
 		// Weird error when stat()'ing the dir. Probably won't work to do
 		// anything else with it if we can't even stat() it.
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
 		return
 	} else if !info.IsDir() {
 		l.Infof("Puller (folder %q, dir %q): should be dir, but is not", p.folder, file.Name)
+		p.newError(file.Name, errNotDir)
 		return
 	}
 
@@ -398,33 +1082,47 @@ func (p *Puller) handleDir(file protocol.FileInfo) {
 		p.model.updateLocal(p.folder, file)
 	} else {
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
 	}
 }
 
 // deleteDir attempts to delete the given directory
 func (p *Puller) deleteDir(file protocol.FileInfo) {
 	realName := filepath.Join(p.dir, file.Name)
-	err := osutil.InWritableDir(os.Remove, realName)
+	err := p.checkParent(file.Name)
+	if err == nil {
+		err = osutil.InWritableDir(os.Remove, realName)
+	}
 	if err == nil || os.IsNotExist(err) {
 		p.model.updateLocal(p.folder, file)
 	} else {
 		l.Infof("Puller (folder %q, dir %q): delete: %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
 	}
 }
 
 // deleteFile attempts to delete the given file
 func (p *Puller) deleteFile(file protocol.FileInfo) {
 	realName := filepath.Join(p.dir, file.Name)
+	curFile := p.model.CurrentFolderFile(p.folder, file.Name)
 
-	var err error
-	if p.versioner != nil {
+	err := p.checkParent(file.Name)
+	switch {
+	case err != nil:
+		// Don't follow a symlink out of the folder
+	case p.inConflict(curFile, file):
+		// The file was changed locally at the same time as it was deleted
+		// remotely. Keep the local changes as a conflict copy.
+		err = p.moveForConflict(curFile)
+	case p.versioner != nil:
 		err = osutil.InWritableDir(p.versioner.Archive, realName)
-	} else {
+	default:
 		err = osutil.InWritableDir(os.Remove, realName)
 	}
 
 	if err != nil && !os.IsNotExist(err) {
 		l.Infof("Puller (folder %q, file %q): delete: %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
 	} else {
 		p.model.updateLocal(p.folder, file)
 	}
@@ -433,9 +1131,17 @@ func (p *Puller) deleteFile(file protocol.FileInfo) {
 // handleFile queues the copies and pulls as necessary for a single new or
 // changed file.
 func (p *Puller) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocksState, finisherChan chan<- *sharedPullerState) {
+	if err := p.checkParent(file.Name); err != nil {
+		l.Infof("Puller (folder %q, file %q): %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
+		return
+	}
+
 	curFile := p.model.CurrentFolderFile(p.folder, file.Name)
 
-	if len(curFile.Blocks) == len(file.Blocks) {
+	// A symlink with a target that happens to equal the contents of the
+	// current file, or vice versa, is still a different thing.
+	if curFile.IsSymlink() == file.IsSymlink() && len(curFile.Blocks) == len(file.Blocks) {
 		for i := range file.Blocks {
 			if !bytes.Equal(curFile.Blocks[i].Hash, file.Blocks[i].Hash) {
 				goto FilesAreDifferent
@@ -461,6 +1167,7 @@ FilesAreDifferent:
 
 	reused := 0
 	var blocks []protocol.BlockInfo
+	var available []uint32
 
 	// Check for an old temporary file which might have some blocks we could
 	// reuse.
@@ -476,10 +1183,12 @@ FilesAreDifferent:
 		}
 
 		// Since the blocks are already there, we don't need to get them.
-		for _, block := range file.Blocks {
+		for i, block := range file.Blocks {
 			_, ok := existingBlocks[block.String()]
 			if !ok {
 				blocks = append(blocks, block)
+			} else {
+				available = append(available, uint32(i))
 			}
 		}
 
@@ -496,20 +1205,38 @@ FilesAreDifferent:
 		blocks = file.Blocks
 	}
 
+	// The disk may have filled up since the pull started, and the rest of
+	// the file must fit on it.
+	var need int64
+	for _, block := range blocks {
+		need += int64(block.Size)
+	}
+	if err := checkFreeSpace("the folder", p.dir, p.minDiskFree, need); err != nil {
+		if debug {
+			l.Debugln(p, "not pulling", file.Name, err)
+		}
+		p.newError(file.Name, err)
+		return
+	}
+
 	s := sharedPullerState{
 		file:       file,
+		curFile:    curFile,
 		folder:     p.folder,
 		tempName:   tempName,
 		realName:   realName,
 		copyTotal:  len(blocks),
 		copyNeeded: len(blocks),
 		reused:     reused,
+		available:  available,
 	}
 
 	if debug {
 		l.Debugf("%v need file %s; copy %d, reused %v", p, file.Name, len(blocks), reused)
 	}
 
+	p.progress.register(&s)
+
 	cs := copyBlocksState{
 		sharedPullerState: &s,
 		blocks:            blocks,
@@ -520,11 +1247,19 @@ FilesAreDifferent:
 // shortcutFile sets file mode and modification time, when that's the only
 // thing that has changed.
 func (p *Puller) shortcutFile(file protocol.FileInfo) {
+	if file.IsSymlink() {
+		// The link target is unchanged, and a symlink carries no other
+		// metadata that we sync.
+		p.model.updateLocal(p.folder, file)
+		return
+	}
+
 	realName := filepath.Join(p.dir, file.Name)
 	if !p.ignorePerms {
 		err := os.Chmod(realName, os.FileMode(file.Flags&0777))
 		if err != nil {
 			l.Infof("Puller (folder %q, file %q): shortcut: %v", p.folder, file.Name, err)
+			p.newError(file.Name, err)
 			return
 		}
 	}
@@ -540,6 +1275,7 @@ func (p *Puller) shortcutFile(file protocol.FileInfo) {
 			l.Infof("Puller (folder %q, file %q): shortcut: %v (continuing anyway as requested)", p.folder, file.Name, err)
 		} else {
 			l.Infof("Puller (folder %q, file %q): shortcut: %v", p.folder, file.Name, err)
+			p.newError(file.Name, err)
 			return
 		}
 	}
@@ -558,6 +1294,7 @@ nextFile:
 		if err != nil {
 			// Nothing more to do for this failed file (the error was logged
 			// when it happened)
+			p.newError(state.file.Name, err)
 			continue nextFile
 		}
 
@@ -601,6 +1338,7 @@ nextFile:
 				_, err = dstFd.WriteAt(buf, block.Offset)
 				if err != nil {
 					state.earlyClose("dst write", err)
+					p.newError(state.file.Name, err)
 				}
 				if file == state.file.Name {
 					state.copiedFromOrigin()
@@ -620,7 +1358,7 @@ nextFile:
 				}
 				pullChan <- ps
 			} else {
-				state.copyDone()
+				state.copyDone(block)
 			}
 		}
 		fdCache.Evict(fdCache.Len())
@@ -636,117 +1374,330 @@ nextBlock:
 			continue nextBlock
 		}
 
-		// Select the least busy device to pull the block from. If we found no
-		// feasible device at all, fail the block (and in the long run, the
-		// file).
-		potentialDevices := p.model.availability(p.folder, state.file.Name)
-		selected := activity.leastBusy(potentialDevices)
-		if selected == (protocol.DeviceID{}) {
-			state.earlyClose("pull", errNoDevice)
-			continue nextBlock
-		}
-
 		// Get an fd to the temporary file. Tehcnically we don't need it until
 		// after fetching the block, but if we run into an error here there is
 		// no point in issuing the request to the network.
 		fd, err := state.tempFile()
 		if err != nil {
+			p.newError(state.file.Name, err)
 			continue nextBlock
 		}
 
-		// Fetch the block, while marking the selected device as in use so that
-		// leastBusy can select another device when someone else asks.
-		activity.using(selected)
-		buf, err := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash)
-		activity.done(selected)
-		if err != nil {
-			state.earlyClose("pull", err)
-			continue nextBlock
+		potentialDevices := p.model.availability(p.folder, state.file.Name)
+		// Devices that are still downloading the file may already have the
+		// block, too.
+		for _, device := range p.model.progressAvailability(p.folder, state.file, state.block) {
+			if !deviceIn(device, potentialDevices) {
+				potentialDevices = append(potentialDevices, device)
+			}
+		}
+
+		var buf []byte
+		for {
+			// Select the least busy device to pull the block from. If we found
+			// no feasible device at all, fail the block (and in the long run,
+			// the file).
+			selected := activity.leastBusy(potentialDevices)
+			if selected == (protocol.DeviceID{}) {
+				if err == nil {
+					err = errNoDevice
+				}
+				state.earlyClose("pull", err)
+				p.newError(state.file.Name, err)
+				continue nextBlock
+			}
+
+			// Fetch the block, while marking the selected device as in use so
+			// that leastBusy can select another device when someone else asks.
+			activity.using(selected)
+			buf, err = p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash)
+			activity.done(selected)
+			if err == nil {
+				// A device serving the block from a temporary file might have
+				// moved on to another version of the file since advertising it.
+				if hash := sha256.Sum256(buf); !bytes.Equal(hash[:], state.block.Hash) {
+					err = errBlockHash
+				}
+			}
+			if err == nil {
+				break
+			}
+
+			// A failed request or a bad block says nothing about the other
+			// devices. Try the block from the remaining ones instead.
+			if debug {
+				l.Debugf("%v block %s:%d from %v: %v; trying another device", p, state.file.Name, state.block.Offset, selected, err)
+			}
+			potentialDevices = removeDevice(potentialDevices, selected)
 		}
 
 		// Save the block data we got from the cluster
 		_, err = fd.WriteAt(buf, state.block.Offset)
 		if err != nil {
 			state.earlyClose("save", err)
+			p.newError(state.file.Name, err)
 			continue nextBlock
 		}
 
-		state.pullDone()
+		state.pullDone(state.block)
 		out <- state.sharedPullerState
 	}
 }
 
+// deviceIn returns true if device is one of devices.
+func deviceIn(device protocol.DeviceID, devices []protocol.DeviceID) bool {
+	for _, d := range devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
+// removeDevice returns devices without any occurrence of device.
+func removeDevice(devices []protocol.DeviceID, device protocol.DeviceID) []protocol.DeviceID {
+	kept := devices[:0]
+	for _, d := range devices {
+		if d != device {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
 func (p *Puller) finisherRoutine(in <-chan *sharedPullerState) {
 	for state := range in {
 		if closed, err := state.finalClose(); closed {
 			if debug {
 				l.Debugln(p, "closing", state.file.Name)
 			}
-			if err != nil {
-				l.Warnln("puller: final:", err)
-				continue
+			if err == nil {
+				err = p.performFinish(state)
 			}
-
-			// Verify the file against expected hashes
-			fd, err := os.Open(state.tempName)
 			if err != nil {
 				l.Warnln("puller: final:", err)
-				continue
-			}
-			err = scanner.Verify(fd, protocol.BlockSize, state.file.Blocks)
-			fd.Close()
-			if err != nil {
-				l.Infoln("puller:", state.file.Name, err, "(file changed during pull?)")
-				continue
+				p.newError(state.file.Name, err)
 			}
+			p.progress.deregister(state)
+		}
+	}
+}
 
-			// Set the correct permission bits on the new file
-			if !p.ignorePerms {
-				err = os.Chmod(state.tempName, os.FileMode(state.file.Flags&0777))
-				if err != nil {
-					l.Warnln("puller: final:", err)
-					continue
-				}
-			}
+// performFinish verifies the completed temporary file and moves it into
+// place, recording the new file in the index.
+func (p *Puller) performFinish(state *sharedPullerState) error {
+	// A symlink may have taken the place of a parent directory since the
+	// pull started.
+	if err := p.checkParent(state.file.Name); err != nil {
+		return err
+	}
 
-			// Set the correct timestamp on the new file
-			t := time.Unix(state.file.Modified, 0)
-			err = os.Chtimes(state.tempName, t, t)
+	// Verify the file against expected hashes
+	fd, err := os.Open(state.tempName)
+	if err != nil {
+		return err
+	}
+	err = scanner.Verify(fd, protocol.BlockSize, state.file.Blocks)
+	fd.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v (file changed during pull?)", state.file.Name, err)
+	}
+
+	if state.file.IsSymlink() {
+		// The temporary file contains the link target. Replace it with the
+		// link itself, which is then renamed into place like any other
+		// file.
+		if err = replaceWithSymlink(state.tempName); err != nil {
+			return err
+		}
+	} else {
+		// Set the correct permission bits on the new file
+		if !p.ignorePerms {
+			err = os.Chmod(state.tempName, os.FileMode(state.file.Flags&0777))
 			if err != nil {
-				if p.lenientMtimes {
-					// We accept the failure with a warning here and allow the sync to
-					// continue. We'll sync the new mtime back to the other devices later.
-					// If they have the same problem & setting, we might never get in
-					// sync.
-					l.Infof("Puller (folder %q, file %q): final: %v (continuing anyway as requested)", p.folder, state.file.Name, err)
-				} else {
-					l.Warnln("puller: final:", err)
-					continue
-				}
+				return err
 			}
+		}
 
-			// If we should use versioning, let the versioner archive the old
-			// file before we replace it. Archiving a non-existent file is not
-			// an error.
-			if p.versioner != nil {
-				err = p.versioner.Archive(state.realName)
-				if err != nil {
-					l.Warnln("puller: final:", err)
-					continue
-				}
+		// Set the correct timestamp on the new file
+		t := time.Unix(state.file.Modified, 0)
+		err = os.Chtimes(state.tempName, t, t)
+		if err != nil {
+			if p.lenientMtimes {
+				// We accept the failure with a warning here and allow the sync to
+				// continue. We'll sync the new mtime back to the other devices later.
+				// If they have the same problem & setting, we might never get in
+				// sync.
+				l.Infof("Puller (folder %q, file %q): final: %v (continuing anyway as requested)", p.folder, state.file.Name, err)
+			} else {
+				return err
 			}
+		}
+	}
 
-			// Replace the original file with the new one
-			err = osutil.Rename(state.tempName, state.realName)
-			if err != nil {
-				l.Warnln("puller: final:", err)
-				continue
-			}
+	switch {
+	case p.inConflict(state.curFile, state.file):
+		// The local file was changed at the same time as the remote one.
+		// Keep the local changes as a conflict copy instead of archiving or
+		// overwriting them.
+		err = p.moveForConflict(state.curFile)
+
+	case p.versioner != nil:
+		// If we should use versioning, let the versioner archive the old
+		// file before we replace it. Archiving a non-existent file is not
+		// an error.
+		err = p.versioner.Archive(state.realName)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Replace the original file with the new one
+	if err = osutil.Rename(state.tempName, state.realName); err != nil {
+		return err
+	}
+
+	// Record the updated file in the index
+	p.model.updateLocal(p.folder, state.file)
+	return nil
+}
+
+// replaceWithSymlink replaces the file at path, which contains a link target
+// in wire format, with a symlink pointing to that target.
+func replaceWithSymlink(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return os.Symlink(filepath.FromSlash(string(bs)), path)
+}
+
+// revertLocalChanges reverts the local changes in a receive only folder.
+// Changed files that exist in the cluster are given an empty version, making
+// them older than the global version and thus needed again. Files that were
+// added locally are removed.
+func (p *Puller) revertLocalChanges() {
+	p.model.fmut.RLock()
+	fs := p.model.folderFiles[p.folder]
+	p.model.fmut.RUnlock()
+
+	var batch []protocol.FileInfo
+	var added []protocol.FileInfo
+	fs.WithHave(protocol.LocalDeviceID, func(fi protocol.FileIntf) bool {
+		f := fi.(protocol.FileInfo)
+		if !f.IsLocalChanged() {
+			return true
+		}
+		if gf := fs.GetGlobal(f.Name); gf.Name != f.Name {
+			added = append(added, f)
+			return true
+		}
+		f.Flags &^= protocol.FlagInvalid | protocol.FlagLocalChanged
+		f.Version = protocol.Vector{}
+		f.LocalVersion = 0
+		batch = append(batch, f)
+		return true
+	})
+
+	// Remove added files in reverse order, so that directories are empty
+	// by the time we get to them.
+	for i := len(added) - 1; i >= 0; i-- {
+		f := added[i]
+		realName := filepath.Join(p.dir, f.Name)
 
-			// Record the updated file in the index
-			p.model.updateLocal(p.folder, state.file)
+		var err error
+		switch {
+		case f.IsDeleted():
+			// Already gone
+		case f.IsDirectory() || p.versioner == nil:
+			err = osutil.InWritableDir(os.Remove, realName)
+		default:
+			err = osutil.InWritableDir(p.versioner.Archive, realName)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			l.Infof("Puller (folder %q, file %q): revert: %v", p.folder, f.Name, err)
+			continue
 		}
+
+		// The file stays invalid, so the deletion isn't announced either.
+		f.Flags = (f.Flags &^ protocol.FlagLocalChanged) | protocol.FlagDeleted
+		f.Blocks = nil
+		f.LocalVersion = 0
+		batch = append(batch, f)
+	}
+
+	if debug {
+		l.Debugf("%v reverting %d local changes", p, len(batch))
+	}
+	fs.Update(protocol.LocalDeviceID, batch)
+}
+
+// inConflict returns true if the local file cur has been modified
+// concurrently with the incoming file, so that replacing it would lose the
+// local changes.
+func (p *Puller) inConflict(cur, file protocol.FileInfo) bool {
+	if cur.Name == "" || cur.IsDeleted() || cur.IsDirectory() || (cur.IsInvalid() && !cur.IsLocalChanged()) {
+		// We don't have any data of our own to preserve.
+		return false
+	}
+	return cur.Version.Concurrent(file.Version)
+}
+
+// moveForConflict renames the local file out of the way to a conflict copy
+// and adds the copy to the index as a new file, so that it propagates to the
+// other devices.
+func (p *Puller) moveForConflict(cur protocol.FileInfo) error {
+	name := conflictName(cur.Name, time.Now(), p.model.id)
+	realName := filepath.Join(p.dir, cur.Name)
+	conflictPath := filepath.Join(p.dir, name)
+
+	err := osutil.InWritableDir(func(path string) error {
+		return osutil.Rename(path, conflictPath)
+	}, realName)
+	if os.IsNotExist(err) {
+		// The file has already been moved or removed locally, so there is
+		// nothing to keep.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	l.Infof("Puller (folder %q, file %q): conflicting changes; local version kept as %q", p.folder, cur.Name, name)
+
+	// The conflict copy is a new file as far as the rest of the cluster is
+	// concerned, so it gets a fresh version. In a receive only folder it
+	// keeps the local change flag and so isn't announced.
+	cf := protocol.FileInfo{
+		Name:     name,
+		Flags:    cur.Flags,
+		Modified: cur.Modified,
+		Version:  protocol.Vector{}.Update(p.model.shortID),
+		Blocks:   cur.Blocks,
+	}
+	p.model.updateLocal(p.folder, cf)
+
+	events.Default.Log(events.ConflictCreated, map[string]string{
+		"folder":   p.folder,
+		"item":     cur.Name,
+		"conflict": name,
+	})
+
+	return nil
+}
+
+// conflictName returns the name of the conflict copy for the given file,
+// on the form name.sync-conflict-<date>-<time>-<device>.ext. The leading dot
+// of a dotfile such as .bashrc is part of the name, not an extension.
+func conflictName(name string, t time.Time, device protocol.DeviceID) string {
+	ext := filepath.Ext(name)
+	if len(ext) == len(filepath.Base(name)) {
+		ext = ""
 	}
+	withoutExt := name[:len(name)-len(ext)]
+	return fmt.Sprintf("%s.sync-conflict-%s-%s%s", withoutExt, t.Format("20060102-150405"), device.String()[:7], ext)
 }
 
 // clean deletes orphaned temporary files
@@ -16,11 +16,16 @@
 package model
 
 import (
+	"crypto/sha256"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syncthing/syncthing/internal/scanner"
 
@@ -66,7 +71,7 @@ func TestHandleFile(t *testing.T) {
 	requiredFile.Blocks = blocks[1:]
 
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	// Update index
 	m.updateLocal("default", existingFile)
@@ -120,7 +125,7 @@ func TestHandleFileWithTemp(t *testing.T) {
 	requiredFile.Blocks = blocks[1:]
 
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	// Update index
 	m.updateLocal("default", existingFile)
@@ -183,7 +188,7 @@ func TestCopierFinder(t *testing.T) {
 	cfg := config.Configuration{Folders: []config.FolderConfiguration{fcfg}}
 
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
 	m.AddFolder(fcfg)
 	// Update index
 	m.updateLocal("default", existingFile)
@@ -250,3 +255,926 @@ func TestCopierFinder(t *testing.T) {
 
 	os.Remove(tempFile)
 }
+
+func TestConflictName(t *testing.T) {
+	ts := time.Date(2014, 10, 7, 13, 4, 5, 0, time.UTC)
+	prefix := device1.String()[:7]
+
+	testcases := []struct {
+		name, conflict string
+	}{
+		{"foo.txt", "foo.sync-conflict-20141007-130405-" + prefix + ".txt"},
+		{"foo", "foo.sync-conflict-20141007-130405-" + prefix},
+		{"dir/foo.tar.gz", "dir/foo.tar.sync-conflict-20141007-130405-" + prefix + ".gz"},
+		{".bashrc", ".bashrc.sync-conflict-20141007-130405-" + prefix},
+		{"dir/.config.yml", "dir/.config.sync-conflict-20141007-130405-" + prefix + ".yml"},
+	}
+
+	for _, tc := range testcases {
+		if c := conflictName(tc.name, ts, device1); c != tc.conflict {
+			t.Errorf("conflictName(%q) == %q, expected %q", tc.name, c, tc.conflict)
+		}
+	}
+}
+
+func TestDeleteConcurrentlyModified(t *testing.T) {
+	// A remote deletion concurrent with a local change should keep the local
+	// data as a conflict copy instead of removing it.
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("local data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	base := protocol.Vector{{ID: device2.Short(), Value: 1}}
+	local := protocol.FileInfo{
+		Name:    "file",
+		Version: base.Update(device1.Short()),
+		Blocks:  blocks[1:2],
+	}
+	m.updateLocal("default", local)
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	deleted := protocol.FileInfo{
+		Name:    "file",
+		Flags:   protocol.FlagDeleted,
+		Version: base.Update(device2.Short()),
+	}
+	p.deleteFile(deleted)
+
+	if _, err := os.Stat(filepath.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Error("original file should have been moved away")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "file.sync-conflict-*"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one conflict copy, got %v", matches)
+	}
+	data, _ := ioutil.ReadFile(matches[0])
+	if string(data) != "local data" {
+		t.Errorf("conflict copy has incorrect contents %q", data)
+	}
+
+	cf := m.CurrentFolderFile("default", filepath.Base(matches[0]))
+	if cf.Name == "" || cf.IsDeleted() {
+		t.Error("conflict copy should be present in the index")
+	}
+	if cf := m.CurrentFolderFile("default", "file"); !cf.IsDeleted() {
+		t.Error("original file should be deleted in the index")
+	}
+}
+
+func TestReplaceWithSymlink(t *testing.T) {
+	if !osutil.SymlinksSupported {
+		t.Skip("symlinks not supported")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "link")
+	if err := ioutil.WriteFile(name, []byte("some/target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replaceWithSymlink(name); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := os.Readlink(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != filepath.FromSlash("some/target") {
+		t.Errorf("Incorrect link target %q", target)
+	}
+}
+
+func TestSymlinkedParent(t *testing.T) {
+	if !osutil.SymlinksSupported {
+		t.Skip("symlinks not supported")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folder := filepath.Join(dir, "folder")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{folder, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "victim"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A synced symlink points out of the folder
+	if err := os.Symlink(outside, filepath.Join(folder, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: folder})
+	p := Puller{
+		folder: "default",
+		dir:    folder,
+		model:  m,
+	}
+
+	// Nothing is created, replaced or removed through it
+	copyChan := make(chan copyBlocksState, 1)
+	p.handleFile(protocol.FileInfo{Name: filepath.Join("link", "file"), Blocks: blocks[1:2]}, copyChan, nil)
+	if len(copyChan) != 0 {
+		t.Error("file behind a symlink queued for pulling")
+	}
+	p.handleDir(protocol.FileInfo{Name: filepath.Join("link", "dir"), Flags: protocol.FlagDirectory | 0755})
+	p.deleteFile(protocol.FileInfo{Name: filepath.Join("link", "victim"), Flags: protocol.FlagDeleted})
+
+	if _, err := os.Stat(filepath.Join(outside, "dir")); !os.IsNotExist(err) {
+		t.Error("directory created behind a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "victim")); err != nil {
+		t.Error("file deleted behind a symlink:", err)
+	}
+	p.publishErrors()
+	if errs := p.Errors(); len(errs) != 3 {
+		t.Errorf("expected three errors, got %v", errs)
+	}
+}
+
+func TestRevertLocalChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"changed", "added"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("local data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fcfg := config.FolderConfiguration{ID: "default", Path: dir, ReceiveOnly: true}
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	// We have previously synced "changed" from the remote device, with
+	// different contents than what is now on disk.
+	global := protocol.FileInfo{
+		Name:     "changed",
+		Flags:    0644,
+		Modified: 1000,
+		Version:  protocol.Vector{{ID: device2.Short(), Value: 1}},
+		Blocks:   blocks[1:2],
+	}
+	m.folderFiles["default"].Replace(device2, []protocol.FileInfo{global})
+	m.updateLocal("default", global)
+
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"changed", "added"} {
+		if cf := m.CurrentFolderFile("default", name); !cf.IsLocalChanged() || !cf.IsInvalid() {
+			t.Errorf("%q should be flagged as locally changed: %v", name, cf)
+		}
+	}
+	if files, _ := m.LocalChangedSize("default"); files != 2 {
+		t.Errorf("expected two locally changed files, not %d", files)
+	}
+	if files, _ := m.NeedSize("default"); files != 0 {
+		t.Errorf("expected no needed files before revert, not %d", files)
+	}
+	if gf := m.folderFiles["default"].GetGlobal("changed"); !gf.Version.Equal(global.Version) {
+		t.Errorf("global version should be unaffected by local change: %v", gf)
+	}
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+	p.revertLocalChanges()
+
+	if _, err := os.Stat(filepath.Join(dir, "added")); !os.IsNotExist(err) {
+		t.Error("locally added file should have been removed")
+	}
+	if files, _ := m.LocalChangedSize("default"); files != 0 {
+		t.Errorf("expected no locally changed files after revert, not %d", files)
+	}
+	need := m.NeedFolderFilesLimited("default", 10, 100)
+	if len(need) != 1 || need[0].Name != "changed" {
+		t.Errorf("expected the global version of the changed file to be needed, not %v", need)
+	}
+}
+
+func TestRenameDetection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"moved", "changed"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote device has moved both files into a new directory.
+	var remote []protocol.FileInfo
+	for _, name := range []string{"moved", "changed"} {
+		cur := m.CurrentFolderFile("default", name)
+		deleted := cur
+		deleted.Flags |= protocol.FlagDeleted
+		deleted.Blocks = nil
+		deleted.Version = cur.Version.Update(device2.Short())
+		added := cur
+		added.Name = filepath.Join("dir", name)
+		added.Version = protocol.Vector{{ID: device2.Short(), Value: 1}}
+		remote = append(remote, deleted, added)
+	}
+	remote = append(remote, protocol.FileInfo{
+		Name:    "dir",
+		Flags:   protocol.FlagDirectory | 0755,
+		Version: protocol.Vector{{ID: device2.Short(), Value: 1}},
+	})
+	m.folderFiles["default"].Replace(device2, remote)
+
+	// One of the files changes on disk before the puller gets to it, so it
+	// can't be used as the source of a rename.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "changed"), future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	buckets := make(map[string][]renameSource)
+	for _, name := range []string{"moved", "changed"} {
+		cur := m.CurrentFolderFile("default", name)
+		key := blocksKey(cur.Blocks)
+		buckets[key] = append(buckets[key], renameSource{cur, m.folderFiles["default"].GetGlobal(name)})
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := make(map[string]bool)
+	if !p.renameFile(m.folderFiles["default"].GetGlobal(filepath.Join("dir", "moved")), buckets, renamed) {
+		t.Fatal("unchanged file should have been renamed")
+	}
+	if p.renameFile(m.folderFiles["default"].GetGlobal(filepath.Join("dir", "changed")), buckets, renamed) {
+		t.Fatal("changed file should not have been renamed")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dir", "moved"))
+	if err != nil || string(data) != "data of moved" {
+		t.Errorf("renamed file has incorrect contents %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved")); !os.IsNotExist(err) {
+		t.Error("rename source should be gone")
+	}
+	if !renamed["moved"] || renamed["changed"] {
+		t.Errorf("incorrect renamed set %v", renamed)
+	}
+	if cf := m.CurrentFolderFile("default", "moved"); !cf.IsDeleted() {
+		t.Error("rename source should be deleted in the index")
+	}
+	if cf := m.CurrentFolderFile("default", filepath.Join("dir", "moved")); cf.Name == "" || cf.IsDeleted() {
+		t.Error("rename target should be present in the index")
+	}
+}
+
+func TestFolderErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file is in the way of a directory we should create
+	if err := ioutil.WriteFile(filepath.Join(dir, "dir"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	sub := events.Default.Subscribe(events.FolderErrors)
+	defer events.Default.Unsubscribe(sub)
+
+	p.clearErrors()
+	p.handleDir(protocol.FileInfo{
+		Name:    "dir",
+		Flags:   protocol.FlagDirectory | 0755,
+		Version: protocol.Vector{{ID: device2.Short(), Value: 1}},
+	})
+	p.publishErrors()
+
+	errs := p.Errors()
+	if len(errs) != 1 || errs[0].Path != "dir" || errs[0].Err != errNotDir.Error() {
+		t.Fatalf("incorrect errors %v", errs)
+	}
+	if ev, err := sub.Poll(time.Second); err != nil {
+		t.Fatal("no event for the changed errors:", err)
+	} else if data := ev.Data.(map[string]interface{}); data["folder"] != "default" {
+		t.Errorf("incorrect event data %v", data)
+	}
+
+	// The same errors again should not cause another event
+	p.clearErrors()
+	p.newError("dir", errNotDir)
+	p.publishErrors()
+	if _, err := sub.Poll(100 * time.Millisecond); err != events.ErrTimeout {
+		t.Error("unexpected event for unchanged errors")
+	}
+
+	// No errors is a change as well
+	p.clearErrors()
+	p.publishErrors()
+	if len(p.Errors()) != 0 {
+		t.Errorf("errors should be cleared, not %v", p.Errors())
+	}
+	if _, err := sub.Poll(time.Second); err != nil {
+		t.Error("no event for the cleared errors:", err)
+	}
+}
+
+func TestFailedFileBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file is in the way of a directory we should create
+	if err := ioutil.WriteFile(filepath.Join(dir, "dir"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := m.CurrentFolderFile("default", "dir")
+	blocked.Flags = protocol.FlagDirectory | 0755
+	blocked.Blocks = nil
+	blocked.Version = blocked.Version.Update(device2.Short())
+	remote := []protocol.FileInfo{
+		blocked,
+		{Name: "other", Flags: protocol.FlagDirectory | 0755, Version: protocol.Vector{{ID: device2.Short(), Value: 1}}},
+	}
+	m.folderFiles["default"].Replace(device2, remote)
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	if changed := p.pullerIteration(1, 1, 1); changed != 2 {
+		t.Errorf("both items should have been tried, got %d changes", changed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other")); err != nil {
+		t.Error("the healthy directory should have been created:", err)
+	}
+	if next, ok := p.retries.next(); !ok || next.Sub(time.Now()) > retryMinIntv {
+		t.Errorf("incorrect next retry %v, %v", next, ok)
+	}
+
+	// The failed item is left alone until it's due, but its error remains
+	if changed := p.pullerIteration(1, 1, 1); changed != 0 {
+		t.Errorf("the failed item should not be retried yet, got %d changes", changed)
+	}
+	if errs := p.Errors(); len(errs) != 1 || errs[0].Path != "dir" {
+		t.Errorf("incorrect errors %v", errs)
+	}
+
+	// Once due, it's retried and the backoff doubles
+	r := p.retries.files["dir"]
+	r.next = time.Now()
+	p.retries.files["dir"] = r
+	if changed := p.pullerIteration(1, 1, 1); changed != 1 {
+		t.Errorf("the failed item should have been retried, got %d changes", changed)
+	}
+	if r := p.retries.files["dir"]; r.failures != 2 || r.next.Sub(time.Now()) <= retryMinIntv {
+		t.Errorf("incorrect retry state %+v", r)
+	}
+
+	// When the obstacle is gone and a new version arrives, it's tried right
+	// away and forgotten when synced
+	if err := os.Remove(filepath.Join(dir, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	blocked.Version = blocked.Version.Update(device2.Short())
+	remote[0] = blocked
+	m.folderFiles["default"].Replace(device2, remote)
+	if changed := p.pullerIteration(1, 1, 1); changed != 1 {
+		t.Errorf("the new version should have been tried, got %d changes", changed)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "dir")); err != nil || !info.IsDir() {
+		t.Error("the directory should have been created:", err)
+	}
+	p.pullerIteration(1, 1, 1)
+	if _, ok := p.retries.next(); ok {
+		t.Errorf("synced items should not be retried, %v", p.retries.files)
+	}
+	if errs := p.Errors(); len(errs) != 0 {
+		t.Errorf("errors should be cleared, not %v", errs)
+	}
+}
+
+func TestInsufficientSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, err := osutil.DiskFree(dir); err != nil {
+		t.Skip("free space can't be checked:", err)
+	}
+
+	if err := checkFreeSpace("the folder", dir, config.Size{}, 0); err != nil {
+		t.Error("no minimum should always be satisfied:", err)
+	}
+	if err := checkFreeSpace("the folder", dir, config.Size{Value: 1}, 0); err != nil {
+		t.Error("a single free byte should be available:", err)
+	}
+	if err := checkFreeSpace("the folder", dir, config.Size{}, 1<<62); err == nil {
+		t.Error("a file of an exabyte should not fit")
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	p := Puller{
+		folder:      "default",
+		dir:         dir,
+		model:       m,
+		minDiskFree: config.Size{Value: 1 << 62},
+	}
+
+	sub := events.Default.Subscribe(events.StateChanged)
+	defer events.Default.Unsubscribe(sub)
+
+	p.spaceErr = p.checkDiskSpace()
+	if p.spaceErr == nil {
+		t.Fatal("an exabyte should not be available")
+	}
+	p.setIdleState()
+	if state, _, err := m.State("default"); state != "outOfSpace" || err != p.spaceErr {
+		t.Errorf("incorrect state %q, %v", state, err)
+	}
+	if ev, err := sub.Poll(time.Second); err != nil {
+		t.Fatal("no event for the state change:", err)
+	} else if data := ev.Data.(map[string]interface{}); data["error"] != p.spaceErr.Error() {
+		t.Errorf("incorrect event data %v", data)
+	}
+
+	// Files are not started while the disk is full
+	p.clearErrors()
+	p.handleFile(protocol.FileInfo{
+		Name:    "file",
+		Version: protocol.Vector{{ID: device2.Short(), Value: 1}},
+		Blocks:  []protocol.BlockInfo{{Size: 1, Hash: []byte{1}}},
+	}, nil, nil)
+	p.publishErrors()
+	if errs := p.Errors(); len(errs) != 1 || errs[0].Path != "file" {
+		t.Errorf("incorrect errors %v", errs)
+	}
+
+	p.spaceErr = nil
+	p.setIdleState()
+	if state, _, err := m.State("default"); state != "idle" || err != nil {
+		t.Errorf("incorrect state %q, %v", state, err)
+	}
+
+	// A file too large for the disk is not started either, whatever the
+	// minimum (a petabyte in blocks of two gigabytes)
+	p.minDiskFree = config.Size{}
+	p.clearErrors()
+	large := make([]protocol.BlockInfo, 1<<19)
+	for i := range large {
+		large[i] = protocol.BlockInfo{Size: 1 << 31, Hash: []byte{byte(i), byte(i >> 8), byte(i >> 16)}}
+	}
+	copyChan := make(chan copyBlocksState, 1)
+	p.handleFile(protocol.FileInfo{
+		Name:    "large",
+		Version: protocol.Vector{{ID: device2.Short(), Value: 1}},
+		Blocks:  large,
+	}, copyChan, nil)
+	p.publishErrors()
+	if errs := p.Errors(); len(errs) != 1 || errs[0].Path != "large" {
+		t.Errorf("incorrect errors %v", errs)
+	}
+	if len(copyChan) != 0 {
+		t.Error("file too large for the disk queued for pulling")
+	}
+}
+
+func TestOfflineSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{{
+			ID:      "default",
+			Path:    dir,
+			Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+		}},
+	}
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	// Only device2, which is not connected, has the file
+	m.folderFiles["default"].Replace(device2, []protocol.FileInfo{{
+		Name:    "file",
+		Version: protocol.Vector{{ID: device2.Short(), Value: 1}},
+		Blocks:  []protocol.BlockInfo{{Size: 1, Hash: []byte{1}}},
+	}})
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	if devs := m.availability("default", "file"); len(devs) != 0 {
+		t.Errorf("disconnected devices should not be available, got %v", devs)
+	}
+	if changed := p.pullerIteration(1, 1, 1); changed != 0 {
+		t.Errorf("a file without connected sources should not count as a change, got %d", changed)
+	}
+
+	fc := FakeConnection{id: device2}
+	m.AddConnection(fc, fc)
+	if devs := m.availability("default", "file"); len(devs) != 1 || devs[0] != device2 {
+		t.Errorf("the connected device should be available, got %v", devs)
+	}
+}
+
+func TestPullBlockRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device3 := protocol.NewDeviceID([]byte("device3"))
+	device4 := protocol.NewDeviceID([]byte("device4"))
+	data := []byte("hello")
+	hash := sha256.Sum256(data)
+	file := protocol.FileInfo{
+		Name:    "file",
+		Version: protocol.Vector{{ID: device2.Short(), Value: 1}},
+		Blocks:  []protocol.BlockInfo{{Size: uint32(len(data)), Hash: hash[:]}},
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{{
+			ID:      "default",
+			Path:    dir,
+			Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}, {DeviceID: device3}, {DeviceID: device4}},
+		}},
+	}
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+	for _, dev := range []protocol.DeviceID{device2, device3, device4} {
+		m.folderFiles["default"].Replace(dev, []protocol.FileInfo{file})
+	}
+
+	// device2 fails the request and device4 serves a bad block. device3,
+	// which also advertises the block in its download progress, has the
+	// correct one. It is made to look busy so that it's tried last.
+	fc2 := FakeConnection{id: device2, requestErr: protocol.ErrClosed}
+	m.AddConnection(fc2, fc2)
+	fc3 := FakeConnection{id: device3, requestData: data}
+	m.AddConnection(fc3, fc3)
+	fc4 := FakeConnection{id: device4, requestData: []byte("olleh")}
+	m.AddConnection(fc4, fc4)
+	activity.using(device3)
+	defer activity.done(device3)
+	m.remoteProgress.update(device3, "default", []protocol.FileDownloadProgressUpdate{{
+		UpdateType:   protocol.UpdateTypeAppend,
+		Name:         file.Name,
+		Version:      file.Version,
+		BlockIndexes: []uint32{0},
+	}})
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	s := &sharedPullerState{
+		file:     file,
+		folder:   "default",
+		tempName: filepath.Join(dir, defTempNamer.TempName(file.Name)),
+		realName: filepath.Join(dir, file.Name),
+	}
+	s.pullStarted()
+
+	in := make(chan pullBlockState, 1)
+	out := make(chan *sharedPullerState, 1)
+	in <- pullBlockState{s, file.Blocks[0]}
+	close(in)
+	p.pullerRoutine(in, out)
+
+	if err := s.failed(); err != nil {
+		t.Fatalf("a bad block from one device should be retried from another, got %v", err)
+	}
+	if len(out) != 1 {
+		t.Fatal("the pulled block was not passed on")
+	}
+	s.fd.Close()
+	bs, err := ioutil.ReadFile(s.tempName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != string(data) {
+		t.Errorf("got block data %q, expected %q", bs, data)
+	}
+}
+
+func TestMassDeletionBrake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote device deletes three of the four files
+	var remote []protocol.FileInfo
+	for _, name := range names {
+		f := m.CurrentFolderFile("default", name)
+		if name != "d" {
+			f.Flags |= protocol.FlagDeleted
+			f.Blocks = nil
+			f.Version = f.Version.Update(device2.Short())
+		}
+		remote = append(remote, f)
+	}
+	// A new directory, which waits for the deletions as well
+	remote = append(remote, protocol.FileInfo{
+		Name:    "newdir",
+		Flags:   protocol.FlagDirectory | 0755,
+		Version: protocol.Vector{{ID: device2.Short(), Value: 1}},
+	})
+	m.folderFiles["default"].Replace(device2, remote)
+
+	p := Puller{
+		folder:        "default",
+		dir:           dir,
+		model:         m,
+		maxDeletes:    2,
+		maxDeletesPct: 50,
+	}
+
+	sub := events.Default.Subscribe(events.ItemStarted)
+	defer events.Default.Unsubscribe(sub)
+	if changed := p.pullerIteration(1, 1, 1); changed != 0 {
+		t.Errorf("held back deletions should not count as changes, got %d", changed)
+	}
+	if ev, err := sub.Poll(100 * time.Millisecond); err != events.ErrTimeout {
+		t.Errorf("unexpected event %v for a held back item", ev)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s should not have been deleted: %v", name, err)
+		}
+	}
+	if pending := p.PendingDeletions(); len(pending) != 3 {
+		t.Fatalf("incorrect pending deletions %v", pending)
+	}
+	if p.idleState() != FolderPaused {
+		t.Error("folder should be paused")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "newdir")); !os.IsNotExist(err) {
+		t.Error("directories should not be created while deletions are held")
+	}
+
+	// Either threshold being exceeded holds the deletions
+	p.maxDeletesPct = 80
+	p.pullerIteration(1, 1, 1)
+	if pending := p.PendingDeletions(); len(pending) != 3 {
+		t.Fatalf("deletions above the count limit should be held, got %v", pending)
+	}
+
+	// Higher thresholds let the same deletions through
+	p.maxDeletes = 3
+	p.pullerIteration(1, 1, 1)
+	if pending := p.PendingDeletions(); len(pending) != 0 {
+		t.Fatalf("deletions below both limits should not be held, got %v", pending)
+	}
+	for _, name := range names {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if name == "d" && err != nil {
+			t.Errorf("%s should not have been deleted: %v", name, err)
+		} else if name != "d" && !os.IsNotExist(err) {
+			t.Errorf("%s should have been deleted", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "newdir")); err != nil {
+		t.Error("the directory should have been created:", err)
+	}
+}
+
+func TestMassDeletionConfirm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleteRemote makes the remote device delete the given files
+	var remote []protocol.FileInfo
+	for _, name := range names {
+		remote = append(remote, m.CurrentFolderFile("default", name))
+	}
+	deleteRemote := func(deleted ...string) {
+		for i := range remote {
+			for _, name := range deleted {
+				if remote[i].Name == name {
+					remote[i].Flags |= protocol.FlagDeleted
+					remote[i].Blocks = nil
+					remote[i].Version = remote[i].Version.Update(device2.Short())
+				}
+			}
+		}
+		m.folderFiles["default"].Replace(device2, remote)
+	}
+
+	p := Puller{
+		folder:     "default",
+		dir:        dir,
+		model:      m,
+		maxDeletes: 1,
+	}
+
+	deleteRemote("a", "b")
+	p.pullerIteration(1, 1, 1)
+	if pending := p.PendingDeletions(); len(pending) != 2 {
+		t.Fatalf("incorrect pending deletions %v", pending)
+	}
+	p.confirmDeletions()
+
+	// More deletions show up after the confirmation. They are held, and
+	// the confirmed ones wait with them.
+	deleteRemote("c", "d")
+	p.pullerIteration(1, 1, 1)
+	if pending := p.PendingDeletions(); len(pending) != 4 {
+		t.Fatalf("unconfirmed deletions should be held, got %v", pending)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s should not have been deleted: %v", name, err)
+		}
+	}
+
+	// Once those are confirmed too, all of them are performed
+	p.confirmDeletions()
+	p.pullerIteration(1, 1, 1)
+	if pending := p.PendingDeletions(); len(pending) != 0 {
+		t.Fatalf("confirmed deletions should not be held, got %v", pending)
+	}
+	for _, name := range names {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if name == "e" && err != nil {
+			t.Errorf("%s should not have been deleted: %v", name, err)
+		} else if name != "e" && !os.IsNotExist(err) {
+			t.Errorf("%s should have been deleted", name)
+		}
+	}
+}
+
+func TestMassDeletionAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	f := m.CurrentFolderFile("default", "file")
+	f.Flags |= protocol.FlagDeleted
+	f.Blocks = nil
+	f.Version = f.Version.Update(device2.Short())
+	m.folderFiles["default"].Replace(device2, []protocol.FileInfo{f})
+
+	p := Puller{
+		folder:        "default",
+		dir:           dir,
+		model:         m,
+		maxDeletesPct: 50,
+	}
+
+	p.pullerIteration(1, 1, 1)
+	if pending := p.PendingDeletions(); len(pending) != 1 {
+		t.Fatalf("incorrect pending deletions %v", pending)
+	}
+
+	p.abortDeletions()
+	if pending := p.PendingDeletions(); len(pending) != 0 {
+		t.Errorf("pending deletions remain after abort: %v", pending)
+	}
+	if g := m.folderFiles["default"].GetGlobal("file"); g.IsDeleted() {
+		t.Error("our file should have won over the deletion")
+	}
+	if p.pullerIteration(1, 1, 1) != 0 {
+		t.Error("nothing should be needed after abort")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file")); err != nil {
+		t.Error("file should have been kept:", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// A neededFile is what the puller keeps about a file it needs, until it
+// gets to pulling it.
+type neededFile struct {
+	name     string
+	size     int64
+	modified int64
+}
+
+// orderNeeded sorts the needed files according to the pull order. Files are
+// needed in alphabetic order to begin with, so that order requires nothing
+// further. Directories are not affected, as they are all created before any
+// files are pulled.
+func orderNeeded(files []neededFile, order config.PullOrder) {
+	switch order {
+	case config.OrderRandom:
+		for i := len(files) - 1; i > 0; i-- {
+			j := rand.Intn(i + 1)
+			files[i], files[j] = files[j], files[i]
+		}
+	case config.OrderSmallestFirst:
+		sort.Stable(neededBySize(files))
+	case config.OrderLargestFirst:
+		sort.Stable(sort.Reverse(neededBySize(files)))
+	case config.OrderOldestFirst:
+		sort.Stable(neededByModified(files))
+	case config.OrderNewestFirst:
+		sort.Stable(sort.Reverse(neededByModified(files)))
+	}
+}
+
+type neededBySize []neededFile
+
+func (l neededBySize) Len() int {
+	return len(l)
+}
+
+func (l neededBySize) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l neededBySize) Less(a, b int) bool {
+	return l[a].size < l[b].size
+}
+
+type neededByModified []neededFile
+
+func (l neededByModified) Len() int {
+	return len(l)
+}
+
+func (l neededByModified) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l neededByModified) Less(a, b int) bool {
+	return l[a].modified < l[b].modified
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestOrderNeeded(t *testing.T) {
+	needed := []neededFile{
+		{name: "a", size: 300, modified: 2},
+		{name: "b", size: 100, modified: 3},
+		{name: "c", size: 200, modified: 1},
+		{name: "d", size: 100, modified: 1},
+	}
+
+	cases := []struct {
+		order    config.PullOrder
+		expected []string
+	}{
+		{"", []string{"a", "b", "c", "d"}},
+		{config.OrderAlphabetic, []string{"a", "b", "c", "d"}},
+		{config.OrderSmallestFirst, []string{"b", "d", "c", "a"}},
+		{config.OrderLargestFirst, []string{"a", "c", "b", "d"}},
+		{config.OrderOldestFirst, []string{"c", "d", "a", "b"}},
+		{config.OrderNewestFirst, []string{"b", "a", "c", "d"}},
+	}
+
+	for _, tc := range cases {
+		files := make([]neededFile, len(needed))
+		copy(files, needed)
+		orderNeeded(files, tc.order)
+
+		var names []string
+		for _, f := range files {
+			names = append(names, f.name)
+		}
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("order %q: %v != %v", tc.order, names, tc.expected)
+		}
+	}
+
+	// Random order is a permutation of the files.
+	files := make([]neededFile, len(needed))
+	copy(files, needed)
+	orderNeeded(files, config.OrderRandom)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"a", "b", "c", "d"}) {
+		t.Errorf("random order lost files: %v", names)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"sync"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// A remoteProgress keeps the blocks that other devices have of files they
+// are still downloading, as advertised in DownloadProgress messages.
+type remoteProgress struct {
+	files map[protocol.DeviceID]map[string]map[string]*remoteFile // device -> folder -> name
+	mut   sync.RWMutex
+}
+
+type remoteFile struct {
+	version protocol.Vector
+	blocks  map[uint32]struct{}
+}
+
+func newRemoteProgress() *remoteProgress {
+	return &remoteProgress{
+		files: make(map[protocol.DeviceID]map[string]map[string]*remoteFile),
+	}
+}
+
+func (r *remoteProgress) update(deviceID protocol.DeviceID, folder string, updates []protocol.FileDownloadProgressUpdate) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	folders, ok := r.files[deviceID]
+	if !ok {
+		folders = make(map[string]map[string]*remoteFile)
+		r.files[deviceID] = folders
+	}
+	files, ok := folders[folder]
+	if !ok {
+		files = make(map[string]*remoteFile)
+		folders[folder] = files
+	}
+
+	for _, u := range updates {
+		switch u.UpdateType {
+		case protocol.UpdateTypeForget:
+			if f, ok := files[u.Name]; ok && f.version.Equal(u.Version) {
+				delete(files, u.Name)
+			}
+
+		case protocol.UpdateTypeAppend:
+			f, ok := files[u.Name]
+			if !ok || !f.version.Equal(u.Version) {
+				// A new version replaces whatever we knew about the file.
+				f = &remoteFile{
+					version: u.Version,
+					blocks:  make(map[uint32]struct{}, len(u.BlockIndexes)),
+				}
+				files[u.Name] = f
+			}
+			for _, i := range u.BlockIndexes {
+				f.blocks[i] = struct{}{}
+			}
+
+		default:
+			if debug {
+				l.Debugf("remoteProgress: %s: unknown update type %d for %q", deviceID, u.UpdateType, u.Name)
+			}
+		}
+	}
+}
+
+// forget drops everything advertised by the device.
+func (r *remoteProgress) forget(deviceID protocol.DeviceID) {
+	r.mut.Lock()
+	delete(r.files, deviceID)
+	r.mut.Unlock()
+}
+
+// devices returns the devices that have advertised the given block of the
+// given version of the file.
+func (r *remoteProgress) devices(folder string, file protocol.FileInfo, block protocol.BlockInfo) []protocol.DeviceID {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	index := blockIndex(block)
+	var devices []protocol.DeviceID
+	for deviceID, folders := range r.files {
+		f, ok := folders[folder][file.Name]
+		if !ok || !f.version.Equal(file.Version) {
+			continue
+		}
+		if _, ok := f.blocks[index]; ok {
+			devices = append(devices, deviceID)
+		}
+	}
+	return devices
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+func TestRemoteProgress(t *testing.T) {
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+	file := protocol.FileInfo{Name: "file", Version: v1}
+	block := func(i int64) protocol.BlockInfo {
+		return protocol.BlockInfo{Offset: i * protocol.BlockSize}
+	}
+
+	rp := newRemoteProgress()
+	rp.update(device1, "default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "file", Version: v1, BlockIndexes: []uint32{0, 1}},
+	})
+	rp.update(device2, "default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "file", Version: v1, BlockIndexes: []uint32{1}},
+	})
+
+	if devs := rp.devices("default", file, block(0)); !reflect.DeepEqual(devs, []protocol.DeviceID{device1}) {
+		t.Errorf("incorrect devices for block 0: %v", devs)
+	}
+	if devs := rp.devices("default", file, block(1)); len(devs) != 2 {
+		t.Errorf("incorrect devices for block 1: %v", devs)
+	}
+	if devs := rp.devices("default", file, block(2)); len(devs) != 0 {
+		t.Errorf("incorrect devices for block 2: %v", devs)
+	}
+	if devs := rp.devices("other", file, block(0)); len(devs) != 0 {
+		t.Errorf("incorrect devices in other folder: %v", devs)
+	}
+
+	// A new version replaces the blocks of the old one.
+	rp.update(device1, "default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "file", Version: v2, BlockIndexes: []uint32{2}},
+	})
+	if devs := rp.devices("default", file, block(0)); len(devs) != 0 {
+		t.Errorf("old version still available: %v", devs)
+	}
+	file2 := protocol.FileInfo{Name: "file", Version: v2}
+	if devs := rp.devices("default", file2, block(2)); !reflect.DeepEqual(devs, []protocol.DeviceID{device1}) {
+		t.Errorf("incorrect devices for new version: %v", devs)
+	}
+
+	// Forgetting needs the right version.
+	rp.update(device1, "default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeForget, Name: "file", Version: v1},
+	})
+	if devs := rp.devices("default", file2, block(2)); len(devs) != 1 {
+		t.Errorf("forgot the wrong version: %v", devs)
+	}
+	rp.update(device1, "default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeForget, Name: "file", Version: v2},
+	})
+	if devs := rp.devices("default", file2, block(2)); len(devs) != 0 {
+		t.Errorf("forgotten file still available: %v", devs)
+	}
+
+	// Everything from a device is dropped when it disconnects.
+	rp.forget(device2)
+	if devs := rp.devices("default", file, block(1)); len(devs) != 0 {
+		t.Errorf("disconnected device still available: %v", devs)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+const (
+	retryMinIntv = 10 * time.Second
+	retryMaxIntv = time.Hour
+)
+
+// A retryTracker keeps track of the files that failed to sync, so that they
+// can be retried with an exponential backoff instead of holding up the rest
+// of the folder. It's only used from the puller goroutine.
+type retryTracker struct {
+	files map[string]fileRetry
+}
+
+type fileRetry struct {
+	version  protocol.Vector // The version that failed
+	failures int
+	next     time.Time // Don't retry before this
+	err      FileError // The most recent error
+}
+
+// blocked returns true, and the most recent error, if the given version of
+// the file has failed and should not be retried yet. A new version of the
+// file is always tried right away.
+func (t *retryTracker) blocked(file protocol.FileInfo, now time.Time) (FileError, bool) {
+	r, ok := t.files[file.Name]
+	if !ok {
+		return FileError{}, false
+	}
+	if !r.version.Equal(file.Version) {
+		delete(t.files, file.Name)
+		return FileError{}, false
+	}
+	return r.err, now.Before(r.next)
+}
+
+// failed records a failure to sync the given version of a file, and returns
+// how long to wait before trying it again.
+func (t *retryTracker) failed(name string, version protocol.Vector, err FileError, now time.Time) time.Duration {
+	if t.files == nil {
+		t.files = make(map[string]fileRetry)
+	}
+	r := t.files[name]
+	if !r.version.Equal(version) {
+		r = fileRetry{version: version}
+	}
+	r.failures++
+	r.err = err
+
+	intv := retryMinIntv
+	for i := 1; i < r.failures && intv < retryMaxIntv; i++ {
+		intv *= 2
+	}
+	if intv > retryMaxIntv {
+		intv = retryMaxIntv
+	}
+	r.next = now.Add(intv)
+	t.files[name] = r
+	return intv
+}
+
+// prune forgets the files that are no longer needed, i.e. that have been
+// synced or removed from the cluster since they failed.
+func (t *retryTracker) prune(needed map[string]bool) {
+	for name := range t.files {
+		if !needed[name] {
+			delete(t.files, name)
+		}
+	}
+}
+
+// next returns the earliest time a failed file should be retried, and false
+// if there are no failed files.
+func (t *retryTracker) next() (time.Time, bool) {
+	var next time.Time
+	for _, r := range t.files {
+		if next.IsZero() || r.next.Before(next) {
+			next = r.next
+		}
+	}
+	return next, !next.IsZero()
+}
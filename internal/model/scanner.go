@@ -18,13 +18,16 @@ package model
 import (
 	"fmt"
 	"time"
+
+	"github.com/syncthing/syncthing/internal/watcher"
 )
 
 type Scanner struct {
-	folder string
-	intv   time.Duration
-	model  *Model
-	stop   chan struct{}
+	folder  string
+	intv    time.Duration
+	model   *Model
+	stop    chan struct{}
+	watcher *watcher.Watcher
 }
 
 func (s *Scanner) Serve() {
@@ -36,6 +39,13 @@ func (s *Scanner) Serve() {
 	timer := time.NewTimer(time.Millisecond)
 	defer timer.Stop()
 
+	var watchChanges <-chan []string
+	if s.watcher != nil {
+		go s.watcher.Serve()
+		defer s.watcher.Stop()
+		watchChanges = s.watcher.Changes()
+	}
+
 	initialScanCompleted := false
 	for {
 		select {
@@ -59,11 +69,23 @@ func (s *Scanner) Serve() {
 				initialScanCompleted = true
 			}
 
-			if s.intv == 0 {
+			if s.intv > 0 {
+				timer.Reset(s.intv)
+			} else if s.watcher == nil {
 				return
 			}
 
-			timer.Reset(s.intv)
+		case subs := <-watchChanges:
+			if debug {
+				l.Debugln(s, "rescan", subs)
+			}
+
+			s.model.setState(s.folder, FolderScanning)
+			if err := s.model.scanFolderSubs(s.folder, subs); err != nil {
+				s.model.cfg.InvalidateFolder(s.folder, err.Error())
+				return
+			}
+			s.model.setState(s.folder, FolderIdle)
 		}
 	}
 }
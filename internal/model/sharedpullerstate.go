@@ -28,6 +28,7 @@ import (
 type sharedPullerState struct {
 	// Immutable, does not require locking
 	file     protocol.FileInfo
+	curFile  protocol.FileInfo // The file as currently present in the local index, if any
 	folder   string
 	tempName string
 	realName string
@@ -41,6 +42,7 @@ type sharedPullerState struct {
 	copyNeeded int        // Number of copy actions still pending
 	pullNeeded int        // Number of block pulls still pending
 	copyOrigin int        // Number of blocks copied from the original file
+	available  []uint32   // Indexes of the blocks present in the temp file
 	closed     bool       // Set when the file has been closed
 	mut        sync.Mutex // Protects the above
 }
@@ -148,9 +150,10 @@ func (s *sharedPullerState) failed() error {
 	return s.err
 }
 
-func (s *sharedPullerState) copyDone() {
+func (s *sharedPullerState) copyDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.copyNeeded--
+	s.available = append(s.available, blockIndex(block))
 	if debug {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "copyNeeded ->", s.copyNeeded)
 	}
@@ -175,15 +178,97 @@ func (s *sharedPullerState) pullStarted() {
 	s.mut.Unlock()
 }
 
-func (s *sharedPullerState) pullDone() {
+func (s *sharedPullerState) pullDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.pullNeeded--
+	s.available = append(s.available, blockIndex(block))
 	if debug {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded done ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
 }
 
+func (s *sharedPullerState) isClosed() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.closed
+}
+
+// availableBlocks returns the indexes of the blocks present in the temp
+// file, skipping the first n.
+func (s *sharedPullerState) availableBlocks(n int) []uint32 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if n >= len(s.available) {
+		return nil
+	}
+	blocks := make([]uint32, len(s.available)-n)
+	copy(blocks, s.available[n:])
+	return blocks
+}
+
+// readBlock reads a block from the temp file, if it is present there and
+// the offset and size match a block of the file being pulled.
+func (s *sharedPullerState) readBlock(offset int64, size int) ([]byte, error) {
+	s.mut.Lock()
+	var ok bool
+	if !s.closed && hasBlock(s.file, offset, size) {
+		index := uint32(offset / protocol.BlockSize)
+		for _, i := range s.available {
+			if i == index {
+				ok = true
+				break
+			}
+		}
+	}
+	s.mut.Unlock()
+
+	if !ok {
+		return nil, ErrNoSuchFile
+	}
+
+	fd, err := os.Open(s.tempName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	buf := make([]byte, size)
+	_, err = fd.ReadAt(buf, offset)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// progress returns how far the file has come. Byte counts are estimated from
+// the number of blocks done.
+func (s *sharedPullerState) progress() PullerProgress {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	total := s.reused + s.copyTotal + s.pullTotal
+	done := total - s.copyNeeded - s.pullNeeded
+	size := s.file.Size()
+	bytesDone := int64(done) * protocol.BlockSize
+	if bytesDone > size {
+		bytesDone = size
+	}
+
+	return PullerProgress{
+		Total:               total,
+		Reused:              s.reused,
+		CopiedFromOrigin:    s.copyOrigin,
+		CopiedFromElsewhere: s.copyTotal - s.copyNeeded - s.copyOrigin,
+		Pulled:              s.pullTotal - s.pullNeeded,
+		Pulling:             s.pullNeeded,
+		BytesDone:           bytesDone,
+		BytesTotal:          size,
+	}
+}
+
 // finalClose atomically closes and returns closed status of a file. A true
 // first return value means the file was closed and should be finished, with
 // the error indicating the success or failure of the close. A false first
@@ -209,3 +294,8 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 	}
 	return true, nil
 }
+
+// blockIndex returns the index of the block in the block list of its file.
+func blockIndex(block protocol.BlockInfo) uint32 {
+	return uint32(block.Offset / protocol.BlockSize)
+}
@@ -43,3 +43,11 @@ func deadlockDetect(mut sync.Locker, timeout time.Duration) {
 		}
 	}()
 }
+
+// errorString returns the message of the error, or an empty string for nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -13,21 +13,13 @@
 // You should have received a copy of the GNU General Public License along
 // with this program. If not, see <http://www.gnu.org/licenses/>.
 
-package lamport
+// +build !linux,!darwin,!freebsd,!windows
 
-import "testing"
+package osutil
 
-var inputs = []uint64{0, 42, 2, 3, 4, 8, 9, 33, 44, 112, 100}
+import "errors"
 
-func TestClock(t *testing.T) {
-	c := Clock{}
-
-	var prev uint64
-	for _, input := range inputs {
-		cur := c.Tick(input)
-		if cur <= prev || cur <= input {
-			t.Error("Clock moving backwards")
-		}
-		prev = cur
-	}
+// DiskFree is not implemented on this platform and always returns an error.
+func DiskFree(path string) (free, total int64, err error) {
+	return 0, 0, errors.New("checking free disk space is not supported on this platform")
 }
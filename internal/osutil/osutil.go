@@ -28,6 +28,8 @@ import (
 
 var ErrNoHome = errors.New("No home directory found - set $HOME (or the platform equivalent).")
 
+var ErrTraversesSymlink = errors.New("path leads through a symlink or out of the folder")
+
 // Try to keep this entire operation atomic-like. We shouldn't be doing this
 // often enough that there is any contention on this lock.
 var renameLock sync.Mutex
@@ -87,6 +89,41 @@ func InWritableDir(fn func(string) error, path string) error {
 	return fn(path)
 }
 
+// TraversesSymlink returns an error if the directory name, relative to base,
+// leads through a symlink or out of base. Nothing below a component that
+// doesn't exist yet can be a symlink, so the check stops there.
+func TraversesSymlink(base, name string) error {
+	name = filepath.Clean(name)
+	if name == "." {
+		return nil
+	}
+	if filepath.IsAbs(name) {
+		return ErrTraversesSymlink
+	}
+
+	path := base
+	for _, part := range strings.Split(name, string(os.PathSeparator)) {
+		if part == ".." {
+			return ErrTraversesSymlink
+		}
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return ErrTraversesSymlink
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s: not a directory", path)
+		}
+	}
+	return nil
+}
+
 func ExpandTilde(path string) (string, error) {
 	if path == "~" {
 		return getHomeDir()
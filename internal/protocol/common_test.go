@@ -26,6 +26,7 @@ type TestModel struct {
 	name     string
 	offset   int64
 	size     int
+	updates  []FileDownloadProgressUpdate
 	closedCh chan bool
 }
 
@@ -56,6 +57,11 @@ func (t *TestModel) Close(deviceID DeviceID, err error) {
 func (t *TestModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessage) {
 }
 
+func (t *TestModel) DownloadProgress(deviceID DeviceID, folder string, updates []FileDownloadProgressUpdate) {
+	t.folder = folder
+	t.updates = updates
+}
+
 func (t *TestModel) isClosed() bool {
 	select {
 	case <-t.closedCh:
@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"regexp"
@@ -55,6 +56,13 @@ func DeviceIDFromBytes(bs []byte) DeviceID {
 	return n
 }
 
+// Short returns an integer representing the first 64 bits of the device ID.
+// It is used as the device identifier in version vectors, where the full
+// 256 bit ID would be needlessly large.
+func (n DeviceID) Short() uint64 {
+	return binary.BigEndian.Uint64(n[:])
+}
+
 // String returns the canonical string representation of the device ID
 func (n DeviceID) String() string {
 	id := base32.StdEncoding.EncodeToString(n[:])
@@ -26,18 +26,18 @@ type FileInfo struct {
 	Name         string // max:8192
 	Flags        uint32
 	Modified     int64
-	Version      uint64
+	Version      Vector
 	LocalVersion uint64
 	Blocks       []BlockInfo
 }
 
 func (f FileInfo) String() string {
-	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%d, Size:%d, Blocks:%v}",
+	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%v, Size:%d, Blocks:%v}",
 		f.Name, f.Flags, f.Modified, f.Version, f.Size(), f.Blocks)
 }
 
 func (f FileInfo) Size() (bytes int64) {
-	if IsDeleted(f.Flags) || IsDirectory(f.Flags) {
+	if IsDeleted(f.Flags) || IsDirectory(f.Flags) || IsSymlink(f.Flags) {
 		return 128
 	}
 	for _, b := range f.Blocks {
@@ -58,24 +58,32 @@ func (f FileInfo) IsDirectory() bool {
 	return IsDirectory(f.Flags)
 }
 
+func (f FileInfo) IsSymlink() bool {
+	return IsSymlink(f.Flags)
+}
+
+func (f FileInfo) IsLocalChanged() bool {
+	return IsLocalChanged(f.Flags)
+}
+
 // Used for unmarshalling a FileInfo structure but skipping the actual block list
 type FileInfoTruncated struct {
 	Name         string // max:8192
 	Flags        uint32
 	Modified     int64
-	Version      uint64
+	Version      Vector
 	LocalVersion uint64
 	NumBlocks    uint32
 }
 
 func (f FileInfoTruncated) String() string {
-	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%d, Size:%d, NumBlocks:%d}",
+	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%v, Size:%d, NumBlocks:%d}",
 		f.Name, f.Flags, f.Modified, f.Version, f.Size(), f.NumBlocks)
 }
 
 // Returns a statistical guess on the size, not the exact figure
 func (f FileInfoTruncated) Size() int64 {
-	if IsDeleted(f.Flags) || IsDirectory(f.Flags) {
+	if IsDeleted(f.Flags) || IsDirectory(f.Flags) || IsSymlink(f.Flags) {
 		return 128
 	}
 	if f.NumBlocks < 2 {
@@ -93,6 +101,14 @@ func (f FileInfoTruncated) IsInvalid() bool {
 	return IsInvalid(f.Flags)
 }
 
+func (f FileInfoTruncated) IsSymlink() bool {
+	return IsSymlink(f.Flags)
+}
+
+func (f FileInfoTruncated) IsLocalChanged() bool {
+	return IsLocalChanged(f.Flags)
+}
+
 type FileIntf interface {
 	Size() int64
 	IsDeleted() bool
@@ -145,6 +161,7 @@ type Device struct {
 	ID              []byte // max:32
 	Flags           uint32
 	MaxLocalVersion uint64
+	IndexID         uint64
 }
 
 type Option struct {
@@ -152,6 +169,23 @@ type Option struct {
 	Value string // max:1024
 }
 
+// A DownloadProgressMessage tells which blocks of files that are still being
+// downloaded the sender already has.
+type DownloadProgressMessage struct {
+	Folder  string // max:64
+	Updates []FileDownloadProgressUpdate
+}
+
+// A FileDownloadProgressUpdate either adds blocks to those advertised for a
+// version of a file, or says that the file is no longer being downloaded.
+// Blocks are identified by their index in the block list of the file.
+type FileDownloadProgressUpdate struct {
+	UpdateType   uint32
+	Name         string // max:8192
+	Version      Vector
+	BlockIndexes []uint32 // max:1000000
+}
+
 type CloseMessage struct {
 	Reason string // max:1024
 }
@@ -118,9 +118,7 @@ FileInfo Structure:
 +                      Modified (64 bits)                       +
 |                                                               |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-|                                                               |
-+                       Version (64 bits)                       +
-|                                                               |
+|                            Vector                             |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 |                                                               |
 +                    Local Version (64 bits)                    +
@@ -138,7 +136,7 @@ struct FileInfo {
 	string Name<8192>;
 	unsigned int Flags;
 	hyper Modified;
-	unsigned hyper Version;
+	Vector Version;
 	unsigned hyper LocalVersion;
 	BlockInfo Blocks<>;
 }
@@ -176,7 +174,10 @@ func (o FileInfo) encodeXDR(xw *xdr.Writer) (int, error) {
 	xw.WriteString(o.Name)
 	xw.WriteUint32(o.Flags)
 	xw.WriteUint64(uint64(o.Modified))
-	xw.WriteUint64(o.Version)
+	_, err := o.Version.encodeXDR(xw)
+	if err != nil {
+		return xw.Tot(), err
+	}
 	xw.WriteUint64(o.LocalVersion)
 	xw.WriteUint32(uint32(len(o.Blocks)))
 	for i := range o.Blocks {
@@ -203,7 +204,7 @@ func (o *FileInfo) decodeXDR(xr *xdr.Reader) error {
 	o.Name = xr.ReadStringMax(8192)
 	o.Flags = xr.ReadUint32()
 	o.Modified = int64(xr.ReadUint64())
-	o.Version = xr.ReadUint64()
+	(&o.Version).decodeXDR(xr)
 	o.LocalVersion = xr.ReadUint64()
 	_BlocksSize := int(xr.ReadUint32())
 	o.Blocks = make([]BlockInfo, _BlocksSize)
@@ -232,9 +233,7 @@ FileInfoTruncated Structure:
 +                      Modified (64 bits)                       +
 |                                                               |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-|                                                               |
-+                       Version (64 bits)                       +
-|                                                               |
+|                            Vector                             |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 |                                                               |
 +                    Local Version (64 bits)                    +
@@ -248,7 +247,7 @@ struct FileInfoTruncated {
 	string Name<8192>;
 	unsigned int Flags;
 	hyper Modified;
-	unsigned hyper Version;
+	Vector Version;
 	unsigned hyper LocalVersion;
 	unsigned int NumBlocks;
 }
@@ -286,7 +285,10 @@ func (o FileInfoTruncated) encodeXDR(xw *xdr.Writer) (int, error) {
 	xw.WriteString(o.Name)
 	xw.WriteUint32(o.Flags)
 	xw.WriteUint64(uint64(o.Modified))
-	xw.WriteUint64(o.Version)
+	_, err := o.Version.encodeXDR(xw)
+	if err != nil {
+		return xw.Tot(), err
+	}
 	xw.WriteUint64(o.LocalVersion)
 	xw.WriteUint32(o.NumBlocks)
 	return xw.Tot(), xw.Error()
@@ -307,7 +309,7 @@ func (o *FileInfoTruncated) decodeXDR(xr *xdr.Reader) error {
 	o.Name = xr.ReadStringMax(8192)
 	o.Flags = xr.ReadUint32()
 	o.Modified = int64(xr.ReadUint64())
-	o.Version = xr.ReadUint64()
+	(&o.Version).decodeXDR(xr)
 	o.LocalVersion = xr.ReadUint64()
 	o.NumBlocks = xr.ReadUint32()
 	return xr.Error()
@@ -784,12 +786,17 @@ Device Structure:
 +                  Max Local Version (64 bits)                  +
 |                                                               |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                      Index ID (64 bits)                       +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
 
 struct Device {
 	opaque ID<32>;
 	unsigned int Flags;
 	unsigned hyper MaxLocalVersion;
+	unsigned hyper IndexID;
 }
 
 */
@@ -825,6 +832,7 @@ func (o Device) encodeXDR(xw *xdr.Writer) (int, error) {
 	xw.WriteBytes(o.ID)
 	xw.WriteUint32(o.Flags)
 	xw.WriteUint64(o.MaxLocalVersion)
+	xw.WriteUint64(o.IndexID)
 	return xw.Tot(), xw.Error()
 }
 
@@ -843,6 +851,7 @@ func (o *Device) decodeXDR(xr *xdr.Reader) error {
 	o.ID = xr.ReadBytesMax(32)
 	o.Flags = xr.ReadUint32()
 	o.MaxLocalVersion = xr.ReadUint64()
+	o.IndexID = xr.ReadUint64()
 	return xr.Error()
 }
 
@@ -929,6 +938,196 @@ func (o *Option) decodeXDR(xr *xdr.Reader) error {
 
 /*
 
+DownloadProgressMessage Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                       Length of Folder                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                   Folder (variable length)                    \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                       Number of Updates                       |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\      Zero or more FileDownloadProgressUpdate Structures       \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct DownloadProgressMessage {
+	string Folder<64>;
+	FileDownloadProgressUpdate Updates<>;
+}
+
+*/
+
+func (o DownloadProgressMessage) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.encodeXDR(xw)
+}
+
+func (o DownloadProgressMessage) MarshalXDR() ([]byte, error) {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o DownloadProgressMessage) MustMarshalXDR() []byte {
+	bs, err := o.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (o DownloadProgressMessage) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.encodeXDR(xw)
+	return []byte(aw), err
+}
+
+func (o DownloadProgressMessage) encodeXDR(xw *xdr.Writer) (int, error) {
+	if l := len(o.Folder); l > 64 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Folder", l, 64)
+	}
+	xw.WriteString(o.Folder)
+	xw.WriteUint32(uint32(len(o.Updates)))
+	for i := range o.Updates {
+		_, err := o.Updates[i].encodeXDR(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	return xw.Tot(), xw.Error()
+}
+
+func (o *DownloadProgressMessage) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.decodeXDR(xr)
+}
+
+func (o *DownloadProgressMessage) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *DownloadProgressMessage) decodeXDR(xr *xdr.Reader) error {
+	o.Folder = xr.ReadStringMax(64)
+	_UpdatesSize := int(xr.ReadUint32())
+	o.Updates = make([]FileDownloadProgressUpdate, _UpdatesSize)
+	for i := range o.Updates {
+		(&o.Updates[i]).decodeXDR(xr)
+	}
+	return xr.Error()
+}
+
+/*
+
+FileDownloadProgressUpdate Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                          Update Type                          |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of Name                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    Name (variable length)                     \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                            Vector                             |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                    Number of Block Indexes                    |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                         Block Indexes                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct FileDownloadProgressUpdate {
+	unsigned int UpdateType;
+	string Name<8192>;
+	Vector Version;
+	unsigned int BlockIndexes<1000000>;
+}
+
+*/
+
+func (o FileDownloadProgressUpdate) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.encodeXDR(xw)
+}
+
+func (o FileDownloadProgressUpdate) MarshalXDR() ([]byte, error) {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o FileDownloadProgressUpdate) MustMarshalXDR() []byte {
+	bs, err := o.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (o FileDownloadProgressUpdate) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.encodeXDR(xw)
+	return []byte(aw), err
+}
+
+func (o FileDownloadProgressUpdate) encodeXDR(xw *xdr.Writer) (int, error) {
+	xw.WriteUint32(o.UpdateType)
+	if l := len(o.Name); l > 8192 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Name", l, 8192)
+	}
+	xw.WriteString(o.Name)
+	_, err := o.Version.encodeXDR(xw)
+	if err != nil {
+		return xw.Tot(), err
+	}
+	if l := len(o.BlockIndexes); l > 1000000 {
+		return xw.Tot(), xdr.ElementSizeExceeded("BlockIndexes", l, 1000000)
+	}
+	xw.WriteUint32(uint32(len(o.BlockIndexes)))
+	for i := range o.BlockIndexes {
+		xw.WriteUint32(o.BlockIndexes[i])
+	}
+	return xw.Tot(), xw.Error()
+}
+
+func (o *FileDownloadProgressUpdate) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.decodeXDR(xr)
+}
+
+func (o *FileDownloadProgressUpdate) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *FileDownloadProgressUpdate) decodeXDR(xr *xdr.Reader) error {
+	o.UpdateType = xr.ReadUint32()
+	o.Name = xr.ReadStringMax(8192)
+	(&o.Version).decodeXDR(xr)
+	_BlockIndexesSize := int(xr.ReadUint32())
+	if _BlockIndexesSize > 1000000 {
+		return xdr.ElementSizeExceeded("BlockIndexes", _BlockIndexesSize, 1000000)
+	}
+	o.BlockIndexes = make([]uint32, _BlockIndexesSize)
+	for i := range o.BlockIndexes {
+		o.BlockIndexes[i] = xr.ReadUint32()
+	}
+	return xr.Error()
+}
+
+/*
+
 CloseMessage Structure:
 
  0                   1                   2                   3
@@ -48,6 +48,13 @@ func (m nativeModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessag
 	m.next.ClusterConfig(deviceID, config)
 }
 
+func (m nativeModel) DownloadProgress(deviceID DeviceID, folder string, updates []FileDownloadProgressUpdate) {
+	for i := range updates {
+		updates[i].Name = norm.NFD.String(updates[i].Name)
+	}
+	m.next.DownloadProgress(deviceID, folder, updates)
+}
+
 func (m nativeModel) Close(deviceID DeviceID, err error) {
 	m.next.Close(deviceID, err)
 }
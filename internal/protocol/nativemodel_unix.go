@@ -39,6 +39,10 @@ func (m nativeModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessag
 	m.next.ClusterConfig(deviceID, config)
 }
 
+func (m nativeModel) DownloadProgress(deviceID DeviceID, folder string, updates []FileDownloadProgressUpdate) {
+	m.next.DownloadProgress(deviceID, folder, updates)
+}
+
 func (m nativeModel) Close(deviceID DeviceID, err error) {
 	m.next.Close(deviceID, err)
 }
@@ -29,17 +29,28 @@ import (
 
 const (
 	BlockSize = 128 * 1024
+
+	// The version field of message headers. Version 1 (BEP v2) replaced the
+	// scalar file versions by version vectors and added index IDs. Messages
+	// of other versions can't be parsed, so they terminate the connection.
+	protocolVersion = 1
+)
+
+const (
+	messageTypeClusterConfig    = 0
+	messageTypeIndex            = 1
+	messageTypeRequest          = 2
+	messageTypeResponse         = 3
+	messageTypePing             = 4
+	messageTypePong             = 5
+	messageTypeIndexUpdate      = 6
+	messageTypeClose            = 7
+	messageTypeDownloadProgress = 8
 )
 
 const (
-	messageTypeClusterConfig = 0
-	messageTypeIndex         = 1
-	messageTypeRequest       = 2
-	messageTypeResponse      = 3
-	messageTypePing          = 4
-	messageTypePong          = 5
-	messageTypeIndexUpdate   = 6
-	messageTypeClose         = 7
+	UpdateTypeAppend uint32 = 0
+	UpdateTypeForget uint32 = 1
 )
 
 const (
@@ -53,6 +64,12 @@ const (
 	FlagInvalid           = 1 << 13
 	FlagDirectory         = 1 << 14
 	FlagNoPermBits        = 1 << 15
+	FlagSymlink           = 1 << 16
+
+	// FlagLocalChanged marks files in receive only folders that have been
+	// changed locally. It is only used in the local index and is never sent
+	// over the wire.
+	FlagLocalChanged = 1 << 17
 )
 
 const (
@@ -76,17 +93,21 @@ type Model interface {
 	Request(deviceID DeviceID, folder string, name string, offset int64, size int) ([]byte, error)
 	// A cluster configuration message was received
 	ClusterConfig(deviceID DeviceID, config ClusterConfigMessage)
+	// The peer device advertised progress of files it is downloading
+	DownloadProgress(deviceID DeviceID, folder string, updates []FileDownloadProgressUpdate)
 	// The peer device closed the connection
 	Close(deviceID DeviceID, err error)
 }
 
 type Connection interface {
+	Start()
 	ID() DeviceID
 	Name() string
 	Index(folder string, files []FileInfo) error
 	IndexUpdate(folder string, files []FileInfo) error
 	Request(folder string, name string, offset int64, size int) ([]byte, error)
 	ClusterConfig(config ClusterConfigMessage)
+	DownloadProgress(folder string, updates []FileDownloadProgressUpdate)
 	Statistics() Statistics
 }
 
@@ -155,12 +176,18 @@ func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiv
 		compressionThreshold: compThres,
 	}
 
+	return wireFormatConnection{&c}
+}
+
+// Start creates the goroutines for sending and receiving of messages. It must
+// be called exactly once after creating a connection. Messages are not
+// delivered to the Model before Start has been called, which gives the
+// caller a chance to set up any state needed to handle them.
+func (c *rawConnection) Start() {
 	go c.readerLoop()
 	go c.writerLoop()
 	go c.pingerLoop()
 	go c.idGenerator()
-
-	return wireFormatConnection{&c}
 }
 
 func (c *rawConnection) ID() DeviceID {
@@ -231,6 +258,11 @@ func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.send(-1, messageTypeClusterConfig, config)
 }
 
+// DownloadProgress advertises the progress of files being downloaded.
+func (c *rawConnection) DownloadProgress(folder string, updates []FileDownloadProgressUpdate) {
+	c.send(-1, messageTypeDownloadProgress, DownloadProgressMessage{folder, updates})
+}
+
 func (c *rawConnection) ping() bool {
 	var id int
 	select {
@@ -307,9 +339,18 @@ func (c *rawConnection) readerLoop() (err error) {
 			if c.state != stateInitial {
 				return fmt.Errorf("protocol error: cluster config message in state %d", c.state)
 			}
-			go c.receiver.ClusterConfig(c.id, msg.(ClusterConfigMessage))
+			// Handled synchronously, so that the receiver has seen the
+			// cluster config (and the index IDs in it) before any index
+			// message is processed.
+			c.receiver.ClusterConfig(c.id, msg.(ClusterConfigMessage))
 			c.state = stateCCRcvd
 
+		case messageTypeDownloadProgress:
+			if c.state < stateCCRcvd {
+				return fmt.Errorf("protocol error: download progress message in state %d", c.state)
+			}
+			c.handleDownloadProgress(msg.(DownloadProgressMessage))
+
 		case messageTypeClose:
 			return errors.New(msg.(CloseMessage).Reason)
 
@@ -337,6 +378,11 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		l.Debugf("read header %v (msglen=%d)", hdr, msglen)
 	}
 
+	if hdr.version != protocolVersion {
+		err = fmt.Errorf("protocol error: unsupported message version %d (expected %d); the other device runs an incompatible version", hdr.version, protocolVersion)
+		return
+	}
+
 	if cap(c.rdbuf0) < msglen {
 		c.rdbuf0 = make([]byte, msglen)
 	} else {
@@ -401,6 +447,11 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		err = cm.UnmarshalXDR(msgBuf)
 		msg = cm
 
+	case messageTypeDownloadProgress:
+		var dp DownloadProgressMessage
+		err = dp.UnmarshalXDR(msgBuf)
+		msg = dp
+
 	default:
 		err = fmt.Errorf("protocol error: %s: unknown message type %#x", c.id, hdr.msgType)
 	}
@@ -422,6 +473,13 @@ func (c *rawConnection) handleIndexUpdate(im IndexMessage) {
 	c.receiver.IndexUpdate(c.id, im.Folder, im.Files)
 }
 
+func (c *rawConnection) handleDownloadProgress(dp DownloadProgressMessage) {
+	if debug {
+		l.Debugf("DownloadProgress(%v, %v, %d updates)", c.id, dp.Folder, len(dp.Updates))
+	}
+	c.receiver.DownloadProgress(c.id, dp.Folder, dp.Updates)
+}
+
 func (c *rawConnection) handleRequest(msgID int, req RequestMessage) {
 	data, _ := c.receiver.Request(c.id, req.Folder, req.Name, int64(req.Offset), int(req.Size))
 
@@ -459,7 +517,7 @@ func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
 	}
 
 	hdr := header{
-		version: 0,
+		version: protocolVersion,
 		msgID:   msgID,
 		msgType: msgType,
 	}
@@ -650,6 +708,14 @@ func IsDirectory(bits uint32) bool {
 	return bits&FlagDirectory != 0
 }
 
+func IsSymlink(bits uint32) bool {
+	return bits&FlagSymlink != 0
+}
+
+func IsLocalChanged(bits uint32) bool {
+	return bits&FlagLocalChanged != 0
+}
+
 func HasPermissionBits(bits uint32) bool {
 	return bits&FlagNoPermBits == 0
 }
@@ -81,7 +81,9 @@ func TestPing(t *testing.T) {
 	br, bw := io.Pipe()
 
 	c0 := NewConnection(c0ID, ar, bw, nil, "name", true).(wireFormatConnection).next.(*rawConnection)
+	c0.Start()
 	c1 := NewConnection(c1ID, br, aw, nil, "name", true).(wireFormatConnection).next.(*rawConnection)
+	c1.Start()
 
 	if ok := c0.ping(); !ok {
 		t.Error("c0 ping failed")
@@ -105,7 +107,9 @@ func TestPingErr(t *testing.T) {
 			ebw := &ErrPipe{PipeWriter: *bw, max: j, err: e}
 
 			c0 := NewConnection(c0ID, ar, ebw, m0, "name", true).(wireFormatConnection).next.(*rawConnection)
-			NewConnection(c1ID, br, eaw, m1, "name", true)
+			c0.Start()
+			c1 := NewConnection(c1ID, br, eaw, m1, "name", true)
+			c1.Start()
 
 			res := c0.ping()
 			if (i < 8 || j < 8) && res {
@@ -181,11 +185,14 @@ func TestVersionErr(t *testing.T) {
 	br, bw := io.Pipe()
 
 	c0 := NewConnection(c0ID, ar, bw, m0, "name", true).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", true)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, m1, "name", true)
+	c1.Start()
 
+	// A BEP v1 device, which uses scalar file versions
 	w := xdr.NewWriter(c0.cw)
 	w.WriteUint32(encodeHeader(header{
-		version: 2,
+		version: 0,
 		msgID:   0,
 		msgType: 0,
 	}))
@@ -204,11 +211,13 @@ func TestTypeErr(t *testing.T) {
 	br, bw := io.Pipe()
 
 	c0 := NewConnection(c0ID, ar, bw, m0, "name", true).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", true)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, m1, "name", true)
+	c1.Start()
 
 	w := xdr.NewWriter(c0.cw)
 	w.WriteUint32(encodeHeader(header{
-		version: 0,
+		version: protocolVersion,
 		msgID:   0,
 		msgType: 42,
 	}))
@@ -227,7 +236,9 @@ func TestClose(t *testing.T) {
 	br, bw := io.Pipe()
 
 	c0 := NewConnection(c0ID, ar, bw, m0, "name", true).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", true)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, m1, "name", true)
+	c1.Start()
 
 	c0.close(nil)
 
@@ -349,6 +360,61 @@ func TestMarshalCloseMessage(t *testing.T) {
 	}
 }
 
+func TestMarshalDownloadProgressMessage(t *testing.T) {
+	var quickCfg = &quick.Config{MaxCountScale: 10}
+	if testing.Short() {
+		quickCfg = nil
+	}
+
+	f := func(m1 DownloadProgressMessage) bool {
+		for i := range m1.Updates {
+			if len(m1.Updates[i].BlockIndexes) == 0 {
+				m1.Updates[i].BlockIndexes = []uint32{}
+			}
+		}
+		return testMarshal(t, "downloadprogress", &m1, &DownloadProgressMessage{})
+	}
+
+	if err := quick.Check(f, quickCfg); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadProgress(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", true)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, m1, "name", true)
+	c1.Start()
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+
+	updates := []FileDownloadProgressUpdate{
+		{UpdateType: UpdateTypeAppend, Name: "file", Version: Vector{{ID: 1, Value: 2}}, BlockIndexes: []uint32{0, 2, 3}},
+		{UpdateType: UpdateTypeForget, Name: "other", Version: Vector{{ID: 1, Value: 1}}, BlockIndexes: []uint32{}},
+	}
+	c0.DownloadProgress("default", updates)
+
+	// The message is handled asynchronously; a ping round trip after it
+	// makes sure that it has been.
+	if ok := c1.(wireFormatConnection).next.(*rawConnection).ping(); !ok {
+		t.Fatal("ping failed")
+	}
+
+	if m1.folder != "default" {
+		t.Errorf("incorrect folder %q", m1.folder)
+	}
+	if !reflect.DeepEqual(m1.updates, updates) {
+		t.Errorf("incorrect updates\n  got: %+v\n  expected: %+v", m1.updates, updates)
+	}
+}
+
 type message interface {
 	EncodeXDR(io.Writer) (int, error)
 	DecodeXDR(io.Reader) error
@@ -0,0 +1,221 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// The Vector type represents a version vector. The zero value is a usable
+// version vector. The counters are kept sorted on ID. Operations that modify
+// the vector return a new Vector and leave the original untouched.
+type Vector []Counter
+
+// Counter represents a single counter in the version vector.
+type Counter struct {
+	ID    uint64
+	Value uint64
+}
+
+// Ordering describes the relation between two version vectors.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Greater
+	Lesser
+	ConcurrentGreater
+	ConcurrentLesser
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Greater:
+		return "greater"
+	case Lesser:
+		return "lesser"
+	case ConcurrentGreater:
+		return "concurrent-greater"
+	case ConcurrentLesser:
+		return "concurrent-lesser"
+	default:
+		return "unknown"
+	}
+}
+
+// Update returns a Vector with the counter for the given ID incremented by
+// one. A new counter is inserted if the ID was not previously present.
+func (v Vector) Update(id uint64) Vector {
+	for i := range v {
+		if v[i].ID == id {
+			nv := v.Copy()
+			nv[i].Value++
+			return nv
+		} else if v[i].ID > id {
+			// Insert a new counter at this position, keeping the vector sorted
+			nv := make(Vector, len(v)+1)
+			copy(nv, v[:i])
+			nv[i] = Counter{id, 1}
+			copy(nv[i+1:], v[i:])
+			return nv
+		}
+	}
+
+	// Append a new counter at the end
+	nv := make(Vector, len(v)+1)
+	copy(nv, v)
+	nv[len(v)] = Counter{id, 1}
+	return nv
+}
+
+// Merge returns a Vector holding, for every ID present in either vector, the
+// highest counter value of the two.
+func (v Vector) Merge(b Vector) Vector {
+	nv := make(Vector, 0, len(v)+len(b))
+	var vi, bi int
+	for vi < len(v) || bi < len(b) {
+		switch {
+		case bi == len(b) || (vi < len(v) && v[vi].ID < b[bi].ID):
+			nv = append(nv, v[vi])
+			vi++
+		case vi == len(v) || b[bi].ID < v[vi].ID:
+			nv = append(nv, b[bi])
+			bi++
+		default:
+			c := v[vi]
+			if b[bi].Value > c.Value {
+				c.Value = b[bi].Value
+			}
+			nv = append(nv, c)
+			vi++
+			bi++
+		}
+	}
+	return nv
+}
+
+// Copy returns an identical vector that shares no memory with the original.
+func (v Vector) Copy() Vector {
+	nv := make(Vector, len(v))
+	copy(nv, v)
+	return nv
+}
+
+// Counter returns the current value of the counter for the given ID, or
+// zero if the ID is not present.
+func (v Vector) Counter(id uint64) uint64 {
+	for _, c := range v {
+		if c.ID == id {
+			return c.Value
+		}
+	}
+	return 0
+}
+
+// Equal returns true when the two vectors are equivalent.
+func (a Vector) Equal(b Vector) bool {
+	return a.Compare(b) == Equal
+}
+
+// LesserEqual returns true when the two vectors are equivalent or a is
+// causally older than b.
+func (a Vector) LesserEqual(b Vector) bool {
+	comp := a.Compare(b)
+	return comp == Lesser || comp == Equal
+}
+
+// GreaterEqual returns true when the two vectors are equivalent or a is
+// causally newer than b.
+func (a Vector) GreaterEqual(b Vector) bool {
+	comp := a.Compare(b)
+	return comp == Greater || comp == Equal
+}
+
+// Concurrent returns true when the two vectors are concurrent, that is when
+// neither of them is causally derived from the other.
+func (a Vector) Concurrent(b Vector) bool {
+	comp := a.Compare(b)
+	return comp == ConcurrentGreater || comp == ConcurrentLesser
+}
+
+// Compare returns the Ordering that describes a's relation to b. Concurrent
+// vectors are additionally given a consistent (but causally meaningless)
+// ordering, so that all devices select the same winner among them: the
+// vector with the higher counter for the lowest differing ID is considered
+// ConcurrentGreater.
+func (a Vector) Compare(b Vector) Ordering {
+	var ai, bi int
+	var greater, lesser bool
+	var tiebreak Ordering
+
+	for ai < len(a) || bi < len(b) {
+		var av, bv uint64
+		switch {
+		case bi == len(b) || (ai < len(a) && a[ai].ID < b[bi].ID):
+			// Counter is missing on the b side
+			av = a[ai].Value
+			ai++
+		case ai == len(a) || b[bi].ID < a[ai].ID:
+			// Counter is missing on the a side
+			bv = b[bi].Value
+			bi++
+		default:
+			av = a[ai].Value
+			bv = b[bi].Value
+			ai++
+			bi++
+		}
+
+		if av > bv {
+			greater = true
+			if tiebreak == Equal {
+				tiebreak = ConcurrentGreater
+			}
+		} else if av < bv {
+			lesser = true
+			if tiebreak == Equal {
+				tiebreak = ConcurrentLesser
+			}
+		}
+	}
+
+	switch {
+	case greater && lesser:
+		return tiebreak
+	case greater:
+		return Greater
+	case lesser:
+		return Lesser
+	default:
+		return Equal
+	}
+}
+
+func (v Vector) String() string {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, c := range v {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%x:%d", c.ID, c.Value)
+	}
+	b.WriteString("}")
+	return b.String()
+}
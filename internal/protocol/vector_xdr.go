@@ -0,0 +1,88 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"errors"
+
+	"github.com/calmh/xdr"
+)
+
+// The Vector is not a struct and so can't be handled by genxdr. We implement
+// the XDR serialization by hand, using the same layout genxdr would use for a
+// Counter<> list:
+//
+//	struct Counter {
+//		unsigned hyper ID;
+//		unsigned hyper Value;
+//	}
+//
+//	Counter Vector<>;
+
+// maxVectorLength is the maximum number of counters accepted when decoding
+// a vector. Each device that has modified a file adds one counter.
+const maxVectorLength = 1000
+
+// errUnsortedVector is returned when decoding a vector with counters that
+// are not sorted by ID, or with more than one counter for an ID. Comparing
+// and merging vectors depends on them being sorted.
+var errUnsortedVector = errors.New("vector counters are not sorted by unique ID")
+
+// EncodeXDRInto encodes the vector as an XDR object into the given writer.
+func (v Vector) EncodeXDRInto(xw *xdr.Writer) (int, error) {
+	if l := len(v); l > maxVectorLength {
+		return xw.Tot(), xdr.ElementSizeExceeded("Vector", l, maxVectorLength)
+	}
+	xw.WriteUint32(uint32(len(v)))
+	for i := range v {
+		xw.WriteUint64(v[i].ID)
+		xw.WriteUint64(v[i].Value)
+	}
+	return xw.Tot(), xw.Error()
+}
+
+// DecodeXDRFrom decodes the XDR object from the given reader into itself.
+func (v *Vector) DecodeXDRFrom(xr *xdr.Reader) error {
+	l := int(xr.ReadUint32())
+	if l > maxVectorLength {
+		return xdr.ElementSizeExceeded("Vector", l, maxVectorLength)
+	}
+	n := make(Vector, l)
+	for i := range n {
+		n[i].ID = xr.ReadUint64()
+		n[i].Value = xr.ReadUint64()
+	}
+	if err := xr.Error(); err != nil {
+		return err
+	}
+	for i := 1; i < len(n); i++ {
+		if n[i].ID <= n[i-1].ID {
+			return errUnsortedVector
+		}
+	}
+	*v = n
+	return nil
+}
+
+// encodeXDR and decodeXDR are the names genxdr expects for nested types.
+
+func (v Vector) encodeXDR(xw *xdr.Writer) (int, error) {
+	return v.EncodeXDRInto(xw)
+}
+
+func (v *Vector) decodeXDR(xr *xdr.Reader) error {
+	return v.DecodeXDRFrom(xr)
+}
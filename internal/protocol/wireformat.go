@@ -25,6 +25,10 @@ type wireFormatConnection struct {
 	next Connection
 }
 
+func (c wireFormatConnection) Start() {
+	c.next.Start()
+}
+
 func (c wireFormatConnection) ID() DeviceID {
 	return c.next.ID()
 }
@@ -64,6 +68,17 @@ func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.next.ClusterConfig(config)
 }
 
+func (c wireFormatConnection) DownloadProgress(folder string, updates []FileDownloadProgressUpdate) {
+	var myUpdates = make([]FileDownloadProgressUpdate, len(updates))
+	copy(myUpdates, updates)
+
+	for i := range updates {
+		myUpdates[i].Name = norm.NFC.String(filepath.ToSlash(myUpdates[i].Name))
+	}
+
+	c.next.DownloadProgress(folder, myUpdates)
+}
+
 func (c wireFormatConnection) Statistics() Statistics {
 	return c.next.Statistics()
 }
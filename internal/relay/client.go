@@ -0,0 +1,315 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/dialer"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+const (
+	dialTimeout    = 10 * time.Second
+	messageTimeout = 30 * time.Second
+	retryInterval  = 60 * time.Second
+)
+
+// A Client keeps a connection to a relay in protocol mode, making this device
+// reachable through the relay. Requests from other devices to connect to us
+// arrive as SessionInvitations on the invitations channel.
+type Client struct {
+	uri         *url.URL
+	certs       []tls.Certificate
+	invitations chan<- SessionInvitation
+	timeout     time.Duration
+	stop        chan struct{}
+
+	mut       sync.Mutex
+	connected bool
+}
+
+// NewClient returns a client for the relay at the given URI, of the form
+// relay://host:port/?id=RELAYID. The relay is expected to send a ping within
+// the given timeout; the connection is otherwise considered dead.
+func NewClient(uri *url.URL, certs []tls.Certificate, invitations chan<- SessionInvitation, timeout time.Duration) *Client {
+	return &Client{
+		uri:         uri,
+		certs:       certs,
+		invitations: invitations,
+		timeout:     timeout,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Serve joins the relay and keeps rejoining it until Stop is called.
+func (c *Client) Serve() {
+	for {
+		err := c.serveOnce()
+		c.setConnected(false)
+
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		l.Infof("Relay %s: %v; retrying in %v", c.uri, err, retryInterval)
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Stop disconnects from the relay and makes Serve return.
+func (c *Client) Stop() {
+	close(c.stop)
+}
+
+// Connected returns true if the client is currently joined to the relay.
+func (c *Client) Connected() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.connected
+}
+
+func (c *Client) String() string {
+	return fmt.Sprintf("relay.Client@%p(%s)", c, c.uri)
+}
+
+func (c *Client) setConnected(v bool) {
+	c.mut.Lock()
+	c.connected = v
+	c.mut.Unlock()
+}
+
+func (c *Client) serveOnce() error {
+	conn, err := connectToRelay(c.uri, c.certs)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := WriteMessage(conn, JoinRelayRequest{}); err != nil {
+		return err
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+	if resp, ok := msg.(Response); !ok {
+		return fmt.Errorf("protocol error: unexpected %T", msg)
+	} else if resp.Code != ResponseCodeSuccess {
+		return resp
+	}
+	conn.SetDeadline(time.Time{})
+
+	if debug {
+		l.Debugln("relay: joined", c.uri)
+	}
+	c.setConnected(true)
+
+	// The reader exits when the connection is closed on return, or when it
+	// can't hand over a message because we're done with this session.
+	messages := make(chan interface{})
+	errors := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(c.timeout))
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				errors <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-messages:
+			switch msg := msg.(type) {
+			case Ping:
+				conn.SetWriteDeadline(time.Now().Add(messageTimeout))
+				if err := WriteMessage(conn, Pong{}); err != nil {
+					return err
+				}
+
+			case SessionInvitation:
+				if len(msg.From) != len(protocol.DeviceID{}) {
+					return fmt.Errorf("protocol error: invalid device ID in invitation")
+				}
+				if debug {
+					l.Debugln("relay: invitation from", protocol.DeviceIDFromBytes(msg.From), "via", c.uri)
+				}
+				fillAddress(&msg, conn)
+				select {
+				case c.invitations <- msg:
+				case <-c.stop:
+					return nil
+				}
+
+			default:
+				return fmt.Errorf("protocol error: unexpected %T", msg)
+			}
+
+		case err := <-errors:
+			return err
+
+		case <-c.stop:
+			return nil
+		}
+	}
+}
+
+// GetInvitationFromRelay asks the relay at the given URI to set up a session
+// with the given device, which must be joined to the relay.
+func GetInvitationFromRelay(uri *url.URL, id protocol.DeviceID, certs []tls.Certificate) (SessionInvitation, error) {
+	conn, err := connectToRelay(uri, certs)
+	if err != nil {
+		return SessionInvitation{}, err
+	}
+	defer conn.Close()
+
+	if err := WriteMessage(conn, ConnectRequest{ID: id[:]}); err != nil {
+		return SessionInvitation{}, err
+	}
+
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return SessionInvitation{}, err
+	}
+
+	switch msg := msg.(type) {
+	case Response:
+		return SessionInvitation{}, msg
+	case SessionInvitation:
+		if len(msg.From) != len(protocol.DeviceID{}) {
+			return SessionInvitation{}, fmt.Errorf("protocol error: invalid device ID in invitation")
+		}
+		fillAddress(&msg, conn)
+		return msg, nil
+	default:
+		return SessionInvitation{}, fmt.Errorf("protocol error: unexpected %T", msg)
+	}
+}
+
+// JoinSession connects to the session given by the invitation. The returned
+// connection is a plain byte stream to the other device, on which the
+// caller is expected to perform the TLS handshake.
+func JoinSession(invitation SessionInvitation) (net.Conn, error) {
+	addr := net.JoinHostPort(net.IP(invitation.Address).String(), strconv.Itoa(int(invitation.Port)))
+	conn, err := dialer.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(messageTimeout))
+	if err := WriteMessage(conn, JoinSessionRequest{Key: invitation.Key}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp, ok := msg.(Response); !ok {
+		conn.Close()
+		return nil, fmt.Errorf("protocol error: unexpected %T", msg)
+	} else if resp.Code != ResponseCodeSuccess {
+		conn.Close()
+		return nil, resp
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connectToRelay sets up a protocol mode connection to the relay, verifying
+// the relay's device ID if the URI has one.
+func connectToRelay(uri *url.URL, certs []tls.Certificate) (*tls.Conn, error) {
+	if uri.Scheme != "relay" {
+		return nil, fmt.Errorf("unsupported relay scheme %q", uri.Scheme)
+	}
+
+	tcpConn, err := dialer.DialTimeout("tcp", uri.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(tcpConn, &tls.Config{
+		Certificates:       certs,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	conn.SetDeadline(time.Now().Add(messageTimeout))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if relayIDs := uri.Query().Get("id"); relayIDs != "" {
+		relayID, err := protocol.DeviceIDFromString(relayIDs)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("relay id: %v", err)
+		}
+
+		certs := conn.ConnectionState().PeerCertificates
+		if len(certs) != 1 {
+			conn.Close()
+			return nil, fmt.Errorf("unexpected certificate count %d", len(certs))
+		}
+		if remoteID := protocol.NewDeviceID(certs[0].Raw); remoteID != relayID {
+			conn.Close()
+			return nil, fmt.Errorf("relay id does not match: expected %s got %s", relayID, remoteID)
+		}
+	}
+
+	return conn, nil
+}
+
+// fillAddress sets the session address in the invitation to the address of
+// the relay, when the relay didn't send one.
+func fillAddress(invitation *SessionInvitation, conn net.Conn) {
+	if len(invitation.Address) > 0 && !net.IP(invitation.Address).IsUnspecified() {
+		return
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ip := addr.IP.To4(); ip != nil {
+			invitation.Address = ip
+		} else {
+			invitation.Address = addr.IP
+		}
+	}
+}
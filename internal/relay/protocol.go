@@ -0,0 +1,153 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Response codes sent by the relay.
+const (
+	ResponseCodeSuccess       = 0
+	ResponseCodeNotFound      = 1
+	ResponseCodeAlreadyJoined = 2
+	ResponseCodeUnexpected    = 100
+)
+
+var (
+	ResponseSuccess       = Response{ResponseCodeSuccess, "success"}
+	ResponseNotFound      = Response{ResponseCodeNotFound, "not found"}
+	ResponseAlreadyJoined = Response{ResponseCodeAlreadyJoined, "already joined"}
+	ResponseUnexpected    = Response{ResponseCodeUnexpected, "unexpected message"}
+)
+
+// The maximum accepted message body. The largest message is a
+// SessionInvitation or a Response, both of which are far smaller.
+const maxMessageLength = 2048
+
+var (
+	ErrIncorrectMagic = errors.New("incorrect magic number")
+	ErrMessageLength  = errors.New("message too long")
+)
+
+// WriteMessage writes the given message, prefixed by a header, to w.
+func WriteMessage(w io.Writer, message interface{}) error {
+	var msgType int32
+	var body []byte
+	var err error
+
+	switch msg := message.(type) {
+	case Ping:
+		msgType = messageTypePing
+		body, err = msg.MarshalXDR()
+	case Pong:
+		msgType = messageTypePong
+		body, err = msg.MarshalXDR()
+	case JoinRelayRequest:
+		msgType = messageTypeJoinRelayRequest
+		body, err = msg.MarshalXDR()
+	case JoinSessionRequest:
+		msgType = messageTypeJoinSessionRequest
+		body, err = msg.MarshalXDR()
+	case Response:
+		msgType = messageTypeResponse
+		body, err = msg.MarshalXDR()
+	case ConnectRequest:
+		msgType = messageTypeConnectRequest
+		body, err = msg.MarshalXDR()
+	case SessionInvitation:
+		msgType = messageTypeSessionInvitation
+		body, err = msg.MarshalXDR()
+	default:
+		err = fmt.Errorf("unknown message type %T", message)
+	}
+	if err != nil {
+		return err
+	}
+
+	hdr := header{
+		magic:         magic,
+		messageType:   msgType,
+		messageLength: int32(len(body)),
+	}
+	buf, err := hdr.AppendXDR(make([]byte, 0, 12+len(body)))
+	if err != nil {
+		return err
+	}
+	buf = append(buf, body...)
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadMessage reads a single message from r. The returned value is one of
+// the message types, not a pointer to it.
+func ReadMessage(r io.Reader) (interface{}, error) {
+	var hdr header
+	if err := hdr.DecodeXDR(r); err != nil {
+		return nil, err
+	}
+	if hdr.magic != magic {
+		return nil, ErrIncorrectMagic
+	}
+	if hdr.messageLength < 0 || hdr.messageLength > maxMessageLength {
+		return nil, ErrMessageLength
+	}
+
+	body := make([]byte, hdr.messageLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch hdr.messageType {
+	case messageTypePing:
+		var msg Ping
+		err := msg.UnmarshalXDR(body)
+		return msg, err
+	case messageTypePong:
+		var msg Pong
+		err := msg.UnmarshalXDR(body)
+		return msg, err
+	case messageTypeJoinRelayRequest:
+		var msg JoinRelayRequest
+		err := msg.UnmarshalXDR(body)
+		return msg, err
+	case messageTypeJoinSessionRequest:
+		var msg JoinSessionRequest
+		err := msg.UnmarshalXDR(body)
+		return msg, err
+	case messageTypeResponse:
+		var msg Response
+		err := msg.UnmarshalXDR(body)
+		return msg, err
+	case messageTypeConnectRequest:
+		var msg ConnectRequest
+		err := msg.UnmarshalXDR(body)
+		return msg, err
+	case messageTypeSessionInvitation:
+		var msg SessionInvitation
+		err := msg.UnmarshalXDR(body)
+		return msg, err
+	}
+
+	return nil, fmt.Errorf("unknown message type %d", hdr.messageType)
+}
+
+func (r Response) Error() string {
+	return fmt.Sprintf("relay: %s (code %d)", r.Message, r.Code)
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package relay
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundtrip(t *testing.T) {
+	msgs := []interface{}{
+		Ping{},
+		Pong{},
+		JoinRelayRequest{},
+		JoinSessionRequest{Key: []byte("0123456789abcdef0123456789abcdef")},
+		ResponseNotFound,
+		ConnectRequest{ID: make([]byte, 32)},
+		SessionInvitation{
+			From:         make([]byte, 32),
+			Key:          []byte("key"),
+			Address:      []byte{192, 0, 2, 42},
+			Port:         22068,
+			ServerSocket: true,
+		},
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		if err := WriteMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, msg := range msgs {
+		dec, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(dec, msg) {
+			t.Errorf("incorrect decode; %#v != %#v", dec, msg)
+		}
+	}
+}
+
+func TestReadMessageBadMagic(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, Ping{}); err != nil {
+		t.Fatal(err)
+	}
+	bs := buf.Bytes()
+	bs[0] ^= 0xff
+
+	if _, err := ReadMessage(bytes.NewReader(bs)); err != ErrIncorrectMagic {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -20,11 +20,12 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"code.google.com/p/go.text/unicode/norm"
 
 	"github.com/syncthing/syncthing/internal/ignore"
-	"github.com/syncthing/syncthing/internal/lamport"
+	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
@@ -45,6 +46,12 @@ type Walker struct {
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
 	IgnorePerms bool
+	// If IgnoreSymlinks is true, symbolic links are skipped. They are
+	// always skipped on systems that don't support them.
+	IgnoreSymlinks bool
+	// ShortID is the short device ID of the local device. It is used to
+	// update the version vector of changed files.
+	ShortID uint64
 }
 
 type TempNamer interface {
@@ -130,9 +137,59 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			return nil
 		}
 
+		var cf protocol.FileInfo
+		if w.CurrentFiler != nil {
+			cf = w.CurrentFiler.CurrentFile(rn)
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if w.IgnoreSymlinks || !osutil.SymlinksSupported {
+				if debug {
+					l.Debugln("skipping symlink:", rn)
+				}
+				return nil
+			}
+
+			target, err := os.Readlink(p)
+			if err != nil {
+				if debug {
+					l.Debugln("readlink error:", p, err)
+				}
+				return nil
+			}
+
+			// The link target is carried as the contents of the file, so
+			// that it can be transferred using the regular block requests.
+			target = filepath.ToSlash(target)
+			blocks, err := Blocks(strings.NewReader(target), w.BlockSize, int64(len(target)))
+			if err != nil {
+				if debug {
+					l.Debugln("hash link error:", p, err)
+				}
+				return nil
+			}
+
+			if w.CurrentFiler != nil {
+				if !protocol.IsDeleted(cf.Flags) && protocol.IsSymlink(cf.Flags) && BlocksEqual(cf.Blocks, blocks) {
+					return nil
+				}
+			}
+
+			f := protocol.FileInfo{
+				Name:    rn,
+				Version: cf.Version.Update(w.ShortID),
+				Flags:   protocol.FlagSymlink | protocol.FlagNoPermBits | 0666,
+				Blocks:  blocks,
+			}
+			if debug {
+				l.Debugln("symlink:", p, f)
+			}
+			fchan <- f
+			return nil
+		}
+
 		if info.Mode().IsDir() {
 			if w.CurrentFiler != nil {
-				cf := w.CurrentFiler.CurrentFile(rn)
 				permUnchanged := w.IgnorePerms || !protocol.HasPermissionBits(cf.Flags) || PermsEqual(cf.Flags, uint32(info.Mode()))
 				if !protocol.IsDeleted(cf.Flags) && protocol.IsDirectory(cf.Flags) && permUnchanged {
 					return nil
@@ -147,7 +204,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			}
 			f := protocol.FileInfo{
 				Name:     rn,
-				Version:  lamport.Default.Tick(0),
+				Version:  cf.Version.Update(w.ShortID),
 				Flags:    flags,
 				Modified: info.ModTime().Unix(),
 			}
@@ -160,7 +217,6 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 		if info.Mode().IsRegular() {
 			if w.CurrentFiler != nil {
-				cf := w.CurrentFiler.CurrentFile(rn)
 				permUnchanged := w.IgnorePerms || !protocol.HasPermissionBits(cf.Flags) || PermsEqual(cf.Flags, uint32(info.Mode()))
 				if !protocol.IsDeleted(cf.Flags) && cf.Modified == info.ModTime().Unix() && permUnchanged {
 					return nil
@@ -178,7 +234,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 			f := protocol.FileInfo{
 				Name:     rn,
-				Version:  lamport.Default.Tick(0),
+				Version:  cf.Version.Update(w.ShortID),
 				Flags:    flags,
 				Modified: info.ModTime().Unix(),
 			}
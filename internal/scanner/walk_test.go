@@ -18,6 +18,8 @@ package scanner
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	rdebug "runtime/debug"
@@ -25,6 +27,7 @@ import (
 	"testing"
 
 	"github.com/syncthing/syncthing/internal/ignore"
+	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
@@ -122,6 +125,59 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkSymlink(t *testing.T) {
+	if !osutil.SymlinksSupported {
+		t.Skip("symlinks not supported")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Symlink(filepath.Join("..", "target"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(ignoreSymlinks bool) []protocol.FileInfo {
+		w := Walker{
+			Dir:            dir,
+			BlockSize:      128 * 1024,
+			IgnoreSymlinks: ignoreSymlinks,
+		}
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		return files
+	}
+
+	// The link is reported with the (dangling) target as contents
+
+	files := walk(false)
+	if len(files) != 1 {
+		t.Fatalf("Incorrect length %d != 1", len(files))
+	}
+	if !files[0].IsSymlink() || files[0].Name != "link" {
+		t.Errorf("Incorrect file %v", files[0])
+	}
+	expected, _ := Blocks(bytes.NewReader([]byte("../target")), 128*1024, -1)
+	if !BlocksEqual(files[0].Blocks, expected) {
+		t.Errorf("Incorrect blocks %v != %v", files[0].Blocks, expected)
+	}
+
+	// The link is skipped when ignoring symlinks
+
+	if files := walk(true); len(files) != 0 {
+		t.Errorf("Unexpected files %v", files)
+	}
+}
+
 func TestWalkError(t *testing.T) {
 	w := Walker{
 		Dir:       "testdata-missing",
@@ -30,6 +30,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+
+	"github.com/syncthing/syncthing/internal/dialer"
 )
 
 // Upgrade to the given release, saving the previous binary with a ".old" extension.
@@ -70,7 +72,7 @@ func upgradeTo(path string, rel Release, archExtra string) error {
 
 // Returns the latest release, including prereleases or not depending on the argument
 func LatestRelease(prerelease bool) (Release, error) {
-	resp, err := http.Get("https://api.github.com/repos/syncthing/syncthing/releases?per_page=10")
+	resp, err := dialer.HTTPClient.Get("https://api.github.com/repos/syncthing/syncthing/releases?per_page=10")
 	if err != nil {
 		return Release{}, err
 	}
@@ -111,7 +113,7 @@ func readZip(url, dir string) (string, error) {
 	}
 
 	req.Header.Add("Accept", "application/octet-stream")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := dialer.HTTPClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,137 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build linux
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// watchNative watches the tree using inotify. An error is returned if the
+// watches can't be set up, otherwise it returns when the watcher is
+// stopped.
+func (w *Watcher) watchNative(events chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// The file is nonblocking and thus handled by the runtime poller, so
+	// closing it interrupts a blocked Read.
+	inotify := os.NewFile(uintptr(fd), "inotify")
+	defer inotify.Close()
+
+	// Inotify watches are not recursive, so we add a watch for every
+	// directory in the tree and keep track of which is which.
+	dirs := make(map[int32]string)
+	addWatches := func(rel string) error {
+		return filepath.Walk(filepath.Join(w.dir, rel), func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(w.dir, p)
+			if err != nil {
+				return nil
+			}
+			if rel == "." {
+				rel = ""
+			} else if w.ignore(rel) {
+				return filepath.SkipDir
+			}
+			wd, err := syscall.InotifyAddWatch(fd, p, inotifyMask|syscall.IN_ONLYDIR|syscall.IN_DONT_FOLLOW)
+			if err != nil {
+				return err
+			}
+			dirs[int32(wd)] = rel
+			return nil
+		})
+	}
+
+	if err := addWatches(""); err != nil {
+		return err
+	}
+
+	go func() {
+		<-w.stop
+		inotify.Close()
+	}()
+
+	var buf [64 * 1024]byte
+	for {
+		n, err := inotify.Read(buf[:])
+		if err != nil {
+			select {
+			case <-w.stop:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		for offs := 0; offs+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offs]))
+			nameStart := offs + syscall.SizeofInotifyEvent
+			offs = nameStart + int(ev.Len)
+			name := strings.TrimRight(string(buf[nameStart:offs]), "\x00")
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Events were lost; everything may have changed.
+				if !w.send(events, "") {
+					return nil
+				}
+				continue
+			}
+
+			dir, ok := dirs[ev.Wd]
+			if !ok {
+				continue
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				// The watched directory was removed.
+				delete(dirs, ev.Wd)
+				continue
+			}
+
+			rel := filepath.Join(dir, name)
+			if rel == "" || w.ignore(rel) {
+				continue
+			}
+
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				// Watch the new directory. Adding a watch for a directory
+				// moved within the tree returns its existing watch
+				// descriptor, updating the path we have for it.
+				if err := addWatches(rel); err != nil {
+					l.Infof("Cannot watch %s for changes: %v", filepath.Join(w.dir, rel), err)
+				}
+			}
+
+			if debug {
+				l.Debugf("%v: %s 0x%x", w, rel, ev.Mask)
+			}
+			if !w.send(events, rel) {
+				return nil
+			}
+		}
+	}
+}
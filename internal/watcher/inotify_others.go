@@ -13,28 +13,14 @@
 // You should have received a copy of the GNU General Public License along
 // with this program. If not, see <http://www.gnu.org/licenses/>.
 
-// Package lamport implements a simple Lamport Clock for versioning
-package lamport
+// +build !linux
 
-import "sync"
+package watcher
 
-var Default = Clock{}
+import "errors"
 
-type Clock struct {
-	val uint64
-	mut sync.Mutex
-}
-
-func (c *Clock) Tick(v uint64) uint64 {
-	c.mut.Lock()
-	if v > c.val {
-		c.val = v + 1
-		c.mut.Unlock()
-		return v + 1
-	} else {
-		c.val++
-		v = c.val
-		c.mut.Unlock()
-		return v
-	}
+// watchNative always fails, as there is no native change notification
+// support on this platform.
+func (w *Watcher) watchNative(events chan<- string) error {
+	return errors.New("not supported on this platform")
 }
@@ -0,0 +1,107 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type fileState struct {
+	size     int64
+	modified int64
+	mode     os.FileMode
+}
+
+// watchPoll walks the tree every pollIntv and reports the paths that were
+// added, removed or changed since the previous walk. It returns when the
+// watcher is stopped.
+func (w *Watcher) watchPoll(events chan<- string) {
+	ticker := time.NewTicker(w.pollIntv)
+	defer ticker.Stop()
+
+	prev := w.snapshot()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		cur := w.snapshot()
+		for rel, cs := range cur {
+			if ps, ok := prev[rel]; !ok || ps != cs {
+				if !w.send(events, rel) {
+					return
+				}
+			}
+		}
+		for rel := range prev {
+			if _, ok := cur[rel]; !ok {
+				if !w.send(events, rel) {
+					return
+				}
+			}
+		}
+		prev = cur
+	}
+}
+
+// snapshot returns the state of every non ignored file and directory in the
+// tree.
+func (w *Watcher) snapshot() map[string]fileState {
+	res := make(map[string]fileState)
+	filepath.Walk(w.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(w.dir, p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		if w.ignore(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			// Changes to the contents of a directory are reported for the
+			// contents themselves.
+			res[rel] = fileState{mode: info.Mode()}
+		} else {
+			res[rel] = fileState{
+				size:     info.Size(),
+				modified: info.ModTime().UnixNano(),
+				mode:     info.Mode(),
+			}
+		}
+		return nil
+	})
+	return res
+}
+
+// send delivers the path on events and returns true, or returns false if
+// the watcher was stopped first.
+func (w *Watcher) send(events chan<- string, rel string) bool {
+	select {
+	case events <- rel:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
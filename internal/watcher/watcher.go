@@ -0,0 +1,201 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package watcher reports changes in a directory tree. The native change
+// notification mechanism of the operating system is used where available,
+// with periodic polling of the tree as the fallback.
+package watcher
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxPaths is the maximum number of paths reported in one batch. Larger
+	// batches are reduced to the parent directories of the changed paths.
+	maxPaths = 64
+
+	// defaultPollIntv is the interval between walks of the tree when native
+	// change notification is unavailable.
+	defaultPollIntv = 10 * time.Second
+)
+
+// A Watcher watches a directory tree for changes. Changes are collected
+// over a delay window and then delivered as a batch of paths relative to
+// the watched directory. The empty path denotes the entire tree.
+type Watcher struct {
+	dir      string
+	delay    time.Duration
+	ignore   func(rel string) bool
+	pollIntv time.Duration
+	changes  chan []string
+	stop     chan struct{}
+}
+
+// New returns a new Watcher for the given directory. Changes are delivered
+// at most once per delay. Changes to paths for which the ignore function
+// returns true are not reported and ignored directories are not descended
+// into. The ignore function may be nil.
+func New(dir string, delay time.Duration, ignore func(rel string) bool) *Watcher {
+	if ignore == nil {
+		ignore = func(string) bool { return false }
+	}
+	return &Watcher{
+		dir:      dir,
+		delay:    delay,
+		ignore:   ignore,
+		pollIntv: defaultPollIntv,
+		changes:  make(chan []string),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Changes returns the channel on which batches of changed paths are
+// delivered.
+func (w *Watcher) Changes() <-chan []string {
+	return w.changes
+}
+
+// Serve watches the directory until Stop is called.
+func (w *Watcher) Serve() {
+	if debug {
+		l.Debugln(w, "starting")
+		defer l.Debugln(w, "exiting")
+	}
+
+	events := make(chan string, 256)
+	go func() {
+		if err := w.watchNative(events); err != nil {
+			l.Infof("Cannot watch %s for changes (%v); polling every %v instead", w.dir, err, w.pollIntv)
+			w.watchPoll(events)
+		}
+	}()
+
+	w.aggregate(events)
+}
+
+// Stop stops the watcher.
+func (w *Watcher) Stop() {
+	close(w.stop)
+}
+
+func (w *Watcher) String() string {
+	return "watcher/" + w.dir
+}
+
+// aggregate collects the changed paths received on events and delivers them
+// on the changes channel. The delay window starts with the first change
+// after a delivery, so a continuous stream of changes doesn't hold back
+// delivery indefinitely. Changes keep being collected while a batch is
+// waiting for the receiver.
+func (w *Watcher) aggregate(events <-chan string) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	pending := make(map[string]struct{})
+	timerRunning := false
+
+	var out chan []string
+	var batch []string
+
+	for {
+		select {
+		case <-w.stop:
+			return
+
+		case rel := <-events:
+			pending[rel] = struct{}{}
+			if !timerRunning {
+				timer.Reset(w.delay)
+				timerRunning = true
+			}
+
+		case <-timer.C:
+			timerRunning = false
+			for _, rel := range batch {
+				pending[rel] = struct{}{}
+			}
+			batch = reduce(pending)
+			pending = make(map[string]struct{})
+			out = w.changes
+			if debug {
+				l.Debugln(w, "changes", batch)
+			}
+
+		case out <- batch:
+			batch = nil
+			out = nil
+		}
+	}
+}
+
+// reduce returns the sorted list of paths, excluding those that are inside
+// another path in the set. While there are more than maxPaths entries, the
+// deepest paths are replaced by their parent directories.
+func reduce(paths map[string]struct{}) []string {
+	for {
+		var res []string
+		maxDepth := 0
+		for rel := range paths {
+			if !hasAncestor(paths, rel) {
+				res = append(res, rel)
+				if d := depth(rel); d > maxDepth {
+					maxDepth = d
+				}
+			}
+		}
+		if len(res) <= maxPaths {
+			sort.Strings(res)
+			return res
+		}
+
+		paths = make(map[string]struct{}, len(res))
+		for _, rel := range res {
+			if depth(rel) == maxDepth {
+				rel = parent(rel)
+			}
+			paths[rel] = struct{}{}
+		}
+	}
+}
+
+func hasAncestor(paths map[string]struct{}, rel string) bool {
+	for rel != "" {
+		rel = parent(rel)
+		if _, ok := paths[rel]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func depth(rel string) int {
+	if rel == "" {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+func parent(rel string) string {
+	dir := filepath.Dir(rel)
+	if dir == "." || dir == string(filepath.Separator) {
+		return ""
+	}
+	return dir
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReduce(t *testing.T) {
+	testcases := []struct {
+		in  []string
+		out []string
+	}{
+		{
+			[]string{"a", "b", "c"},
+			[]string{"a", "b", "c"},
+		},
+		{
+			[]string{"a/b", filepath.Join("a", "b", "c"), "a-c"},
+			[]string{"a-c", filepath.Join("a", "b")},
+		},
+		{
+			[]string{"a", filepath.Join("a", "b"), filepath.Join("a", "b", "c")},
+			[]string{"a"},
+		},
+		{
+			[]string{"", "a", "b"},
+			[]string{""},
+		},
+	}
+
+	for i, tc := range testcases {
+		paths := make(map[string]struct{})
+		for _, p := range tc.in {
+			paths[filepath.FromSlash(p)] = struct{}{}
+		}
+		if res := reduce(paths); !reflect.DeepEqual(res, tc.out) {
+			t.Errorf("%d: incorrect result %q != expected %q", i, res, tc.out)
+		}
+	}
+}
+
+func TestReduceMany(t *testing.T) {
+	paths := make(map[string]struct{})
+	for i := 0; i < 2*maxPaths; i++ {
+		paths[filepath.Join("dir", string(rune('a'+i%26)), strings.Repeat("x", i))] = struct{}{}
+	}
+	paths["file"] = struct{}{}
+
+	res := reduce(paths)
+	if len(res) > maxPaths {
+		t.Fatalf("too many paths, %d > %d", len(res), maxPaths)
+	}
+	if len(res) != 27 || res[0] != filepath.Join("dir", "a") || res[26] != "file" {
+		t.Errorf("incorrect result %q", res)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	testWatcher(t, false)
+}
+
+func TestWatcherPolling(t *testing.T) {
+	testWatcher(t, true)
+}
+
+func testWatcher(t *testing.T, polling bool) {
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "ignored"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New(dir, 50*time.Millisecond, func(rel string) bool {
+		return rel == "ignored" || strings.HasSuffix(rel, ".tmp")
+	})
+	w.pollIntv = 50 * time.Millisecond
+
+	if polling {
+		events := make(chan string)
+		go w.watchPoll(events)
+		go w.aggregate(events)
+	} else {
+		go w.Serve()
+	}
+	defer w.Stop()
+
+	// Give the watcher time to set up its watches or take the first
+	// snapshot.
+	time.Sleep(100 * time.Millisecond)
+
+	for _, name := range []string{"file", "file.tmp", filepath.Join("sub", "file"), filepath.Join("ignored", "file")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"file", filepath.Join("sub", "file")}
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < len(expected) {
+		select {
+		case batch := <-w.Changes():
+			for _, rel := range batch {
+				switch rel {
+				case expected[0], expected[1]:
+					seen[rel] = true
+				default:
+					t.Errorf("unexpected change %q", rel)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for changes; got %v", seen)
+		}
+	}
+}